@@ -0,0 +1,254 @@
+package merkle
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"sort"
+)
+
+// AbsenceProof shows that a value is not a leaf of a tree built with
+// WithSortedLeaves, by proving the two adjacent leaves bracketing it.
+//
+// Left is the greatest leaf smaller than the value; it is missing when the
+// value sorts before every leaf. Right is the smallest leaf bigger than the
+// value; when the value sorts after every leaf it is the empty (or padding)
+// leaf following them, and it is missing only if the tree is full
+type AbsenceProof struct {
+	HasLeft    bool
+	LeftNo     uint
+	Left       Hash
+	LeftProof  []ProofNode
+	HasRight   bool
+	RightNo    uint
+	Right      Hash
+	RightProof []ProofNode
+}
+
+// GetAbsenceProof returns a proof that value, given in the same form as the
+// leaves passed to Generate, is not a leaf of the tree. Trees built with
+// WithSalt or WithCombiner are rejected, VerifyAbsenceProof folds plain nodes
+func (self *SMT) GetAbsenceProof(value []byte) (AbsenceProof, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return AbsenceProof{}, errors.New("SMT tree is not filled")
+	}
+	if !self.sortedLeaves {
+		return AbsenceProof{}, errors.New("Tree leaves are not sorted")
+	}
+	if self.leafIndexBound {
+		return AbsenceProof{}, errors.New("Leaves are bound to their index")
+	}
+	if self.salt != nil {
+		return AbsenceProof{}, errors.New("Absence proofs do not support salted nodes")
+	}
+	if self.combiner != nil {
+		return AbsenceProof{}, errors.New("Absence proofs do not support node combiners")
+	}
+	hashes, err := self.leafHashes(0, [][]byte{value})
+	if err != nil {
+		return AbsenceProof{}, err
+	}
+	target := hashes[0]
+
+	leaves := self.fullNodes[0]
+	count := self.countOfNonEmptyLeaves
+	next := sort.Search(count, func(i int) bool {
+		return bytes.Compare(leaves[i], target) >= 0
+	})
+	if next < count && bytes.Equal(leaves[next], target) {
+		return AbsenceProof{}, errors.New("Value is in the tree")
+	}
+
+	proof := AbsenceProof{}
+	if next > 0 {
+		proof.HasLeft = true
+		proof.LeftNo = uint(next - 1)
+		proof.Left = leaves[next-1]
+		proof.LeftProof, _ = self.getMerkleProof(proof.LeftNo)
+	}
+	if next < self.capacity() {
+		proof.HasRight = true
+		proof.RightNo = uint(next)
+		proof.Right = self.emptyTreeRootHash[0]
+		if next < count {
+			proof.Right = leaves[next]
+		}
+		proof.RightProof, _ = self.getMerkleProof(proof.RightNo)
+	}
+	return proof, nil
+}
+
+// VerifyAbsenceProof checks that value, in the form stored as leaf, is absent
+// from the sorted set tree with the given root. For a tree built with
+// WithPaddingLeaf, emptyHash is the padding leaf
+func VerifyAbsenceProof(value Hash, proof AbsenceProof, root []byte, emptyHash Hash, hashFunc hash.Hash) error {
+	if !proof.HasLeft && !proof.HasRight {
+		return errors.New("Absence proof has no neighbour")
+	}
+	if proof.HasLeft && proof.HasRight && len(proof.LeftProof) != len(proof.RightProof) {
+		return errors.New("Absence proof neighbours have different heights")
+	}
+	rightIsEmpty := proof.HasRight && bytes.Equal(proof.Right, emptyHash)
+
+	if proof.HasLeft {
+		if bytes.Compare(proof.Left, value) >= 0 {
+			return errors.New("Left neighbour does not precede the value")
+		}
+		if !proof.HasRight && proof.LeftNo != uint(1)<<uint(len(proof.LeftProof))-1 {
+			return errors.New("Left neighbour is not the last leaf")
+		}
+		if err := verifyPositionedProof(proof.Left, proof.LeftNo, proof.LeftProof, root, hashFunc); err != nil {
+			return err
+		}
+	}
+	if proof.HasRight {
+		if !rightIsEmpty && bytes.Compare(value, proof.Right) >= 0 {
+			return errors.New("Right neighbour does not follow the value")
+		}
+		if proof.HasLeft && proof.RightNo != proof.LeftNo+1 {
+			return errors.New("Absence proof neighbours are not adjacent")
+		}
+		if !proof.HasLeft && proof.RightNo != 0 {
+			return errors.New("Right neighbour is not the first leaf")
+		}
+		if err := verifyPositionedProof(proof.Right, proof.RightNo, proof.RightProof, root, hashFunc); err != nil {
+			return err
+		}
+		if rightIsEmpty {
+			// An empty neighbour only ends the set if nothing follows it
+			emptyRight, err := isEmptyRight(proof.RightProof, emptyHash, hashFunc, nil)
+			if err != nil {
+				return err
+			}
+			if !emptyRight {
+				return errors.New("Leaves follow the empty right neighbour")
+			}
+		}
+	}
+	return nil
+}
+
+// GetInsertionPointProof returns the position the next appended leaf would
+// take, right after the last non empty leaf, and the proof of the empty (or
+// padding) leaf currently there. It fails if the tree is full
+func (self *SMT) GetInsertionPointProof() (leafNo uint, proof []ProofNode, err error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return 0, nil, errors.New("SMT tree is not filled")
+	}
+	if self.countOfNonEmptyLeaves == self.capacity() {
+		return 0, nil, errors.New("SMT tree is full")
+	}
+	leafNo = uint(self.countOfNonEmptyLeaves)
+	return leafNo, self.proofToLevel(leafNo, 0), nil
+}
+
+// CompletenessProof shows that the non empty leaves of a tree are exactly the
+// positions [0, Count): LastProof proves the last of them, and EmptyProof the
+// empty (or padding) leaf at Count along with the empty subtrees right of it.
+// LastProof is missing when Count is 0, and EmptyProof when the tree is full
+type CompletenessProof struct {
+	Count      uint
+	LastProof  []ProofNode
+	EmptyProof []ProofNode
+}
+
+// GetCompletenessProof returns the proof that the non empty leaves are
+// exactly the first ones of the tree. A tree with unset positions of
+// WithIndexedLeaves has no such proof, nor has a tree built with WithSalt or
+// WithCombiner
+func (self *SMT) GetCompletenessProof() (CompletenessProof, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return CompletenessProof{}, errors.New("SMT tree is not filled")
+	}
+	if self.capacityInRoot {
+		return CompletenessProof{}, errors.New("Completeness proofs do not support capacity bound roots")
+	}
+	if self.rootTag != nil {
+		return CompletenessProof{}, errors.New("Completeness proofs do not support tagged roots")
+	}
+	if self.emptyNodeSeed != nil {
+		return CompletenessProof{}, errors.New("Completeness proofs do not support seeded empty nodes")
+	}
+	if self.salt != nil {
+		return CompletenessProof{}, errors.New("Completeness proofs do not support salted nodes")
+	}
+	if self.combiner != nil {
+		return CompletenessProof{}, errors.New("Completeness proofs do not support node combiners")
+	}
+	if len(self.unsetLeaves) != 0 {
+		return CompletenessProof{}, errors.New("Tree has unset leaves")
+	}
+	count := uint(self.countOfNonEmptyLeaves)
+	proof := CompletenessProof{Count: count}
+	if count > 0 {
+		proof.LastProof = self.proofToLevel(count-1, 0)
+	}
+	if count < uint(self.capacity()) {
+		proof.EmptyProof = self.proofToLevel(count, 0)
+	}
+	return proof, nil
+}
+
+// VerifyCompletenessProof checks that a tree with the given root holds
+// exactly count non empty leaves, the last of which is lastLeaf in stored
+// form. Together with the proofs of the other leaves it shows a verifier has
+// the full leaf set. For a tree built with WithPaddingLeaf, emptyHash is the
+// padding leaf
+func VerifyCompletenessProof(count uint, lastLeaf Hash, proof CompletenessProof, root []byte, emptyHash Hash, hashFunc hash.Hash) error {
+	if count != proof.Count {
+		return errors.New("Completeness proof is for another leaf count")
+	}
+	if count > 0 {
+		if bytes.Equal(lastLeaf, emptyHash) {
+			return errors.New("Last leaf is empty")
+		}
+		if err := verifyPositionedProof(lastLeaf, count-1, proof.LastProof, root, hashFunc); err != nil {
+			return err
+		}
+	}
+	if proof.EmptyProof == nil {
+		if count == 0 || count != uint(1)<<uint(len(proof.LastProof)) {
+			return errors.New("Completeness proof is missing the empty leaf")
+		}
+		return nil
+	}
+	if count > 0 && len(proof.LastProof) != len(proof.EmptyProof) {
+		return errors.New("Completeness proofs have different heights")
+	}
+	if err := verifyPositionedProof(emptyHash, count, proof.EmptyProof, root, hashFunc); err != nil {
+		return err
+	}
+	emptyRight, err := isEmptyRight(proof.EmptyProof, emptyHash, hashFunc, nil)
+	if err != nil {
+		return err
+	}
+	if !emptyRight {
+		return errors.New("Leaves follow the claimed count")
+	}
+	return nil
+}
+
+// Following are non public function
+
+// Verifies a proof whose directions must match leafNo, since the position of
+// the leaf matters to the caller
+func verifyPositionedProof(leafHash Hash, leafNo uint, proof []ProofNode, root []byte, hashFunc hash.Hash) error {
+	return NewVerifier(hashFunc, WithStrictDirections()).VerifyProof(leafHash, leafNo, proof, root)
+}
+
+// Returns true if every node is on the side implied by leafNo and leafNo fits
+// into a tree of the proof height
+func directionsMatch(leafNo uint, proof []ProofNode) bool {
+	for i, node := range proof {
+		if node.Left != ((leafNo>>uint(i))&1 == 1) {
+			return false
+		}
+	}
+	return leafNo>>uint(len(proof)) == 0
+}
@@ -0,0 +1,217 @@
+package merkle
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAbsenceProof(t *testing.T) {
+	sorted := sortedTestHashes()
+	//every other hash is a leaf, the rest are absent values
+	leaves := [][]byte{}
+	for i := 1; i < len(sorted)-1; i += 2 {
+		leaves = append(leaves, sorted[i])
+	}
+	tree := NewSMT(emptyHash, hashFunc, WithSortedLeaves())
+	err := tree.Generate(leaves, 16)
+	assert.Nil(t, err)
+	root := tree.RootHash()
+
+	//in the middle
+	proof, err := tree.GetAbsenceProof(sorted[4])
+	assert.Nil(t, err)
+	assert.True(t, proof.HasLeft && proof.HasRight)
+	assert.Equal(t, uint(1), proof.LeftNo)
+	assert.Equal(t, uint(2), proof.RightNo)
+	assert.Nil(t, VerifyAbsenceProof(sorted[4], proof, root, emptyHash, hashFunc))
+	assert.NotNil(t, VerifyAbsenceProof(sorted[6], proof, root, emptyHash, hashFunc))
+
+	//before the first leaf
+	proof, err = tree.GetAbsenceProof(sorted[0])
+	assert.Nil(t, err)
+	assert.False(t, proof.HasLeft)
+	assert.Equal(t, uint(0), proof.RightNo)
+	assert.Nil(t, VerifyAbsenceProof(sorted[0], proof, root, emptyHash, hashFunc))
+
+	//after the last leaf, bracketed by the first empty leaf
+	proof, err = tree.GetAbsenceProof(sorted[15])
+	assert.Nil(t, err)
+	assert.Equal(t, uint(len(leaves)-1), proof.LeftNo)
+	assert.Equal(t, emptyHash, []byte(proof.Right))
+	assert.Nil(t, VerifyAbsenceProof(sorted[15], proof, root, emptyHash, hashFunc))
+
+	//a leaf has no absence proof
+	_, err = tree.GetAbsenceProof(sorted[3])
+	assert.Equal(t, "Value is in the tree", err.Error())
+}
+
+func TestAbsenceProofFullAndEmptyTree(t *testing.T) {
+	sorted := sortedTestHashes()
+	tree := NewSMT(emptyHash, hashFunc, WithSortedLeaves())
+	err := tree.Generate(sorted[:8], 8)
+	assert.Nil(t, err)
+	proof, err := tree.GetAbsenceProof(sorted[15])
+	assert.Nil(t, err)
+	assert.False(t, proof.HasRight)
+	assert.Nil(t, VerifyAbsenceProof(sorted[15], proof, tree.RootHash(), emptyHash, hashFunc))
+
+	tree = NewSMT(emptyHash, hashFunc, WithSortedLeaves())
+	err = tree.Generate(nil, 8)
+	assert.Nil(t, err)
+	proof, err = tree.GetAbsenceProof(sorted[0])
+	assert.Nil(t, err)
+	assert.False(t, proof.HasLeft)
+	assert.Nil(t, VerifyAbsenceProof(sorted[0], proof, tree.RootHash(), emptyHash, hashFunc))
+
+	tree = NewSMT(emptyHash, hashFunc)
+	err = tree.Generate(sorted[:8], 8)
+	assert.Nil(t, err)
+	_, err = tree.GetAbsenceProof(sorted[15])
+	assert.Equal(t, "Tree leaves are not sorted", err.Error())
+
+	tree = NewSMT(emptyHash, hashFunc, WithSortedLeaves(), WithSalt([]byte("salt")))
+	err = tree.Generate(sorted[:4], 8)
+	assert.Nil(t, err)
+	_, err = tree.GetAbsenceProof(sorted[15])
+	assert.Equal(t, "Absence proofs do not support salted nodes", err.Error())
+
+	tree = NewSMT(emptyHash, hashFunc, WithSortedLeaves(), WithCombiner(swapCombiner))
+	err = tree.Generate(sorted[:4], 8)
+	assert.Nil(t, err)
+	_, err = tree.GetAbsenceProof(sorted[15])
+	assert.Equal(t, "Absence proofs do not support node combiners", err.Error())
+}
+
+func TestAbsenceProofForged(t *testing.T) {
+	sorted := sortedTestHashes()
+	leaves := [][]byte{sorted[1], sorted[3], sorted[5], sorted[7]}
+	tree := NewSMT(emptyHash, hashFunc, WithSortedLeaves())
+	err := tree.Generate(leaves, 8)
+	assert.Nil(t, err)
+	root := tree.RootHash()
+
+	//skipping a leaf between the neighbours
+	proof, err := tree.GetAbsenceProof(sorted[2])
+	assert.Nil(t, err)
+	right, _ := tree.GetMerkleProof(2)
+	forged := proof
+	forged.RightNo, forged.Right, forged.RightProof = 2, sorted[5], right
+	assert.Equal(t, "Absence proof neighbours are not adjacent", VerifyAbsenceProof(sorted[3], forged, root, emptyHash, hashFunc).Error())
+
+	//lying about the position of a neighbour
+	forged = proof
+	forged.LeftNo = 2
+	assert.Equal(t, "Proof directions do not match the leaf number", VerifyAbsenceProof(sorted[2], forged, root, emptyHash, hashFunc).Error())
+
+	//claiming the value sorts before the first leaf
+	forged = proof
+	forged.HasLeft = false
+	assert.Equal(t, "Right neighbour is not the first leaf", VerifyAbsenceProof(sorted[2], forged, root, emptyHash, hashFunc).Error())
+
+	//an empty right neighbour followed by the value itself
+	gapped := NewSMT(emptyHash, hashFunc)
+	err = gapped.Generate([][]byte{sorted[1], emptyHash, sorted[5]}, 4)
+	assert.Nil(t, err)
+	forged = AbsenceProof{HasLeft: true, LeftNo: 0, Left: sorted[1], HasRight: true, RightNo: 1, Right: emptyHash}
+	forged.LeftProof, _ = gapped.GetMerkleProof(0)
+	forged.RightProof, _ = gapped.GetMerkleProof(1)
+	assert.Equal(t, "Leaves follow the empty right neighbour", VerifyAbsenceProof(sorted[5], forged, gapped.RootHash(), emptyHash, hashFunc).Error())
+}
+
+func TestGetInsertionPointProof(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	_, _, err := tree.GetInsertionPointProof()
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+
+	for _, count := range []int{0, 1, 5, 15} {
+		tree := NewSMT(emptyHash, hashFunc)
+		err := tree.Generate(testHashes[:count], 16)
+		assert.Nil(t, err)
+		leafNo, proof, err := tree.GetInsertionPointProof()
+		assert.Nil(t, err)
+		assert.Equal(t, uint(count), leafNo)
+		assert.Nil(t, VerifyProof(emptyHash, leafNo, proof, tree.RootHash(), hashFunc))
+
+		//the next appended leaf lands there
+		appended, err := tree.AppendLeaf(testHashes[15])
+		assert.Nil(t, err)
+		assert.Equal(t, leafNo, appended)
+	}
+
+	tree = NewSMT(emptyHash, hashFunc)
+	err = tree.Generate(testHashes, 16)
+	assert.Nil(t, err)
+	_, _, err = tree.GetInsertionPointProof()
+	assert.Equal(t, "SMT tree is full", err.Error())
+}
+
+func TestCompletenessProof(t *testing.T) {
+	for _, count := range []int{0, 1, 5, 15, 16} {
+		tree := NewSMT(emptyHash, hashFunc)
+		err := tree.Generate(testHashes[:count], 16)
+		assert.Nil(t, err)
+		proof, err := tree.GetCompletenessProof()
+		assert.Nil(t, err)
+		assert.Equal(t, uint(count), proof.Count)
+		var last Hash
+		if count > 0 {
+			last = testHashes[count-1]
+		}
+		err = VerifyCompletenessProof(uint(count), last, proof, tree.RootHash(), emptyHash, hashFunc)
+		assert.Nil(t, err)
+		if count > 0 {
+			err = VerifyCompletenessProof(uint(count), testHashes[count%16], proof, tree.RootHash(), emptyHash, hashFunc)
+			assert.NotNil(t, err)
+		}
+	}
+
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:6], 16)
+	assert.Nil(t, err)
+	proof, err := tree.GetCompletenessProof()
+	assert.Nil(t, err)
+	err = VerifyCompletenessProof(5, testHashes[4], proof, tree.RootHash(), emptyHash, hashFunc)
+	assert.Equal(t, "Completeness proof is for another leaf count", err.Error())
+
+	//claiming fewer leaves than set: leaf 5 is not empty
+	claimed := CompletenessProof{Count: 5}
+	claimed.LastProof, _ = tree.GetMerkleProof(4)
+	claimed.EmptyProof, _ = tree.GetMerkleProof(5)
+	err = VerifyCompletenessProof(5, testHashes[4], claimed, tree.RootHash(), emptyHash, hashFunc)
+	assert.NotNil(t, err)
+
+	//the leaf at the claimed count is empty but a later one is set
+	indexed := NewSMT(emptyHash, hashFunc, WithIndexedLeaves())
+	err = indexed.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+	err = indexed.SetLeaf(9, testHashes[9])
+	assert.Nil(t, err)
+	_, err = indexed.GetCompletenessProof()
+	assert.Equal(t, "Tree has unset leaves", err.Error())
+	claimed = CompletenessProof{Count: 5}
+	claimed.LastProof, _ = indexed.GetMerkleProof(4)
+	claimed.EmptyProof, _ = indexed.GetMerkleProof(5)
+	err = VerifyCompletenessProof(5, testHashes[4], claimed, indexed.RootHash(), emptyHash, hashFunc)
+	assert.Equal(t, "Leaves follow the claimed count", err.Error())
+
+	//only a full tree may omit the empty leaf proof
+	claimed.EmptyProof = nil
+	err = VerifyCompletenessProof(5, testHashes[4], claimed, indexed.RootHash(), emptyHash, hashFunc)
+	assert.Equal(t, "Completeness proof is missing the empty leaf", err.Error())
+
+	salted := NewSMT(emptyHash, hashFunc, WithSalt([]byte("salt")))
+	err = salted.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+	_, err = salted.GetCompletenessProof()
+	assert.Equal(t, "Completeness proofs do not support salted nodes", err.Error())
+	combined := NewSMT(emptyHash, hashFunc, WithCombiner(swapCombiner))
+	err = combined.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+	_, err = combined.GetCompletenessProof()
+	assert.Equal(t, "Completeness proofs do not support node combiners", err.Error())
+}
+
+// Hashes the right child before the left one
+func swapCombiner(left, right []byte) ([]byte, error) {
+	return hashPair(hashFunc, right, left)
+}
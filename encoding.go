@@ -0,0 +1,315 @@
+package merkle
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+)
+
+const abiWordSize = 32
+
+// Version of the ContentID layout
+const contentIDVersion byte = 1
+
+// Direction bytes of the standard proof encoding
+const (
+	standardSiblingRight byte = 0x00
+	standardSiblingLeft  byte = 0x01
+)
+
+// ABIEncodeProof encodes proof as the Solidity ABI encoding of
+// (bytes32[] siblings, uint256 directions), where bit i of directions is set
+// when proof[i] is a left sibling. Every hash must be 32 bytes long
+func ABIEncodeProof(proof []ProofNode) ([]byte, error) {
+	if len(proof) > abiWordSize*8 {
+		return nil, errors.New("Proof is too long for a uint256 direction bitmap")
+	}
+	encoded := make([]byte, abiWordSize*(3+len(proof)))
+
+	// Head: offset of the dynamic array, then the direction bitmap
+	binary.BigEndian.PutUint64(encoded[abiWordSize-8:abiWordSize], 2*abiWordSize)
+	directions := encoded[abiWordSize : 2*abiWordSize]
+	// Tail: array length followed by its elements
+	binary.BigEndian.PutUint64(encoded[3*abiWordSize-8:3*abiWordSize], uint64(len(proof)))
+
+	for i, node := range proof {
+		if len(node.Hash) != abiWordSize {
+			return nil, errors.New("Proof hash is not 32 bytes")
+		}
+		if node.Left {
+			directions[abiWordSize-1-i/8] |= 1 << uint(i%8)
+		}
+		copy(encoded[abiWordSize*(3+i):], node.Hash)
+	}
+	return encoded, nil
+}
+
+// GetMerkleProofStandard returns the proof of a leaf in the standard byte
+// encoding: one record per proof node, bottom up, each record being a
+// direction byte (0x01 if the sibling is on the left, 0x00 if it is on the
+// right) followed by the sibling hash. With 32 byte hashes every record is 33
+// bytes long. See ParseProofStandard
+func (self *SMT) GetMerkleProofStandard(leafNo uint) ([]byte, error) {
+	proof, err := self.GetMerkleProof(leafNo)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeProofStandard(proof)
+}
+
+// EncodeProofStandard encodes proof in the layout described on
+// GetMerkleProofStandard. All hashes must have the same length
+func EncodeProofStandard(proof []ProofNode) ([]byte, error) {
+	if len(proof) == 0 {
+		return []byte{}, nil
+	}
+	hashSize := len(proof[0].Hash)
+	encoded := make([]byte, 0, len(proof)*(1+hashSize))
+	for _, node := range proof {
+		if len(node.Hash) != hashSize {
+			return nil, errors.New("Proof hashes differ in size")
+		}
+		encoded = appendStandardRecord(encoded, node)
+	}
+	return encoded, nil
+}
+
+// ParseProofStandard decodes a proof encoded as described on
+// GetMerkleProofStandard, given the size of the hashes
+func ParseProofStandard(data []byte, hashSize int) ([]ProofNode, error) {
+	if hashSize <= 0 {
+		return nil, errors.New("Hash size must be positive")
+	}
+	recordSize := 1 + hashSize
+	if len(data)%recordSize != 0 {
+		return nil, errors.New("Proof length is not a multiple of the record size")
+	}
+	proof := make([]ProofNode, 0, len(data)/recordSize)
+	for offset := 0; offset < len(data); offset += recordSize {
+		node, err := parseStandardRecord(data[offset : offset+recordSize])
+		if err != nil {
+			return nil, err
+		}
+		proof = append(proof, node)
+	}
+	return proof, nil
+}
+
+// MarshalFixed packs proof into fixed width records of one direction byte
+// and exactly hashSize hash bytes, the layout described on
+// GetMerkleProofStandard, so a proof of a tree of height h is always
+// (h-1)*(1+hashSize) bytes long. It fails if any hash has another size
+func MarshalFixed(proof []ProofNode, hashSize int) ([]byte, error) {
+	if hashSize <= 0 {
+		return nil, errors.New("Hash size must be positive")
+	}
+	encoded := make([]byte, 0, len(proof)*(1+hashSize))
+	for _, node := range proof {
+		if len(node.Hash) != hashSize {
+			return nil, errors.New("Proof hash does not match the hash size")
+		}
+		encoded = appendStandardRecord(encoded, node)
+	}
+	return encoded, nil
+}
+
+// UnmarshalFixed decodes a proof packed by MarshalFixed
+func UnmarshalFixed(data []byte, hashSize int) ([]ProofNode, error) {
+	return ParseProofStandard(data, hashSize)
+}
+
+// WriteMerkleProof writes the proof of a leaf to w in the stream encoding,
+// see WriteProof
+func (self *SMT) WriteMerkleProof(w io.Writer, leafNo uint) error {
+	proof, err := self.GetMerkleProof(leafNo)
+	if err != nil {
+		return err
+	}
+	return WriteProof(w, proof)
+}
+
+// WriteProof writes proof to w as a big endian uint32 node count followed by
+// one standard record per node (see GetMerkleProofStandard), so a reader can
+// consume the nodes one at a time with VerifyProofStream
+func WriteProof(w io.Writer, proof []ProofNode) error {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(proof)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	record := []byte{}
+	for _, node := range proof {
+		record = appendStandardRecord(record[:0], node)
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProofsDigest commits to the proofs of the given leaves with the tree's hash
+// function. The leaves are taken in increasing order, duplicates once, each
+// as its big endian uint64 number followed by its proof as written by
+// WriteProof, so the digest does not depend on the order of indices
+func (self *SMT) ProofsDigest(indices []uint) ([]byte, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return nil, errors.New("SMT tree is not filled")
+	}
+	leafNos := append([]uint{}, indices...)
+	sort.Slice(leafNos, func(i, j int) bool { return leafNos[i] < leafNos[j] })
+	for _, leafNo := range leafNos {
+		if leafNo >= uint(self.capacity()) {
+			return nil, errors.New("Leaf number is out of range")
+		}
+	}
+
+	self.hashMu.Lock()
+	defer self.hashMu.Unlock()
+	defer self.hashFunc.Reset()
+	encoded := make([]byte, 8)
+	for i, leafNo := range leafNos {
+		if i > 0 && leafNo == leafNos[i-1] {
+			continue
+		}
+		binary.BigEndian.PutUint64(encoded, uint64(leafNo))
+		if _, err := self.hashFunc.Write(encoded); err != nil {
+			return nil, err
+		}
+		if err := WriteProof(self.hashFunc, self.proofToLevel(leafNo, 0)); err != nil {
+			return nil, err
+		}
+	}
+	return checkedSum(self.hashFunc, nil)
+}
+
+// HexProofNode is a ProofNode with the hash as a lowercase hex string, ready
+// for a JSON response
+type HexProofNode struct {
+	Left bool   `json:"left"`
+	Hash string `json:"hash"`
+}
+
+// GetMerkleProofHex returns the proof of a leaf with hex encoded hashes,
+// prefixed with 0x if the tree was created with WithHexPrefix
+func (self *SMT) GetMerkleProofHex(leafNo uint) ([]HexProofNode, error) {
+	proof, err := self.GetMerkleProof(leafNo)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if self.hexPrefix {
+		prefix = "0x"
+	}
+	nodes := make([]HexProofNode, 0, len(proof))
+	for _, node := range proof {
+		nodes = append(nodes, HexProofNode{Left: node.Left, Hash: prefix + hex.EncodeToString(node.Hash)})
+	}
+	return nodes, nil
+}
+
+// ToJSON writes the tree as a JSON document for inspection: the height
+// (levels, leaves included), capacity, occupancy and root, and every level
+// from the root down to the leaves. A level lists its stored nodes in hex,
+// followed by the number of nodes synthesized as roots of empty subtrees and
+// the hash they all share
+func (self *SMT) ToJSON(w io.Writer) error {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return errors.New("SMT tree is not filled")
+	}
+	doc := jsonTree{
+		Height:    self.treeHeight,
+		Capacity:  self.capacity(),
+		Occupancy: float64(self.countOfNonEmptyLeaves-len(self.unsetLeaves)) / float64(self.capacity()),
+		Root:      hex.EncodeToString(self.rootHash()),
+	}
+	for level := 0; level < self.treeHeight; level++ {
+		height := self.treeHeight - 1 - level
+		stored := self.fullNodes[height]
+		nodes := make([]string, 0, len(stored))
+		for _, hash := range stored {
+			nodes = append(nodes, hex.EncodeToString(hash))
+		}
+		jsonLevel := jsonLevel{Level: level, Nodes: nodes, EmptyNodes: 1<<uint(level) - len(stored)}
+		if jsonLevel.EmptyNodes > 0 {
+			jsonLevel.EmptyHash = hex.EncodeToString(self.emptyTreeRootHash[height])
+		}
+		doc.Levels = append(doc.Levels, jsonLevel)
+	}
+	return json.NewEncoder(w).Encode(doc)
+}
+
+// ContentID returns a canonical encoding of the tree identity: a version
+// byte, the length prefixed hash algorithm identifier, the big endian uint64
+// capacity and the root. Trees producing the same proofs share a ContentID.
+// It returns nil if the tree is not filled
+func (self *SMT) ContentID() []byte {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	root := self.rootHash()
+	if root == nil {
+		return nil
+	}
+	algorithm := hashAlgorithmID(self.hashFunc)
+	id := make([]byte, 0, 1+2+len(algorithm)+8+len(root))
+	id = append(id, contentIDVersion)
+	id = append(id, byte(len(algorithm)>>8), byte(len(algorithm)))
+	id = append(id, algorithm...)
+	capacity := make([]byte, 8)
+	binary.BigEndian.PutUint64(capacity, uint64(self.capacity()))
+	id = append(id, capacity...)
+	return append(id, root...)
+}
+
+// Following are non public function
+
+// Identifies the hash algorithm by its implementation type and output size
+func hashAlgorithmID(hashFunc hash.Hash) string {
+	return fmt.Sprintf("%T/%d", hashFunc, hashFunc.Size())
+}
+
+// Layout of ToJSON
+type jsonTree struct {
+	Height    int         `json:"height"`
+	Capacity  int         `json:"capacity"`
+	Occupancy float64     `json:"occupancy"`
+	Root      string      `json:"root"`
+	Levels    []jsonLevel `json:"levels"`
+}
+
+type jsonLevel struct {
+	Level      int      `json:"level"`
+	Nodes      []string `json:"nodes"`
+	EmptyNodes int      `json:"emptyNodes"`
+	EmptyHash  string   `json:"emptyHash,omitempty"`
+}
+
+func appendStandardRecord(dst []byte, node ProofNode) []byte {
+	if node.Left {
+		dst = append(dst, standardSiblingLeft)
+	} else {
+		dst = append(dst, standardSiblingRight)
+	}
+	return append(dst, node.Hash...)
+}
+
+func parseStandardRecord(record []byte) (ProofNode, error) {
+	var left bool
+	switch record[0] {
+	case standardSiblingLeft:
+		left = true
+	case standardSiblingRight:
+		left = false
+	default:
+		return ProofNode{}, errors.New("Invalid proof direction byte")
+	}
+	return ProofNode{Left: left, Hash: append([]byte{}, record[1:]...)}, nil
+}
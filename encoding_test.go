@@ -0,0 +1,307 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestABIEncodeProof(t *testing.T) {
+	leaves := [][]byte{}
+	for i := 0; i < 5; i++ {
+		leaves = append(leaves, hashValue([]byte{byte(i)}, sha256.New()))
+	}
+	tree := NewSMT(emptyHashFunc(sha256.New()), sha256.New())
+	err := tree.Generate(leaves, 16)
+	assert.Nil(t, err)
+
+	proof, err := tree.GetMerkleProof(5)
+	assert.Nil(t, err)
+	encoded, err := ABIEncodeProof(proof)
+	assert.Nil(t, err)
+	assert.Equal(t, 32*(3+4), len(encoded))
+
+	offset := new(big.Int).SetBytes(encoded[0:32])
+	assert.Equal(t, int64(64), offset.Int64())
+	length := binary.BigEndian.Uint64(encoded[88:96])
+	assert.Equal(t, uint64(len(proof)), length)
+
+	directions := new(big.Int).SetBytes(encoded[32:64])
+	for i, node := range proof {
+		assert.Equal(t, node.Left, directions.Bit(i) == 1)
+		assert.Equal(t, []byte(node.Hash), encoded[96+32*i:128+32*i])
+	}
+	//siblings are on the left exactly where the leaf index has a 1 bit
+	assert.Equal(t, int64(5), directions.Int64())
+}
+
+func TestABIEncodeProofInvalid(t *testing.T) {
+	_, err := ABIEncodeProof([]ProofNode{{Hash: testHashes[0]}})
+	assert.Equal(t, "Proof hash is not 32 bytes", err.Error())
+
+	_, err = ABIEncodeProof(make([]ProofNode, 257))
+	assert.Equal(t, "Proof is too long for a uint256 direction bitmap", err.Error())
+
+	encoded, err := ABIEncodeProof(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 96, len(encoded))
+}
+
+func TestProofStandardRoundTrip(t *testing.T) {
+	leaves := [][]byte{}
+	for i := 0; i < 5; i++ {
+		leaves = append(leaves, hashValue([]byte{byte(i)}, sha256.New()))
+	}
+	tree := NewSMT(emptyHashFunc(sha256.New()), sha256.New())
+	err := tree.Generate(leaves, 8)
+	assert.Nil(t, err)
+
+	for i := uint(0); i < 8; i++ {
+		proof, err := tree.GetMerkleProof(i)
+		assert.Nil(t, err)
+		encoded, err := tree.GetMerkleProofStandard(i)
+		assert.Nil(t, err)
+		assert.Equal(t, 3*33, len(encoded))
+		for j, node := range proof {
+			assert.Equal(t, node.Left, encoded[33*j] == 0x01)
+		}
+
+		parsed, err := ParseProofStandard(encoded, 32)
+		assert.Nil(t, err)
+		assert.Equal(t, proof, parsed)
+	}
+	_, err = tree.GetMerkleProofStandard(8)
+	assert.Equal(t, "Leaf number is out of range", err.Error())
+	_, err = tree.AppendLeaves(leaves[:3])
+	assert.Nil(t, err)
+	_, err = tree.GetMerkleProofStandard(8)
+	assert.Equal(t, "Leaf number is out of range", err.Error())
+}
+
+func TestProofStandardInvalid(t *testing.T) {
+	_, err := ParseProofStandard(make([]byte, 34), 32)
+	assert.Equal(t, "Proof length is not a multiple of the record size", err.Error())
+
+	data := make([]byte, 33)
+	data[0] = 2
+	_, err = ParseProofStandard(data, 32)
+	assert.Equal(t, "Invalid proof direction byte", err.Error())
+
+	_, err = ParseProofStandard(data, 0)
+	assert.Equal(t, "Hash size must be positive", err.Error())
+
+	_, err = EncodeProofStandard([]ProofNode{{Hash: make([]byte, 32)}, {Hash: make([]byte, 16)}})
+	assert.Equal(t, "Proof hashes differ in size", err.Error())
+
+	tree := NewSMT(emptyHash, hashFunc)
+	_, err = tree.GetMerkleProofStandard(0)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+}
+
+func TestContentID(t *testing.T) {
+	generated := NewSMT(emptyHash, hashFunc)
+	err := generated.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	appended := NewSMT(emptyHash, hashFunc)
+	err = appended.Generate(testHashes[:2], 8)
+	assert.Nil(t, err)
+	_, err = appended.AppendLeaves(testHashes[2:5])
+	assert.Nil(t, err)
+	assert.Equal(t, generated.ContentID(), appended.ContentID())
+
+	algorithm := "*md5.digest/16"
+	id := generated.ContentID()
+	assert.Equal(t, byte(1), id[0])
+	assert.Equal(t, []byte{0, byte(len(algorithm))}, id[1:3])
+	assert.Equal(t, algorithm, string(id[3:3+len(algorithm)]))
+	assert.Equal(t, uint64(8), binary.BigEndian.Uint64(id[3+len(algorithm):]))
+	assert.Equal(t, generated.RootHash(), id[3+len(algorithm)+8:])
+
+	others := []*SMT{NewSMT(emptyHash, hashFunc), NewSMT(emptyHash, hashFunc), NewSMT(emptyHash, hashFunc, WithCapacityInRoot()), NewSMT(emptyHash, sha256.New())}
+	assert.Nil(t, others[0].Generate(testHashes[:6], 8))
+	assert.Nil(t, others[1].Generate(testHashes[:5], 16))
+	assert.Nil(t, others[2].Generate(testHashes[:5], 8))
+	assert.Nil(t, others[3].Generate(testHashes[:5], 8))
+	for _, other := range others {
+		assert.NotEqual(t, id, other.ContentID())
+	}
+
+	assert.Nil(t, NewSMT(emptyHash, md5.New()).ContentID())
+}
+
+func TestMarshalFixed(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:11], 16)
+	assert.Nil(t, err)
+
+	for leafNo := uint(0); leafNo < 16; leafNo++ {
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		encoded, err := MarshalFixed(proof, md5.Size)
+		assert.Nil(t, err)
+		assert.Len(t, encoded, 4*(1+md5.Size))
+		decoded, err := UnmarshalFixed(encoded, md5.Size)
+		assert.Nil(t, err)
+		assert.Equal(t, proof, decoded)
+	}
+
+	proof, err := tree.GetMerkleProof(3)
+	assert.Nil(t, err)
+	_, err = MarshalFixed(proof, sha256.Size)
+	assert.Equal(t, "Proof hash does not match the hash size", err.Error())
+	proof[2].Hash = proof[2].Hash[:md5.Size-1]
+	_, err = MarshalFixed(proof, md5.Size)
+	assert.Equal(t, "Proof hash does not match the hash size", err.Error())
+	_, err = MarshalFixed(proof, 0)
+	assert.Equal(t, "Hash size must be positive", err.Error())
+
+	_, err = UnmarshalFixed(make([]byte, 2*(1+md5.Size)-1), md5.Size)
+	assert.Equal(t, "Proof length is not a multiple of the record size", err.Error())
+}
+
+func TestGetMerkleProofHex(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	_, err := tree.GetMerkleProofHex(0)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+	err = tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	prefixed := NewSMT(emptyHash, hashFunc, WithHexPrefix())
+	err = prefixed.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+
+	for leafNo := uint(0); leafNo < 8; leafNo++ {
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		nodes, err := tree.GetMerkleProofHex(leafNo)
+		assert.Nil(t, err)
+		withPrefix, err := prefixed.GetMerkleProofHex(leafNo)
+		assert.Nil(t, err)
+		assert.Len(t, nodes, len(proof))
+		for i, node := range nodes {
+			assert.Equal(t, strings.ToLower(node.Hash), node.Hash)
+			decoded, err := hex.DecodeString(node.Hash)
+			assert.Nil(t, err)
+			assert.Equal(t, proof[i], ProofNode{Left: node.Left, Hash: decoded})
+			assert.Equal(t, HexProofNode{Left: node.Left, Hash: "0x" + node.Hash}, withPrefix[i])
+		}
+	}
+
+	nodes, err := tree.GetMerkleProofHex(1)
+	assert.Nil(t, err)
+	encoded, err := json.Marshal(nodes[0])
+	assert.Nil(t, err)
+	assert.Equal(t, `{"left":true,"hash":"`+hex.EncodeToString(testHashes[0])+`"}`, string(encoded))
+
+	//positions beyond the capacity have no proof, full tree or not
+	for _, count := range []int{5, 8} {
+		tree := NewSMT(emptyHash, hashFunc)
+		err := tree.Generate(testHashes[:count], 8)
+		assert.Nil(t, err)
+		for _, leafNo := range []uint{8, 9, 1 << 20} {
+			_, err = tree.GetMerkleProof(leafNo)
+			assert.Equal(t, "Leaf number is out of range", err.Error())
+			_, err = tree.GetMerkleProofHex(leafNo)
+			assert.Equal(t, "Leaf number is out of range", err.Error())
+		}
+	}
+}
+
+func TestProofsDigest(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	_, err := tree.ProofsDigest([]uint{0})
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+	err = tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+
+	digest, err := tree.ProofsDigest([]uint{1, 3, 6})
+	assert.Nil(t, err)
+	assert.Len(t, digest, hashFunc.Size())
+	for _, indices := range [][]uint{{6, 3, 1}, {3, 1, 6, 1}} {
+		again, err := tree.ProofsDigest(indices)
+		assert.Nil(t, err)
+		assert.Equal(t, digest, again)
+	}
+
+	//the digest is the hash of the numbered proofs
+	buf := &bytes.Buffer{}
+	for _, leafNo := range []uint{1, 3, 6} {
+		encoded := make([]byte, 8)
+		binary.BigEndian.PutUint64(encoded, uint64(leafNo))
+		buf.Write(encoded)
+		err = tree.WriteMerkleProof(buf, leafNo)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, hashValue(buf.Bytes(), md5.New()), digest)
+
+	other, err := tree.ProofsDigest([]uint{1, 3})
+	assert.Nil(t, err)
+	assert.NotEqual(t, digest, other)
+
+	//updating a leaf changes the proofs of the other leaves
+	err = tree.UpdateLeaf(0, testHashes[7])
+	assert.Nil(t, err)
+	updated, err := tree.ProofsDigest([]uint{1, 3, 6})
+	assert.Nil(t, err)
+	assert.NotEqual(t, digest, updated)
+
+	_, err = tree.ProofsDigest([]uint{8})
+	assert.Equal(t, "Leaf number is out of range", err.Error())
+}
+
+func TestToJSON(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.ToJSON(&bytes.Buffer{})
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+	err = tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+
+	buf := &bytes.Buffer{}
+	err = tree.ToJSON(buf)
+	assert.Nil(t, err)
+	var doc struct {
+		Height    int     `json:"height"`
+		Capacity  int     `json:"capacity"`
+		Occupancy float64 `json:"occupancy"`
+		Root      string  `json:"root"`
+		Levels    []struct {
+			Level      int      `json:"level"`
+			Nodes      []string `json:"nodes"`
+			EmptyNodes int      `json:"emptyNodes"`
+			EmptyHash  string   `json:"emptyHash"`
+		} `json:"levels"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &doc)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, doc.Height)
+	assert.Equal(t, 8, doc.Capacity)
+	assert.Equal(t, 5.0/8, doc.Occupancy)
+	root, err := hex.DecodeString(doc.Root)
+	assert.Nil(t, err)
+	assert.Equal(t, tree.RootHash(), root)
+
+	//every node, stored or synthesized, is found at its coordinate
+	assert.Len(t, doc.Levels, 4)
+	for level, jsonLevel := range doc.Levels {
+		assert.Equal(t, level, jsonLevel.Level)
+		assert.Equal(t, 1<<uint(level), len(jsonLevel.Nodes)+jsonLevel.EmptyNodes)
+		for index := 0; index < 1<<uint(level); index++ {
+			expected, err := tree.NodeHash(level, index)
+			assert.Nil(t, err)
+			encoded := jsonLevel.EmptyHash
+			if index < len(jsonLevel.Nodes) {
+				encoded = jsonLevel.Nodes[index]
+			}
+			assert.Equal(t, hex.EncodeToString(expected), encoded)
+		}
+	}
+	assert.Equal(t, []string{hex.EncodeToString(testHashes[0]), hex.EncodeToString(testHashes[1]), hex.EncodeToString(testHashes[2]), hex.EncodeToString(testHashes[3]), hex.EncodeToString(testHashes[4])}, doc.Levels[3].Nodes)
+	assert.Equal(t, 3, doc.Levels[3].EmptyNodes)
+	assert.Equal(t, "", doc.Levels[0].EmptyHash)
+}
@@ -0,0 +1,86 @@
+package merkle
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+)
+
+// PrecomputedEmptyChain holds the empty subtree roots for every height of
+// trees up to a maximum size. It is computed once and given to any number of
+// trees with WithEmptyChain, which then slice it instead of hashing it again
+type PrecomputedEmptyChain struct {
+	algorithm string
+	// Options changing how empty parents are hashed
+	salt          []byte
+	emptyNodeSeed []byte
+	combiner      bool
+	// Empty subtree roots for every height up to the largest supported tree
+	roots []Hash
+}
+
+// NewPrecomputedEmptyChain computes the empty subtree roots for trees of up
+// to maxTotalSize leaves, hashed as a tree made with the same arguments would
+func NewPrecomputedEmptyChain(emptyHash Hash, hashFunc hash.Hash, maxTotalSize int, opts ...Option) (*PrecomputedEmptyChain, error) {
+	if !isPowerOfTwo(uint64(maxTotalSize)) {
+		return nil, errors.New("Leaves number of SMT tree should be power of 2")
+	}
+	tree := NewSMT(emptyHash, hashFunc, opts...)
+	err := tree.computeEmptyLeavesSubTreeHash(int(logBaseTwo(uint64(maxTotalSize)) + 1))
+	if err != nil {
+		return nil, err
+	}
+	return &PrecomputedEmptyChain{
+		algorithm:     hashAlgorithmID(hashFunc),
+		salt:          tree.salt,
+		emptyNodeSeed: tree.emptyNodeSeed,
+		combiner:      tree.combiner != nil,
+		roots:         tree.emptyTreeRootHash,
+	}, nil
+}
+
+// TreeFactory creates trees sharing one configuration and a precomputed
+// chain of empty subtree roots, so building many trees does not hash the
+// chain again for every one of them
+type TreeFactory struct {
+	emptyHash   Hash
+	hashFactory func() hash.Hash
+	opts        []Option
+	chain       *PrecomputedEmptyChain
+}
+
+// NewTreeFactory precomputes the empty subtree roots for trees of up to
+// maxTotalSize leaves. Every tree gets its own hash from hashFactory, so trees
+// from the same factory can be used concurrently
+func NewTreeFactory(emptyHash Hash, hashFactory func() hash.Hash, maxTotalSize int, opts ...Option) (*TreeFactory, error) {
+	chain, err := NewPrecomputedEmptyChain(emptyHash, hashFactory(), maxTotalSize, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// The caller's options are copied so the chain option is never appended
+	// into their backing array
+	opts = append(append([]Option{}, opts...), WithEmptyChain(chain))
+	return &TreeFactory{emptyHash: emptyHash, hashFactory: hashFactory, opts: opts, chain: chain}, nil
+}
+
+// NewSMT returns an unfilled tree using the precomputed empty subtree roots.
+// Larger trees than the factory was made for still work, extending the chain
+// on their own
+func (self *TreeFactory) NewSMT() *SMT {
+	return NewSMT(self.emptyHash, self.hashFactory(), self.opts...)
+}
+
+// Following are non public function
+
+// Returns true if the chain starts from the empty (or padding) leaf of tree
+// and was hashed as tree would: same algorithm, salt and empty node seed.
+// Combiners cannot be compared, so chains are never used with them
+func (self *PrecomputedEmptyChain) matches(tree *SMT) bool {
+	if self.combiner || tree.combiner != nil {
+		return false
+	}
+	return bytes.Equal(self.roots[0], tree.emptyTreeRootHash[0]) &&
+		self.algorithm == hashAlgorithmID(tree.hashFunc) &&
+		bytes.Equal(self.salt, tree.salt) &&
+		bytes.Equal(self.emptyNodeSeed, tree.emptyNodeSeed)
+}
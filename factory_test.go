@@ -0,0 +1,142 @@
+package merkle
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTreeFactory(t *testing.T) {
+	factory, err := NewTreeFactory(emptyHash, md5.New, 16)
+	assert.Nil(t, err)
+
+	for _, size := range []int{1, 4, 16, 64} {
+		for _, count := range []int{0, 1, 3} {
+			if count > size {
+				continue
+			}
+			tree := factory.NewSMT()
+			err = tree.Generate(testHashes[:count], size)
+			assert.Nil(t, err)
+			expected := NewSMT(emptyHash, md5.New())
+			err = expected.Generate(testHashes[:count], size)
+			assert.Nil(t, err)
+			assert.Equal(t, expected.RootHash(), tree.RootHash())
+		}
+	}
+
+	//the tree of 64 leaves outgrew the factory chain without writing into
+	//its spare capacity
+	assert.Equal(t, 5, len(factory.chain.roots))
+	spare := factory.chain.roots[:cap(factory.chain.roots)]
+	for _, hash := range spare[5:] {
+		assert.Nil(t, hash)
+	}
+
+	seeded, err := NewTreeFactory(emptyHash, md5.New, 8, WithEmptyNodeSeed([]byte("seed")))
+	assert.Nil(t, err)
+	tree := seeded.NewSMT()
+	err = tree.Generate(testHashes[:3], 8)
+	assert.Nil(t, err)
+	expected := NewSMT(emptyHash, md5.New(), WithEmptyNodeSeed([]byte("seed")))
+	err = expected.Generate(testHashes[:3], 8)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.RootHash(), tree.RootHash())
+
+	_, err = NewTreeFactory(emptyHash, md5.New, 12)
+	assert.Equal(t, "Leaves number of SMT tree should be power of 2", err.Error())
+}
+
+func TestPrecomputedEmptyChain(t *testing.T) {
+	for _, opts := range [][]Option{
+		{},
+		{WithSalt([]byte("salt"))},
+		{WithPaddingLeaf(testHashes[15])},
+	} {
+		chain, err := NewPrecomputedEmptyChain(emptyHash, md5.New(), 16, opts...)
+		assert.Nil(t, err)
+		for _, size := range []int{1, 4, 16, 64} {
+			for _, count := range []int{0, 1, 3} {
+				if count > size {
+					continue
+				}
+				tree := NewSMT(emptyHash, md5.New(), append(opts, WithEmptyChain(chain))...)
+				err = tree.Generate(testHashes[:count], size)
+				assert.Nil(t, err)
+				expected := NewSMT(emptyHash, md5.New(), opts...)
+				err = expected.Generate(testHashes[:count], size)
+				assert.Nil(t, err)
+				assert.Equal(t, expected.RootHash(), tree.RootHash())
+			}
+		}
+	}
+
+	//a chain of another empty leaf or hash algorithm is ignored
+	chain, err := NewPrecomputedEmptyChain(emptyHash, md5.New(), 16)
+	assert.Nil(t, err)
+	for _, tree := range []*SMT{
+		NewSMT(testHashes[0], md5.New(), WithEmptyChain(chain)),
+		NewSMT(emptyHash, sha1.New(), WithEmptyChain(chain)),
+	} {
+		assert.Equal(t, 1, len(tree.emptyTreeRootHash))
+	}
+	assert.Equal(t, 5, len(NewSMT(emptyHash, md5.New(), WithEmptyChain(chain)).emptyTreeRootHash))
+
+	//so is a chain hashed with other options
+	combine := func(left, right []byte) ([]byte, error) { return hashPair(md5.New(), left, right) }
+	for _, opts := range [][]Option{
+		{WithSalt([]byte("salt"))},
+		{WithEmptyNodeSeed([]byte("seed"))},
+		{WithCombiner(combine)},
+	} {
+		tree := NewSMT(emptyHash, md5.New(), append(opts, WithEmptyChain(chain))...)
+		assert.Equal(t, 1, len(tree.emptyTreeRootHash))
+		err = tree.Generate(testHashes[:3], 16)
+		assert.Nil(t, err)
+		expected := NewSMT(emptyHash, md5.New(), opts...)
+		err = expected.Generate(testHashes[:3], 16)
+		assert.Nil(t, err)
+		assert.Equal(t, expected.RootHash(), tree.RootHash())
+	}
+	salted, err := NewPrecomputedEmptyChain(emptyHash, md5.New(), 16, WithSalt([]byte("salt")))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(NewSMT(emptyHash, md5.New(), WithEmptyChain(salted)).emptyTreeRootHash))
+	assert.Equal(t, 1, len(NewSMT(emptyHash, md5.New(), WithSalt([]byte("other")), WithEmptyChain(salted)).emptyTreeRootHash))
+	combined, err := NewPrecomputedEmptyChain(emptyHash, md5.New(), 16, WithCombiner(combine))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(NewSMT(emptyHash, md5.New(), WithCombiner(combine), WithEmptyChain(combined)).emptyTreeRootHash))
+
+	_, err = NewPrecomputedEmptyChain(emptyHash, md5.New(), 12)
+	assert.Equal(t, "Leaves number of SMT tree should be power of 2", err.Error())
+}
+
+func benchmarkManyTrees(b *testing.B, newTree func() *SMT) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		tree := newTree()
+		if err := tree.Generate(testHashes[:1], 1<<20); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkManyTrees(b *testing.B) {
+	benchmarkManyTrees(b, func() *SMT { return NewSMT(emptyHash, md5.New()) })
+}
+
+func BenchmarkManyTrees_Factory(b *testing.B) {
+	factory, err := NewTreeFactory(emptyHash, md5.New, 1<<20)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkManyTrees(b, factory.NewSMT)
+}
+
+func BenchmarkManyTrees_EmptyChain(b *testing.B) {
+	chain, err := NewPrecomputedEmptyChain(emptyHash, md5.New(), 1<<20)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkManyTrees(b, func() *SMT { return NewSMT(emptyHash, md5.New(), WithEmptyChain(chain)) })
+}
@@ -0,0 +1,44 @@
+package merkle
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// SuperTree builds a tree whose leaves are the roots of trees, in order, with
+// the smallest capacity holding all of them. The proof of leaf i of the
+// returned tree shows that trees[i] is included in its root. All trees must
+// be filled and hashed with the same algorithm as factory
+func SuperTree(trees []*SMT, emptyHash Hash, factory func() hash.Hash) (*SMT, error) {
+	if len(trees) == 0 {
+		return nil, errors.New("No trees to combine")
+	}
+	hashFunc := factory()
+	algorithm := hashAlgorithmID(hashFunc)
+	roots := make([][]byte, 0, len(trees))
+	for i, tree := range trees {
+		height, treeAlgorithm, _ := tree.identity()
+		if height == 0 {
+			return nil, fmt.Errorf("Tree %d is not filled", i)
+		}
+		if treeAlgorithm != algorithm {
+			return nil, fmt.Errorf("Tree %d uses a different hash algorithm", i)
+		}
+		roots = append(roots, tree.RootHash())
+	}
+	super := NewSMT(emptyHash, hashFunc)
+	if err := super.Generate(roots, NextCapacity(len(roots))); err != nil {
+		return nil, err
+	}
+	return super, nil
+}
+
+// SuperRoot returns the root of the SuperTree of trees
+func SuperRoot(trees []*SMT, emptyHash Hash, factory func() hash.Hash) ([]byte, error) {
+	super, err := SuperTree(trees, emptyHash, factory)
+	if err != nil {
+		return nil, err
+	}
+	return super.RootHash(), nil
+}
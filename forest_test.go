@@ -0,0 +1,49 @@
+package merkle
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSuperRoot(t *testing.T) {
+	trees := []*SMT{}
+	for _, count := range []int{1, 5, 16} {
+		tree := NewSMT(emptyHash, hashFunc)
+		err := tree.Generate(testHashes[:count], 16)
+		assert.Nil(t, err)
+		trees = append(trees, tree)
+	}
+	root, err := SuperRoot(trees, emptyHash, md5.New)
+	assert.Nil(t, err)
+	super, err := SuperTree(trees, emptyHash, md5.New)
+	assert.Nil(t, err)
+	assert.Equal(t, root, super.RootHash())
+	assert.Equal(t, 4, super.Capacity())
+
+	for i, tree := range trees {
+		proof, err := super.GetMerkleProof(uint(i))
+		assert.Nil(t, err)
+		assert.Nil(t, VerifyProof(tree.RootHash(), uint(i), proof, root, hashFunc))
+		//a leaf proven in a child carries on to the super root
+		leafProof, err := tree.GetMerkleProof(0)
+		assert.Nil(t, err)
+		assert.Nil(t, VerifyProof(testHashes[0], 0, append(leafProof, proof...), root, hashFunc))
+	}
+	proof, err := super.GetMerkleProof(0)
+	assert.Nil(t, err)
+	assert.NotNil(t, VerifyProof(trees[1].RootHash(), 0, proof, root, hashFunc))
+
+	_, err = SuperRoot(nil, emptyHash, md5.New)
+	assert.Equal(t, "No trees to combine", err.Error())
+	_, err = SuperRoot(append(trees, NewSMT(emptyHash, hashFunc)), emptyHash, md5.New)
+	assert.Equal(t, "Tree 3 is not filled", err.Error())
+	other := NewSMT(emptyHash, sha256.New())
+	err = other.Generate(testHashes[:1], 1)
+	assert.Nil(t, err)
+	_, err = SuperRoot(append(trees, other), emptyHash, md5.New)
+	assert.Equal(t, "Tree 3 uses a different hash algorithm", err.Error())
+	_, err = SuperRoot(trees, emptyHash, sha256.New)
+	assert.Equal(t, "Tree 0 uses a different hash algorithm", err.Error())
+}
@@ -0,0 +1,133 @@
+package merkle
+
+import (
+	"errors"
+	"hash"
+)
+
+// FrontierTree is an append only tree which only keeps the frontier: the
+// roots of the perfect subtrees covering all appended leaves. Appending a
+// leaf and computing the root take O(log n) hashes and memory, but no proofs
+// can be produced. Its root equals the root of an SMT with the same leaves.
+// Unlike an SMT it is not safe for concurrent use
+type FrontierTree struct {
+	// Hashing and the empty subtree cache are delegated to an unfilled SMT
+	tree *SMT
+	// Frontier roots by height, nil where there is none
+	peaks    []Hash
+	count    int
+	rootHash []byte
+}
+
+func NewFrontierTree(emptyHash Hash, hashFunc hash.Hash, totalSize int, opts ...Option) (*FrontierTree, error) {
+	if !isPowerOfTwo(uint64(totalSize)) {
+		return nil, errors.New("Leaves number of SMT tree should be power of 2")
+	}
+	tree := NewSMT(emptyHash, hashFunc, opts...)
+	tree.treeHeight = int(logBaseTwo(uint64(totalSize)) + 1)
+	err := tree.computeEmptyLeavesSubTreeHash(tree.treeHeight)
+	if err != nil {
+		return nil, err
+	}
+	self := &FrontierTree{tree: tree, peaks: make([]Hash, tree.treeHeight)}
+	self.rootHash, err = self.computeRoot()
+	if err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+// PushLeaf appends a leaf, merging the frontier roots it completes
+func (self *FrontierTree) PushLeaf(leaf []byte) error {
+	if self.count == self.tree.capacity() {
+		return errors.New("Leaves exceed remaining capacity")
+	}
+	hashes, err := self.tree.leafHashes(uint(self.count), [][]byte{leaf})
+	if err != nil {
+		return err
+	}
+	peaks := append([]Hash{}, self.peaks...)
+	node := hashes[0]
+	height := 0
+	for ; self.count&(1<<uint(height)) != 0; height++ {
+		node, err = self.tree.parentHash(peaks[height], node)
+		if err != nil {
+			return err
+		}
+		peaks[height] = nil
+	}
+	peaks[height] = node
+
+	previous := self.peaks
+	self.peaks = peaks
+	self.count++
+	root, err := self.computeRoot()
+	if err != nil {
+		self.peaks = previous
+		self.count--
+		return err
+	}
+	self.rootHash = root
+	return nil
+}
+
+// Frontier returns the roots of the perfect subtrees covering all leaves,
+// from left to right
+func (self *FrontierTree) Frontier() []Hash {
+	return frontierOrder(self.peaks)
+}
+
+func (self *FrontierTree) RootHash() []byte {
+	return self.rootHash
+}
+
+// Frontier returns the roots of the perfect subtrees covering all non empty
+// leaves, from left to right
+func (self *SMT) Frontier() []Hash {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return nil
+	}
+	peaks := make([]Hash, self.treeHeight)
+	for height := range peaks {
+		if self.countOfNonEmptyLeaves&(1<<uint(height)) != 0 {
+			peaks[height] = self.fullNodes[height][self.countOfNonEmptyLeaves>>uint(height)-1]
+		}
+	}
+	return frontierOrder(peaks)
+}
+
+// Following are non public function
+
+// Folds the frontier with the empty subtrees right of it up to the root
+func (self *FrontierTree) computeRoot() ([]byte, error) {
+	levels := self.tree.treeHeight - 1
+	if self.count == self.tree.capacity() {
+		return self.tree.finalizeRoot(self.peaks[levels])
+	}
+	current := self.tree.emptyTreeRootHash[0]
+	for height := 0; height < levels; height++ {
+		var err error
+		if self.count&(1<<uint(height)) != 0 {
+			current, err = self.tree.parentHash(self.peaks[height], current)
+		} else {
+			current, err = self.tree.parentHash(current, self.tree.emptyTreeRootHash[height])
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return self.tree.finalizeRoot(current)
+}
+
+// Returns the non nil peaks, highest first
+func frontierOrder(peaks []Hash) []Hash {
+	frontier := []Hash{}
+	for height := len(peaks) - 1; height >= 0; height-- {
+		if peaks[height] != nil {
+			frontier = append(frontier, peaks[height])
+		}
+	}
+	return frontier
+}
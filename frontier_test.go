@@ -0,0 +1,45 @@
+package merkle
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFrontierTree(t *testing.T) {
+	frontier, err := NewFrontierTree(emptyHash, hashFunc, 16)
+	assert.Nil(t, err)
+
+	for count := 0; count <= 16; count++ {
+		if count > 0 {
+			err = frontier.PushLeaf(testHashes[count-1])
+			assert.Nil(t, err)
+		}
+		tree := NewSMT(emptyHash, hashFunc)
+		err = tree.Generate(testHashes[:count], 16)
+		assert.Nil(t, err)
+		assert.Equal(t, tree.RootHash(), frontier.RootHash())
+		assert.Equal(t, tree.Frontier(), frontier.Frontier())
+	}
+	err = frontier.PushLeaf(testHashes[0])
+	assert.Equal(t, "Leaves exceed remaining capacity", err.Error())
+}
+
+func TestFrontier(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:11], 16)
+	assert.Nil(t, err)
+
+	//11 = 8 + 2 + 1 leaves
+	expected := []Hash{tree.fullNodes[3][0], tree.fullNodes[1][4], tree.fullNodes[0][10]}
+	assert.Equal(t, expected, tree.Frontier())
+
+	frontier, err := NewFrontierTree(emptyHash, hashFunc, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, emptyHash, frontier.RootHash())
+	err = frontier.PushLeaf(testHashes[0])
+	assert.Nil(t, err)
+	assert.Equal(t, testHashes[0], frontier.RootHash())
+
+	_, err = NewFrontierTree(emptyHash, hashFunc, 3)
+	assert.Equal(t, "Leaves number of SMT tree should be power of 2", err.Error())
+}
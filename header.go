@@ -0,0 +1,167 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+)
+
+// Version of the TreeHeader binary layout
+const treeHeaderVersion byte = 1
+
+// Length of the fixed fields of the TreeHeader binary layout: the version,
+// algorithm, capacity and count
+const treeHeaderFixedSize = 1 + 4 + 8 + 8
+
+// TreeHeader is a compact descriptor of a tree, for peers deciding whether
+// they need to sync. Algorithm is a 32 bit FNV-1a digest of the hash
+// algorithm identifier. An unfilled tree has no root and a zero capacity
+type TreeHeader struct {
+	Root      []byte
+	Capacity  uint64
+	Count     uint64
+	Algorithm uint32
+	EmptyHash Hash
+}
+
+// Header returns the descriptor of the tree. Count is the number of non
+// empty leaves, without the unset positions of WithIndexedLeaves
+func (self *SMT) Header() TreeHeader {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	header := TreeHeader{
+		Algorithm: algorithmDigest(hashAlgorithmID(self.hashFunc)),
+		EmptyHash: append(Hash{}, self.emptyHash...),
+	}
+	if len(self.fullNodes) == 0 {
+		return header
+	}
+	header.Root = append([]byte{}, self.rootHash()...)
+	header.Capacity = uint64(self.capacity())
+	header.Count = uint64(self.countOfNonEmptyLeaves - len(self.unsetLeaves))
+	return header
+}
+
+// Equal reports whether both headers describe the same tree
+func (self TreeHeader) Equal(other TreeHeader) bool {
+	return self.Capacity == other.Capacity &&
+		self.Count == other.Count &&
+		self.Algorithm == other.Algorithm &&
+		bytes.Equal(self.Root, other.Root) &&
+		bytes.Equal(self.EmptyHash, other.EmptyHash)
+}
+
+// MarshalBinary encodes the header as a version byte, the big endian
+// algorithm, capacity and count, then the root and the empty hash, each
+// prefixed with its length in one byte
+func (self TreeHeader) MarshalBinary() ([]byte, error) {
+	if len(self.Root) > 0xff || len(self.EmptyHash) > 0xff {
+		return nil, errors.New("Header hash is too long")
+	}
+	data := make([]byte, treeHeaderFixedSize, treeHeaderFixedSize+2+len(self.Root)+len(self.EmptyHash))
+	data[0] = treeHeaderVersion
+	binary.BigEndian.PutUint32(data[1:], self.Algorithm)
+	binary.BigEndian.PutUint64(data[5:], self.Capacity)
+	binary.BigEndian.PutUint64(data[13:], self.Count)
+	data = append(data, byte(len(self.Root)))
+	data = append(data, self.Root...)
+	data = append(data, byte(len(self.EmptyHash)))
+	return append(data, self.EmptyHash...), nil
+}
+
+// UnmarshalBinary decodes a header encoded by MarshalBinary
+func (self *TreeHeader) UnmarshalBinary(data []byte) error {
+	if len(data) < treeHeaderFixedSize+1 {
+		return errors.New("Header is truncated")
+	}
+	if data[0] != treeHeaderVersion {
+		return errors.New("Unknown header version")
+	}
+	header := TreeHeader{
+		Algorithm: binary.BigEndian.Uint32(data[1:]),
+		Capacity:  binary.BigEndian.Uint64(data[5:]),
+		Count:     binary.BigEndian.Uint64(data[13:]),
+	}
+	rest := data[treeHeaderFixedSize:]
+	root, rest, err := readHeaderHash(rest)
+	if err != nil {
+		return err
+	}
+	emptyHash, rest, err := readHeaderHash(rest)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return errors.New("Header has trailing bytes")
+	}
+	if len(root) > 0 {
+		header.Root = root
+	}
+	if len(emptyHash) > 0 {
+		header.EmptyHash = emptyHash
+	}
+	*self = header
+	return nil
+}
+
+// RootCommitment asserts the root of a tree of the given height and
+// capacity, without proving any leaf. An unfilled tree commits to no root
+type RootCommitment struct {
+	Root     []byte
+	Height   int
+	Capacity uint64
+}
+
+// RootProof returns the commitment to the current root
+func (self *SMT) RootProof() RootCommitment {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return RootCommitment{}
+	}
+	return RootCommitment{
+		Root:     append([]byte{}, self.rootHash()...),
+		Height:   self.treeHeight,
+		Capacity: uint64(self.capacity()),
+	}
+}
+
+// VerifyRootCommitment checks commitment against a trusted header: the root
+// and capacity must match, and the height must be the one of the capacity
+func VerifyRootCommitment(commitment RootCommitment, header TreeHeader) error {
+	expectedHeight := 0
+	if commitment.Capacity != 0 {
+		if !isPowerOfTwo(commitment.Capacity) {
+			return errors.New("Commitment capacity is not a power of 2")
+		}
+		expectedHeight = int(logBaseTwo(commitment.Capacity)) + 1
+	}
+	if commitment.Height != expectedHeight {
+		return errors.New("Commitment height does not match its capacity")
+	}
+	if commitment.Capacity != header.Capacity {
+		return errors.New("Commitment capacity does not match the header")
+	}
+	if !bytes.Equal(commitment.Root, header.Root) {
+		return errors.New("Commitment root does not match the header")
+	}
+	return nil
+}
+
+// Following are non public function
+
+func algorithmDigest(algorithm string) uint32 {
+	digest := fnv.New32a()
+	digest.Write([]byte(algorithm))
+	return digest.Sum32()
+}
+
+// Splits a length prefixed hash off data
+func readHeaderHash(data []byte) ([]byte, []byte, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return nil, nil, errors.New("Header is truncated")
+	}
+	length := 1 + int(data[0])
+	return append([]byte{}, data[1:length]...), data[length:], nil
+}
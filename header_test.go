@@ -0,0 +1,101 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTreeHeader(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+	header := tree.Header()
+	assert.Equal(t, tree.RootHash(), header.Root)
+	assert.Equal(t, uint64(16), header.Capacity)
+	assert.Equal(t, uint64(5), header.Count)
+	assert.Equal(t, Hash(emptyHash), header.EmptyHash)
+
+	data, err := header.MarshalBinary()
+	assert.Nil(t, err)
+	assert.Equal(t, treeHeaderFixedSize+2+16+16, len(data))
+	decoded := TreeHeader{}
+	err = decoded.UnmarshalBinary(data)
+	assert.Nil(t, err)
+	assert.Equal(t, header, decoded)
+	assert.True(t, header.Equal(decoded))
+
+	//identical trees have equal headers
+	same := NewSMT(emptyHash, hashFunc)
+	err = same.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+	assert.True(t, header.Equal(same.Header()))
+
+	//any difference shows
+	other := NewSMT(emptyHash, hashFunc)
+	err = other.Generate(testHashes[:5], 32)
+	assert.Nil(t, err)
+	assert.False(t, header.Equal(other.Header()))
+	other = NewSMT(emptyHash, hashFunc)
+	err = other.Generate(testHashes[:6], 16)
+	assert.Nil(t, err)
+	assert.False(t, header.Equal(other.Header()))
+	assert.NotEqual(t, header.Algorithm, NewSMT(emptyHash, sha256.New()).Header().Algorithm)
+
+	//an unfilled tree round trips without root
+	unfilled := NewSMT(nil, hashFunc).Header()
+	assert.Nil(t, unfilled.Root)
+	data, err = unfilled.MarshalBinary()
+	assert.Nil(t, err)
+	decoded = TreeHeader{}
+	err = decoded.UnmarshalBinary(data)
+	assert.Nil(t, err)
+	assert.True(t, unfilled.Equal(decoded))
+
+	//malformed encodings are rejected
+	data, _ = header.MarshalBinary()
+	assert.Equal(t, "Header is truncated", decoded.UnmarshalBinary(data[:len(data)-1]).Error())
+	assert.Equal(t, "Header has trailing bytes", decoded.UnmarshalBinary(append(data, 0)).Error())
+	data[0] = 2
+	assert.Equal(t, "Unknown header version", decoded.UnmarshalBinary(data).Error())
+}
+
+func TestRootCommitment(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+	commitment := tree.RootProof()
+	assert.Equal(t, RootCommitment{Root: tree.RootHash(), Height: 5, Capacity: 16}, commitment)
+
+	//a peer checks it against the header it trusts, received encoded
+	data, err := tree.Header().MarshalBinary()
+	assert.Nil(t, err)
+	trusted := TreeHeader{}
+	err = trusted.UnmarshalBinary(data)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyRootCommitment(commitment, trusted))
+
+	other := NewSMT(emptyHash, hashFunc)
+	err = other.Generate(testHashes[:6], 16)
+	assert.Nil(t, err)
+	err = VerifyRootCommitment(other.RootProof(), trusted)
+	assert.Equal(t, "Commitment root does not match the header", err.Error())
+
+	forged := commitment
+	forged.Capacity = 32
+	forged.Height = 6
+	err = VerifyRootCommitment(forged, trusted)
+	assert.Equal(t, "Commitment capacity does not match the header", err.Error())
+	forged.Height = 5
+	err = VerifyRootCommitment(forged, trusted)
+	assert.Equal(t, "Commitment height does not match its capacity", err.Error())
+	forged.Capacity = 12
+	err = VerifyRootCommitment(forged, trusted)
+	assert.Equal(t, "Commitment capacity is not a power of 2", err.Error())
+
+	//an unfilled tree commits to no root
+	unfilled := NewSMT(emptyHash, hashFunc)
+	assert.Equal(t, RootCommitment{}, unfilled.RootProof())
+	assert.Nil(t, VerifyRootCommitment(unfilled.RootProof(), unfilled.Header()))
+}
@@ -0,0 +1,126 @@
+package merkle
+
+import (
+	"errors"
+	"hash"
+)
+
+// DefaultSiblingCacheSize is the number of subtree roots a LowMemorySMT keeps
+// from earlier proofs
+const DefaultSiblingCacheSize = 1024
+
+// LowMemorySMT stores only the leaves of a tree and computes internal nodes
+// when they are needed. A proof recomputes only the subtrees hanging off the
+// proof path, at most one per level, and the roots of these subtrees are
+// cached so later proofs sharing them skip the work. It holds the same tree
+// as an SMT generated from the same leaves. Unlike an SMT it is not safe for
+// concurrent use
+type LowMemorySMT struct {
+	// Hashing and the empty subtree cache are delegated to an unfilled SMT
+	tree     *SMT
+	leaves   []Hash
+	rootHash []byte
+	// Subtree roots computed for proofs, keyed by height and index, and
+	// their keys in insertion order for eviction
+	cache     map[[2]int]Hash
+	cacheKeys [][2]int
+	cacheSize int
+}
+
+func NewLowMemorySMT(emptyHash Hash, hashFunc hash.Hash, opts ...Option) *LowMemorySMT {
+	return &LowMemorySMT{tree: NewSMT(emptyHash, hashFunc, opts...), cacheSize: DefaultSiblingCacheSize}
+}
+
+func (self *LowMemorySMT) Generate(leaves [][]byte, totalSize int) error {
+	if self.leaves != nil && !self.tree.allowRebuild {
+		return errors.New("SMT tree already filled")
+	}
+	if err := checkTotalSize(len(leaves), totalSize); err != nil {
+		return err
+	}
+	hashes, err := self.tree.leafHashes(0, leaves)
+	if err != nil {
+		return err
+	}
+	self.tree.treeHeight = levelsFor(totalSize)
+	err = self.tree.computeEmptyLeavesSubTreeHash(self.tree.treeHeight)
+	if err != nil {
+		return err
+	}
+	self.leaves = hashes
+	self.cache = map[[2]int]Hash{}
+	self.cacheKeys = nil
+
+	top, err := self.subtreeRoot(self.tree.treeHeight-1, 0, false)
+	if err == nil {
+		self.rootHash, err = self.tree.finalizeRoot(top)
+	}
+	if err != nil {
+		self.leaves = nil
+		return err
+	}
+	return nil
+}
+
+func (self *LowMemorySMT) RootHash() []byte {
+	return self.rootHash
+}
+
+// GetMerkleProof returns the same proof as an SMT holding the same leaves
+func (self *LowMemorySMT) GetMerkleProof(leafNo uint) ([]ProofNode, error) {
+	if self.leaves == nil {
+		return nil, errors.New("SMT tree is not filled")
+	}
+	if leafNo >= uint(self.tree.capacity()) {
+		return nil, errors.New("Leaf number is out of range")
+	}
+	proof := []ProofNode{}
+	index := int(leafNo)
+	for height := 0; height < self.tree.treeHeight-1; height++ {
+		sibling, err := self.subtreeRoot(height, index^1, true)
+		if err != nil {
+			return nil, err
+		}
+		proof = append(proof, ProofNode{Left: index%2 == 1, Hash: sibling})
+		index = index / 2
+	}
+	return proof, nil
+}
+
+// Following are non public function
+
+// Returns the root of the subtree at (height, index), height 0 being the
+// leaves. Only the requested root is cached, never the nodes below it
+func (self *LowMemorySMT) subtreeRoot(height int, index int, cache bool) (Hash, error) {
+	if index<<uint(height) >= len(self.leaves) {
+		return self.tree.emptyTreeRootHash[height], nil
+	}
+	if height == 0 {
+		return self.leaves[index], nil
+	}
+	key := [2]int{height, index}
+	if hash, ok := self.cache[key]; ok {
+		return hash, nil
+	}
+	left, err := self.subtreeRoot(height-1, 2*index, false)
+	if err != nil {
+		return nil, err
+	}
+	right, err := self.subtreeRoot(height-1, 2*index+1, false)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := self.tree.parentHash(left, right)
+	if err != nil {
+		return nil, err
+	}
+	if cache && self.cacheSize > 0 {
+		if len(self.cacheKeys) == self.cacheSize {
+			delete(self.cache, self.cacheKeys[0])
+			self.cacheKeys = self.cacheKeys[1:]
+		}
+		self.cache[key] = hash
+		self.cacheKeys = append(self.cacheKeys, key)
+	}
+	return hash, nil
+}
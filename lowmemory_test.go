@@ -0,0 +1,86 @@
+package merkle
+
+import (
+	"crypto/md5"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLowMemorySMT(t *testing.T) {
+	for _, count := range []int{0, 1, 5, 11, 16} {
+		full := NewSMT(emptyHash, hashFunc, WithCapacityInRoot())
+		err := full.Generate(testHashes[:count], 16)
+		assert.Nil(t, err)
+		low := NewLowMemorySMT(emptyHash, md5.New(), WithCapacityInRoot())
+		err = low.Generate(testHashes[:count], 16)
+		assert.Nil(t, err)
+		assert.Equal(t, full.RootHash(), low.RootHash())
+
+		//twice, the second time from the cache
+		for round := 0; round < 2; round++ {
+			for leafNo := uint(0); leafNo < 16; leafNo++ {
+				expected, err := full.GetMerkleProof(leafNo)
+				assert.Nil(t, err)
+				proof, err := low.GetMerkleProof(leafNo)
+				assert.Nil(t, err)
+				assert.Equal(t, expected, proof)
+			}
+		}
+	}
+
+	//the oldest cached roots are evicted first
+	low := NewLowMemorySMT(emptyHash, md5.New())
+	low.cacheSize = 2
+	err := low.Generate(testHashes[:16], 16)
+	assert.Nil(t, err)
+	_, err = low.GetMerkleProof(0)
+	assert.Nil(t, err)
+	assert.Equal(t, [][2]int{{2, 1}, {3, 1}}, low.cacheKeys)
+	assert.Len(t, low.cache, 2)
+
+	_, err = low.GetMerkleProof(16)
+	assert.Equal(t, "Leaf number is out of range", err.Error())
+	err = low.Generate(testHashes[:1], 16)
+	assert.Equal(t, "SMT tree already filled", err.Error())
+	_, err = NewLowMemorySMT(emptyHash, md5.New()).GetMerkleProof(0)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+}
+
+func lowMemoryBenchmarkLeaves() [][]byte {
+	leaves := make([][]byte, 1<<12)
+	for i := range leaves {
+		leaves[i] = hashValue([]byte{byte(i), byte(i >> 8)}, md5.New())
+	}
+	return leaves
+}
+
+func BenchmarkLowMemoryProof(b *testing.B) {
+	leaves := lowMemoryBenchmarkLeaves()
+	tree := NewLowMemorySMT(emptyHash, md5.New())
+	if err := tree.Generate(leaves, len(leaves)); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tree.GetMerkleProof(uint(i*97) % uint(len(leaves))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// A proof from leaves alone by rebuilding the whole tree every time
+func BenchmarkLowMemoryProof_FullRebuild(b *testing.B) {
+	leaves := lowMemoryBenchmarkLeaves()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree := NewSMT(emptyHash, md5.New())
+		if err := tree.Generate(leaves, len(leaves)); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := tree.GetMerkleProof(uint(i*97) % uint(len(leaves))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -275,6 +275,13 @@ func TestIsPowerOfTwo(t *testing.T) {
 	}
 }
 
+func TestNextCapacity(t *testing.T) {
+	inputs := [][]int{{-1, 1}, {0, 1}, {1, 1}, {2, 2}, {3, 4}, {5, 8}, {1023, 1024}, {1024, 1024}}
+	for _, i := range inputs {
+		assert.Equal(t, i[1], NextCapacity(i[0]))
+	}
+}
+
 /* Tree */
 
 func containsNode(nodes []Node, node *Node) bool {
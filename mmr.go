@@ -0,0 +1,159 @@
+package merkle
+
+import (
+	"errors"
+	"hash"
+)
+
+// MMR is a Merkle mountain range: an append only tree without a capacity.
+// The leaves are covered by perfect subtrees, the peaks, and the root is
+// computed by bagging the peaks from right to left, so with peaks p0, p1, p2
+// the root is hash(p0 || hash(p1 || p2)). Unlike an SMT it is not safe for
+// concurrent use
+type MMR struct {
+	// Hashing is delegated to an unfilled SMT
+	tree *SMT
+	// All nodes by height, nodes[0] being the leaves
+	nodes [][]Hash
+	count int
+}
+
+func NewMMR(hashFunc hash.Hash, opts ...Option) *MMR {
+	return &MMR{tree: NewSMT(nil, hashFunc, opts...), nodes: [][]Hash{{}}}
+}
+
+// AppendLeaves appends leaves, merging the peaks they complete. On error the
+// MMR is left unchanged
+func (self *MMR) AppendLeaves(leaves [][]byte) error {
+	hashes, err := self.tree.leafHashes(uint(self.count), leaves)
+	if err != nil {
+		return err
+	}
+	lengths := make([]int, len(self.nodes))
+	for height, row := range self.nodes {
+		lengths[height] = len(row)
+	}
+	for _, leafHash := range hashes {
+		if err := self.push(leafHash); err != nil {
+			self.nodes = self.nodes[:len(lengths)]
+			for height, length := range lengths {
+				self.nodes[height] = self.nodes[height][:length]
+			}
+			self.count = lengths[0]
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *MMR) AppendLeaf(leaf []byte) error {
+	return self.AppendLeaves([][]byte{leaf})
+}
+
+// Count returns the number of appended leaves
+func (self *MMR) Count() int {
+	return self.count
+}
+
+// Peaks returns the roots of the perfect subtrees covering all leaves, from
+// left to right
+func (self *MMR) Peaks() []Hash {
+	peaks := []Hash{}
+	for height := len(self.nodes) - 1; height >= 0; height-- {
+		if self.count&(1<<uint(height)) != 0 {
+			peaks = append(peaks, self.nodes[height][len(self.nodes[height])-1])
+		}
+	}
+	return peaks
+}
+
+// RootHash returns the bagged peaks, or nil if no leaf was appended
+func (self *MMR) RootHash() []byte {
+	root, err := self.bag(self.Peaks())
+	if err != nil {
+		return nil
+	}
+	return root
+}
+
+// GetMerkleProof returns the siblings of the leaf up to its peak, followed by
+// the bagging steps: the bag of the peaks right of it, if any, then every peak
+// left of it from the nearest one. The directions do not follow the leaf
+// number, so the proof verifies with VerifyProof but not with a Verifier
+// created WithStrictDirections
+func (self *MMR) GetMerkleProof(leafNo uint) ([]ProofNode, error) {
+	if leafNo >= uint(self.count) {
+		return nil, errors.New("Leaf number is out of range")
+	}
+	// Peaks are ordered left to right, highest first
+	peakHeight, position := 0, 0
+	offset := uint(0)
+	for height := len(self.nodes) - 1; height >= 0; height-- {
+		if self.count&(1<<uint(height)) == 0 {
+			continue
+		}
+		if leafNo < offset+1<<uint(height) {
+			peakHeight = height
+			break
+		}
+		offset += 1 << uint(height)
+		position++
+	}
+
+	proof := []ProofNode{}
+	for height := 0; height < peakHeight; height++ {
+		index := leafNo >> uint(height)
+		proof = append(proof, ProofNode{Left: index&1 == 1, Hash: self.nodes[height][index^1]})
+	}
+
+	peaks := self.Peaks()
+	if position < len(peaks)-1 {
+		right, err := self.bag(peaks[position+1:])
+		if err != nil {
+			return nil, err
+		}
+		proof = append(proof, ProofNode{Left: false, Hash: right})
+	}
+	for i := position - 1; i >= 0; i-- {
+		proof = append(proof, ProofNode{Left: true, Hash: peaks[i]})
+	}
+	return proof, nil
+}
+
+// Following are non public function
+
+// Appends a leaf hash and the parents it completes
+func (self *MMR) push(leafHash Hash) error {
+	node := leafHash
+	self.nodes[0] = append(self.nodes[0], node)
+	for height := 0; len(self.nodes[height])%2 == 0; height++ {
+		row := self.nodes[height]
+		parent, err := self.tree.parentHash(row[len(row)-2], node)
+		if err != nil {
+			return err
+		}
+		if height+1 == len(self.nodes) {
+			self.nodes = append(self.nodes, []Hash{})
+		}
+		self.nodes[height+1] = append(self.nodes[height+1], parent)
+		node = parent
+	}
+	self.count++
+	return nil
+}
+
+// Folds peaks from right to left
+func (self *MMR) bag(peaks []Hash) ([]byte, error) {
+	if len(peaks) == 0 {
+		return nil, errors.New("MMR is empty")
+	}
+	current := []byte(peaks[len(peaks)-1])
+	for i := len(peaks) - 2; i >= 0; i-- {
+		var err error
+		current, err = self.tree.parentHash(peaks[i], current)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return current, nil
+}
@@ -0,0 +1,72 @@
+package merkle
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMMR(t *testing.T) {
+	mmr := NewMMR(hashFunc)
+	assert.Nil(t, mmr.RootHash())
+	_, err := mmr.GetMerkleProof(0)
+	assert.Equal(t, "Leaf number is out of range", err.Error())
+
+	for count := 1; count <= 16; count++ {
+		err = mmr.AppendLeaf(testHashes[count-1])
+		assert.Nil(t, err)
+		assert.Equal(t, count, mmr.Count())
+
+		// Peaks cover the leaves with perfect subtrees, highest first
+		peaks := []Hash{}
+		start := 0
+		for height := 4; height >= 0; height-- {
+			if count&(1<<uint(height)) != 0 {
+				end := start + 1<<uint(height)
+				peak, err := ComputeRoot(testHashes[start:end], end-start, emptyHash, hashFunc)
+				assert.Nil(t, err)
+				peaks = append(peaks, peak)
+				start = end
+			}
+		}
+		assert.Equal(t, peaks, mmr.Peaks())
+		root := []byte(peaks[len(peaks)-1])
+		for i := len(peaks) - 2; i >= 0; i-- {
+			root = hashValue(append(append([]byte{}, peaks[i]...), root...), hashFunc)
+		}
+		assert.Equal(t, root, mmr.RootHash())
+
+		for leafNo := 0; leafNo < count; leafNo++ {
+			proof, err := mmr.GetMerkleProof(uint(leafNo))
+			assert.Nil(t, err)
+			err = VerifyProof(testHashes[leafNo], uint(leafNo), proof, mmr.RootHash(), hashFunc)
+			assert.Nil(t, err)
+			err = VerifyProof(testHashes[(leafNo+1)%16], uint(leafNo), proof, mmr.RootHash(), hashFunc)
+			assert.NotNil(t, err)
+		}
+		_, err = mmr.GetMerkleProof(uint(count))
+		assert.Equal(t, "Leaf number is out of range", err.Error())
+	}
+}
+
+func TestMMRAppendLeaves(t *testing.T) {
+	one := NewMMR(hashFunc)
+	batch := NewMMR(hashFunc)
+	for _, leaf := range testHashes[:11] {
+		err := one.AppendLeaf(leaf)
+		assert.Nil(t, err)
+	}
+	err := batch.AppendLeaves(testHashes[:5])
+	assert.Nil(t, err)
+	err = batch.AppendLeaves(testHashes[5:11])
+	assert.Nil(t, err)
+	assert.Equal(t, one.RootHash(), batch.RootHash())
+	assert.Len(t, batch.Peaks(), 3)
+
+	// A full MMR has a single peak, the root of the equivalent full SMT
+	err = batch.AppendLeaves(testHashes[11:])
+	assert.Nil(t, err)
+	tree := NewSMT(emptyHash, hashFunc)
+	err = tree.Generate(testHashes, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, tree.RootHash(), batch.RootHash())
+}
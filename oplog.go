@@ -0,0 +1,128 @@
+package merkle
+
+import (
+	"errors"
+	"hash"
+)
+
+// OperationKind identifies a tree mutation in an operation log
+type OperationKind int
+
+const (
+	OpGenerate OperationKind = iota
+	OpAppendLeaves
+	OpUpdateLeaf
+	OpReset
+	OpSetLeaf
+	OpTruncate
+	OpDeleteLeaf
+	OpBuildFromLeafHashes
+	OpGenerateFunc
+)
+
+// Operation is one recorded tree mutation. Leaves holds the raw inputs as
+// passed by the caller, the leaf hashes for OpBuildFromLeafHashes and the
+// stored leaves for OpGenerateFunc. Index is the written leaf for
+// OpUpdateLeaf and OpSetLeaf and the deleted one for OpDeleteLeaf. Size is
+// the total size for OpGenerate, OpBuildFromLeafHashes and OpGenerateFunc and
+// the kept leaves for OpTruncate. Gaps lists the unoccupied positions among
+// the leaves of OpGenerateFunc
+type Operation struct {
+	Kind   OperationKind
+	Index  uint
+	Leaves [][]byte
+	Size   int
+	Gaps   []uint
+}
+
+// OperationLog returns a copy of the mutations recorded so far, oldest first.
+// Recording is enabled with WithOperationLog
+func (self *SMT) OperationLog() []Operation {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return append([]Operation{}, self.operations...)
+}
+
+// ReplayLog builds a new tree with the given configuration and applies ops to
+// it in order, reproducing the tree the log was recorded from
+func ReplayLog(ops []Operation, emptyHash Hash, hashFunc hash.Hash, opts ...Option) (*SMT, error) {
+	tree := NewSMT(emptyHash, hashFunc, opts...)
+	for _, op := range ops {
+		var err error
+		switch op.Kind {
+		case OpGenerate:
+			err = tree.Generate(op.Leaves, op.Size)
+		case OpAppendLeaves:
+			_, err = tree.AppendLeaves(op.Leaves)
+		case OpUpdateLeaf:
+			if len(op.Leaves) != 1 {
+				return nil, errors.New("Update operation must hold exactly one leaf")
+			}
+			err = tree.UpdateLeaf(op.Index, op.Leaves[0])
+		case OpSetLeaf:
+			if len(op.Leaves) != 1 {
+				return nil, errors.New("Set operation must hold exactly one leaf")
+			}
+			err = tree.SetLeaf(op.Index, op.Leaves[0])
+		case OpTruncate:
+			err = tree.Truncate(op.Size)
+		case OpDeleteLeaf:
+			err = tree.DeleteLeaf(op.Index)
+		case OpBuildFromLeafHashes:
+			hashes := make([]Hash, 0, len(op.Leaves))
+			for _, leaf := range op.Leaves {
+				hashes = append(hashes, leaf)
+			}
+			err = tree.BuildFromLeafHashes(hashes, op.Size)
+		case OpGenerateFunc:
+			err = tree.replayGenerateFunc(op)
+		case OpReset:
+			tree.Reset()
+		default:
+			return nil, errors.New("Unknown operation")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+// Following are non public function
+
+func (self *SMT) record(op Operation) {
+	if !self.operationLog {
+		return
+	}
+	leaves := make([][]byte, 0, len(op.Leaves))
+	for _, leaf := range op.Leaves {
+		leaves = append(leaves, append([]byte{}, leaf...))
+	}
+	op.Leaves = leaves
+	if op.Gaps != nil {
+		op.Gaps = append([]uint{}, op.Gaps...)
+	}
+	self.operations = append(self.operations, op)
+}
+
+// Rebuilds exactly the stored leaves and gaps recorded by GenerateFunc
+func (self *SMT) replayGenerateFunc(op Operation) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.fullNodes) != 0 && !self.allowRebuild {
+		return errors.New("SMT tree already filled")
+	}
+	if err := checkTotalSize(len(op.Leaves), op.Size); err != nil {
+		return err
+	}
+	hashes := make([]Hash, 0, len(op.Leaves))
+	for _, leaf := range op.Leaves {
+		hashes = append(hashes, append(Hash{}, leaf...))
+	}
+	for _, gap := range op.Gaps {
+		if gap >= uint(len(hashes)) {
+			return errors.New("Gap is beyond the stored leaves")
+		}
+	}
+	return self.buildWithGaps(hashes, op.Size, op.Gaps)
+}
@@ -0,0 +1,317 @@
+package merkle
+
+import (
+	"hash"
+	"sync"
+)
+
+// Option configures optional behaviour of a tree
+type Option func(*config)
+
+type config struct {
+	bufferPool      *sync.Pool
+	leafHashFactory func() hash.Hash
+	secureErase     bool
+	operationLog    bool
+	sortedLeaves    bool
+	capacityInRoot  bool
+	indexedLeaves   bool
+	maxProofNodes   int
+	paddingLeaf     Hash
+	strict          bool
+	emptyNodeSeed   []byte
+	buildMetrics    bool
+	expectedLeaves  int
+	reusableBuffer  bool
+	leafHashWorkers int
+	uniformLevels   bool
+	hexPrefix       bool
+	combiner        func(left, right []byte) ([]byte, error)
+	allowRebuild    bool
+	maxLeafIndex    uint
+	uniformLeafSize bool
+	salt            []byte
+	leafPrefix      []byte
+	failFast        bool
+	emptyLeafHook   func(leafNo uint)
+	leafIndexBound  bool
+	emptyChain      *PrecomputedEmptyChain
+	rootTag         []byte
+	uniqueLeaves    bool
+}
+
+// WithBufferPool makes the tree compute node hashes into scratch buffers taken
+// from pool instead of allocating a new slice per node. The pool must hold
+// *[]byte values; a nil value from the pool is replaced by a new buffer.
+// Stored hashes are copied out of the buffers, so they stay safe to retain.
+// NewVerifier panics on it
+func WithBufferPool(pool *sync.Pool) Option {
+	return func(c *config) {
+		c.bufferPool = pool
+	}
+}
+
+// WithLeafHash makes the tree hash every raw leaf input with a hash created by
+// factory before storing it. Internal nodes keep using the tree's hash function
+func WithLeafHash(factory func() hash.Hash) Option {
+	return func(c *config) {
+		c.leafHashFactory = factory
+	}
+}
+
+// WithLeafIndexBinding makes every stored leaf the hash of its index, as a
+// big endian uint64, followed by the raw leaf, so a leaf proves only at its
+// own position. The leaf hash of WithLeafHash is used, or the tree's hash
+// function without one. A Verifier binds the leaves given to VerifyLeaf the
+// same way
+func WithLeafIndexBinding() Option {
+	return func(c *config) {
+		c.leafIndexBound = true
+	}
+}
+
+// WithLeafHashWorkers makes the tree hash the raw leaves given to WithLeafHash
+// on up to n goroutines. The stored leaves keep the order of the input.
+// NewVerifier panics on it
+func WithLeafHashWorkers(n int) Option {
+	return func(c *config) {
+		c.leafHashWorkers = n
+	}
+}
+
+// WithSecureErase makes the tree overwrite stored hashes with zeros before
+// discarding them in Reset and UpdateLeaf. Raw leaves are copied so the
+// caller's slices are never modified. This only reduces the residual exposure
+// of sensitive leaves: copies made by the runtime, the hash function or the
+// caller are out of its reach. NewVerifier panics on it
+func WithSecureErase() Option {
+	return func(c *config) {
+		c.secureErase = true
+	}
+}
+
+// WithOperationLog makes the tree record every successful mutation, see
+// OperationLog and ReplayLog. NewVerifier panics on it
+func WithOperationLog() Option {
+	return func(c *config) {
+		c.operationLog = true
+	}
+}
+
+// WithUniqueLeaves makes Generate fail with a *DuplicateLeafError if two of
+// the input leaves are byte equal. NewVerifier panics on it
+func WithUniqueLeaves() Option {
+	return func(c *config) {
+		c.uniqueLeaves = true
+	}
+}
+
+// WithSortedLeaves makes the tree represent a sorted set: Generate, AppendLeaves
+// and UpdateLeaf fail unless the stored leaves stay strictly increasing in
+// byte order, which enables neighbour based non-membership proofs.
+// NewVerifier panics on it
+func WithSortedLeaves() Option {
+	return func(c *config) {
+		c.sortedLeaves = true
+	}
+}
+
+// WithCapacityInRoot binds the capacity into the root, which becomes
+// hash(top node || big endian uint64 capacity). Proofs then only verify with
+// VerifyProofWithCapacity for the right capacity, or a Verifier with this
+// option binding the capacity implied by the proof length, so a proof from a
+// smaller tree cannot be presented against a larger one
+func WithCapacityInRoot() Option {
+	return func(c *config) {
+		c.capacityInRoot = true
+	}
+}
+
+// WithIndexedLeaves lets SetLeaf write any position within capacity instead
+// of only extending the non empty leaves by one. NewVerifier panics on it
+func WithIndexedLeaves() Option {
+	return func(c *config) {
+		c.indexedLeaves = true
+	}
+}
+
+// WithPaddingLeaf makes the tree fill the positions right of the non empty
+// leaves with pad instead of the empty hash, so a padded tree is told apart
+// from a sparse one. Unset positions left by SetLeaf keep the empty hash.
+// NewVerifier panics on it
+func WithPaddingLeaf(pad Hash) Option {
+	return func(c *config) {
+		c.paddingLeaf = append(Hash{}, pad...)
+	}
+}
+
+// WithStrictDirections makes a Verifier derive the side of every sibling from
+// the leaf number and reject proofs whose Left flags disagree with it, as well
+// as leaf numbers that do not fit the proof height. It has no effect on trees
+func WithStrictDirections() Option {
+	return func(c *config) {
+		c.strict = true
+	}
+}
+
+// WithRootTag makes the root hash(tag || top node), after binding the
+// capacity with WithCapacityInRoot, to separate roots from internal nodes and
+// the roots of other protocols. A Verifier with the same tag applies it to the
+// folded proof before comparing with the root
+func WithRootTag(tag []byte) Option {
+	return func(c *config) {
+		c.rootTag = append([]byte{}, tag...)
+	}
+}
+
+// WithEmptyChain makes the tree start from the empty subtree roots of chain
+// instead of hashing them again. The chain must have been made with the same
+// empty leaf and options; one whose empty or padding leaf, hash algorithm,
+// salt or empty node seed differs is ignored, and so is any chain when either
+// uses WithCombiner. NewVerifier panics on it
+func WithEmptyChain(chain *PrecomputedEmptyChain) Option {
+	return func(c *config) {
+		c.emptyChain = chain
+	}
+}
+
+// WithEmptyNodeSeed makes the roots of empty subtrees above the leaves
+// hash(seed || child || child) instead of hash(child || child), starting from
+// the empty (or padding) leaf. Nodes with a non empty descendant are hashed as
+// usual, and so are the unset positions of WithIndexedLeaves, which are
+// stored like any other leaf. Proofs of positions inside an empty subtree do
+// not fold into the root with VerifyProof, since its first parents are empty
+// nodes. NewVerifier panics on it
+func WithEmptyNodeSeed(seed []byte) Option {
+	return func(c *config) {
+		c.emptyNodeSeed = append([]byte{}, seed...)
+	}
+}
+
+// WithBuildMetrics makes Generate record the time spent computing every level
+// of internal nodes, see BuildMetrics. NewVerifier panics on it
+func WithBuildMetrics() Option {
+	return func(c *config) {
+		c.buildMetrics = true
+	}
+}
+
+// WithExpectedLeaves sizes the level table of the tree for totalSize leaves up
+// front, so generating a tree of that size does not grow it.
+// NewVerifier panics on it
+func WithExpectedLeaves(totalSize int) Option {
+	return func(c *config) {
+		c.expectedLeaves = totalSize
+	}
+}
+
+// WithReusableBuffer makes a Verifier fold proofs into one buffer it keeps
+// across calls, so verifying allocates nothing once the buffer has grown to
+// the hash size. Such a Verifier must not be used concurrently. It has no
+// effect on trees
+func WithReusableBuffer() Option {
+	return func(c *config) {
+		c.reusableBuffer = true
+	}
+}
+
+// WithUniformLevels makes Generate check whether all nodes of a level are
+// equal and, if so, hash their parent only once for the whole level. The
+// output is the same; the check costs one comparison per node.
+// NewVerifier panics on it
+func WithUniformLevels() Option {
+	return func(c *config) {
+		c.uniformLevels = true
+	}
+}
+
+// WithCombiner replaces hash(left || right) with combine(left, right) for
+// every internal node, empty subtree roots included, and for folding proofs
+// in a Verifier. It lets a tree match external definitions that e.g. length
+// prefix or separate the children. The capacity bound of WithCapacityInRoot is
+// still hashed as usual
+func WithCombiner(combine func(left, right []byte) ([]byte, error)) Option {
+	return func(c *config) {
+		c.combiner = combine
+	}
+}
+
+// WithSalt makes every internal node, empty subtree roots included,
+// hash(salt || left || right), for trees and for folding proofs in a
+// Verifier, so trees with different salts never share roots or proofs. Leaves
+// are not salted. It is ignored with WithCombiner
+func WithSalt(salt []byte) Option {
+	return func(c *config) {
+		c.salt = append([]byte{}, salt...)
+	}
+}
+
+// WithEmptyLeafProofHook makes GetMerkleProof call hook with the leaf number
+// whenever it proves an empty leaf, right of the non empty leaves or unset,
+// which is often a mistake for a non membership proof. The proof is returned
+// as usual. The hook is called without the tree locked. NewVerifier panics on it
+func WithEmptyLeafProofHook(hook func(leafNo uint)) Option {
+	return func(c *config) {
+		c.emptyLeafHook = hook
+	}
+}
+
+// WithAllowRebuild makes Generate on a filled tree reset it and build it
+// again instead of failing. The reset is not recorded in the operation log,
+// so a log is replayed with the same option. NewVerifier panics on it
+func WithAllowRebuild() Option {
+	return func(c *config) {
+		c.allowRebuild = true
+	}
+}
+
+// WithUniformLeafSize makes the tree reject leaves whose stored form, after
+// the leaf hash if there is one, is not as long as the node hashes. By default
+// the leaf level may have a different width than the internal nodes, e.g.
+// leaves pre hashed with a longer algorithm, and proofs then mix both sizes.
+// NewVerifier panics on it
+func WithUniformLeafSize() Option {
+	return func(c *config) {
+		c.uniformLeafSize = true
+	}
+}
+
+// WithHexPrefix makes GetMerkleProofHex prefix every hash with 0x.
+// NewVerifier panics on it
+func WithHexPrefix() Option {
+	return func(c *config) {
+		c.hexPrefix = true
+	}
+}
+
+// WithMaxProofNodes makes a Verifier reject proofs with more than n nodes
+// before hashing any of them. It has no effect on trees
+func WithMaxProofNodes(n int) Option {
+	return func(c *config) {
+		c.maxProofNodes = n
+	}
+}
+
+// WithLeafPrefix makes a Verifier reject leaf hashes that do not start with
+// prefix, before hashing anything. It has no effect on trees
+func WithLeafPrefix(prefix []byte) Option {
+	return func(c *config) {
+		c.leafPrefix = append([]byte{}, prefix...)
+	}
+}
+
+// WithFailFast makes Verifier.VerifyBatch stop at the first invalid proof
+// instead of verifying the whole batch. It has no effect on trees
+func WithFailFast() Option {
+	return func(c *config) {
+		c.failFast = true
+	}
+}
+
+// WithMaxLeafIndex makes a Verifier reject proofs of leaves beyond max before
+// hashing anything, as a policy guard. It has no effect on trees
+func WithMaxLeafIndex(max uint) Option {
+	return func(c *config) {
+		c.maxLeafIndex = max
+	}
+}
@@ -0,0 +1,72 @@
+package merkle
+
+import (
+	"errors"
+)
+
+// PartialSMT holds the slice of an SMT needed to serve proofs for the leaves
+// in [start, end): per height, the nodes covering the range and their
+// boundary siblings. Its proofs verify against the root of the full tree
+type PartialSMT struct {
+	start      uint
+	end        uint
+	treeHeight int
+	// Stored nodes per height, leaves first, each window starting at offsets
+	windows  [][]Hash
+	offsets  []uint
+	rootHash []byte
+}
+
+// ExportForRange returns a PartialSMT able to answer GetMerkleProof for every
+// leaf in [start, end). The hashes are copied, later changes to the tree do
+// not affect it
+func (self *SMT) ExportForRange(start uint, end uint) (*PartialSMT, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return nil, errors.New("SMT tree is not filled")
+	}
+	if start >= end || end > uint(self.capacity()) {
+		return nil, errors.New("Invalid leaf range")
+	}
+
+	partial := &PartialSMT{start: start, end: end, treeHeight: self.treeHeight, rootHash: self.rootHash()}
+	for height := 0; height < self.treeHeight-1; height++ {
+		first := (start >> uint(height)) &^ 1
+		last := ((end - 1) >> uint(height)) | 1
+		window := make([]Hash, 0, last-first+1)
+		for index := first; index <= last; index++ {
+			node := self.nodeHash(self.treeHeight-1-height, int(index))
+			window = append(window, append(Hash{}, node...))
+		}
+		partial.windows = append(partial.windows, window)
+		partial.offsets = append(partial.offsets, first)
+	}
+	return partial, nil
+}
+
+// GetMerkleProof returns the same proof as the full tree for a leaf inside the
+// exported range
+func (self *PartialSMT) GetMerkleProof(leafNo uint) ([]ProofNode, error) {
+	if leafNo < self.start || leafNo >= self.end {
+		return nil, errors.New("Leaf number is outside the exported range")
+	}
+	proofs := []ProofNode{}
+	index := leafNo
+	for height, window := range self.windows {
+		sibling := window[(index^1)-self.offsets[height]]
+		proofs = append(proofs, ProofNode{Hash: sibling, Left: index%2 == 1})
+		index = index / 2
+	}
+	return proofs, nil
+}
+
+// Range returns the exported leaf range [start, end)
+func (self *PartialSMT) Range() (uint, uint) {
+	return self.start, self.end
+}
+
+// RootHash returns the root of the tree the range was exported from
+func (self *PartialSMT) RootHash() []byte {
+	return self.rootHash
+}
@@ -0,0 +1,52 @@
+package merkle
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestExportForRange(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:11], 32)
+	assert.Nil(t, err)
+
+	for _, bounds := range [][2]uint{{0, 1}, {0, 32}, {3, 9}, {5, 6}, {9, 20}, {16, 32}, {31, 32}} {
+		partial, err := tree.ExportForRange(bounds[0], bounds[1])
+		assert.Nil(t, err)
+		assert.Equal(t, tree.RootHash(), partial.RootHash())
+		for leafNo := uint(0); leafNo < 32; leafNo++ {
+			proof, err := partial.GetMerkleProof(leafNo)
+			if leafNo < bounds[0] || leafNo >= bounds[1] {
+				assert.Equal(t, "Leaf number is outside the exported range", err.Error())
+				continue
+			}
+			assert.Nil(t, err)
+			expected, _ := tree.GetMerkleProof(leafNo)
+			assert.Equal(t, expected, proof)
+		}
+	}
+
+	//a narrow range keeps a couple of nodes per level
+	partial, err := tree.ExportForRange(5, 6)
+	assert.Nil(t, err)
+	for _, window := range partial.windows {
+		assert.Len(t, window, 2)
+	}
+
+	//the export does not follow later changes to the tree
+	partial, err = tree.ExportForRange(3, 9)
+	assert.Nil(t, err)
+	root := tree.RootHash()
+	err = tree.UpdateLeaf(4, testHashes[15])
+	assert.Nil(t, err)
+	proof, err := partial.GetMerkleProof(3)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyProof(testHashes[3], 3, proof, root, hashFunc))
+
+	for _, bounds := range [][2]uint{{4, 4}, {5, 3}, {0, 33}} {
+		_, err = tree.ExportForRange(bounds[0], bounds[1])
+		assert.Equal(t, "Invalid leaf range", err.Error())
+	}
+	_, err = NewSMT(emptyHash, hashFunc).ExportForRange(0, 1)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+}
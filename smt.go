@@ -6,168 +6,1635 @@ in the LICENSE file.
 package merkle
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"hash"
+	"math/rand"
+	"runtime"
+	"sync"
+	"time"
+	"unsafe"
 )
 
-// A Sparse Merkle Tree which support all empty leaves lies in right
+var sliceHeaderSize = int(unsafe.Sizeof([]byte(nil)))
+
+// A Sparse Merkle Tree which support all empty leaves lies in right.
+//
+// An SMT is safe for concurrent use: methods reading the tree may run in
+// parallel with each other, methods modifying it run exclusively. Hashes
+// returned by the tree share memory with it and must not be modified; with
+// WithSecureErase they are zeroed once the tree discards them
 type SMT struct {
+	// Held for reading by queries and for writing by mutations
+	mu sync.RWMutex
+	// Serializes use of hashFunc by queries running in parallel
+	hashMu sync.Mutex
+	// Stored nodes per level, leaves first. Fully empty subtrees are never
+	// stored, their roots are taken from emptyTreeRootHash, which starts
+	// with the padding leaf if there is one
 	fullNodes             [][]Hash
 	hashFunc              hash.Hash
 	emptyHash             Hash
 	emptyTreeRootHash     []Hash
 	treeHeight            int
 	countOfNonEmptyLeaves int
+	// Positions below countOfNonEmptyLeaves holding an empty placeholder
+	unsetLeaves map[uint]struct{}
+	operations  []Operation
+	// Time spent per level by the last Generate, parents of the leaves first
+	levelDurations []time.Duration
+	config
+}
+
+func NewSMT(emptyHash Hash, hashFunc hash.Hash, opts ...Option) *SMT {
+	tree := &SMT{fullNodes: [][]Hash{}, emptyTreeRootHash: []Hash{emptyHash}, emptyHash: emptyHash, hashFunc: hashFunc}
+	for _, opt := range opts {
+		opt(&tree.config)
+	}
+	if tree.paddingLeaf != nil {
+		tree.emptyTreeRootHash = []Hash{tree.paddingLeaf}
+	}
+	if tree.emptyChain != nil && tree.emptyChain.matches(tree) {
+		// The chain is shared read only: the full slice expression makes any
+		// extension copy it instead of writing into the shared array
+		roots := tree.emptyChain.roots
+		tree.emptyTreeRootHash = roots[:len(roots):len(roots)]
+	}
+	if tree.expectedLeaves > 0 {
+		tree.fullNodes = make([][]Hash, 0, levelsFor(tree.expectedLeaves))
+	}
+	return tree
+}
+
+// RootHash returns the root of the tree, bound to the capacity when the tree
+// uses WithCapacityInRoot. It returns nil if the tree is not filled or if
+// computing the binding fails
+func (self *SMT) RootHash() []byte {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.rootHash()
+}
+
+func (self *SMT) Generate(leaves [][]byte, totalSize int) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.generate(leaves, totalSize)
+}
+
+// BuildFromLeafHashes generates the tree from leaf hashes computed elsewhere,
+// storing them as they are instead of applying the leaf hash. Every hash must
+// be as long as the output of the leaf hash, or of the node hash if there is
+// none
+func (self *SMT) BuildFromLeafHashes(leafHashes []Hash, totalSize int) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.fullNodes) != 0 && !self.allowRebuild {
+		return errors.New("SMT tree already filled")
+	}
+	if err := checkTotalSize(len(leafHashes), totalSize); err != nil {
+		return err
+	}
+	size := self.hashFunc.Size()
+	if self.leafHashFactory != nil {
+		size = self.leafHashFactory().Size()
+	}
+	hashes := make([]Hash, 0, len(leafHashes))
+	for _, hash := range leafHashes {
+		if len(hash) != size {
+			return errors.New("Leaf hash size does not match the hash size")
+		}
+		if self.secureErase {
+			// Erasing must never touch the caller's own slices
+			hash = append(Hash{}, hash...)
+		}
+		hashes = append(hashes, hash)
+	}
+	if err := self.build(hashes, totalSize); err != nil {
+		return err
+	}
+	leaves := make([][]byte, 0, len(hashes))
+	for _, hash := range hashes {
+		leaves = append(leaves, hash)
+	}
+	self.record(Operation{Kind: OpBuildFromLeafHashes, Leaves: leaves, Size: totalSize})
+	return nil
+}
+
+// GenerateFunc generates the tree from valueAt, which returns the leaf at
+// every position and whether the position is occupied, so sparse trees need
+// not be materialized by the caller. valueAt is called once per position.
+// Unoccupied positions left of the last occupied one hold the empty leaf, and
+// are unset with WithIndexedLeaves. The leaves are checked as by Generate for
+// WithUniqueLeaves and WithSortedLeaves, a sorted tree having no unoccupied
+// positions among them. The operation log records the stored leaves and the
+// unoccupied positions as OpGenerateFunc
+func (self *SMT) GenerateFunc(valueAt func(index uint) ([]byte, bool), totalSize int) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.fullNodes) != 0 && !self.allowRebuild {
+		return errors.New("SMT tree already filled")
+	}
+	if err := checkTotalSize(0, totalSize); err != nil {
+		return err
+	}
+	hashes := []Hash{}
+	gaps := []uint{}
+	seen := map[string]int{}
+	for index := uint(0); index < uint(totalSize); index++ {
+		value, ok := valueAt(index)
+		if !ok {
+			continue
+		}
+		if self.uniqueLeaves {
+			if first, ok := seen[string(value)]; ok {
+				return &DuplicateLeafError{First: first, Second: int(index)}
+			}
+			seen[string(value)] = int(index)
+		}
+		if self.sortedLeaves && index != uint(len(hashes)) {
+			return errors.New("Sorted leaves cannot leave unset positions")
+		}
+		// Only the gaps left of an occupied position are stored
+		for gap := uint(len(hashes)); gap < index; gap++ {
+			gaps = append(gaps, gap)
+			hashes = append(hashes, append(Hash{}, self.emptyHash...))
+		}
+		leaf, err := self.leafHashes(index, [][]byte{value})
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, leaf[0])
+	}
+	return self.buildWithGaps(hashes, totalSize, gaps)
+}
+
+// GenerateFromChannel generates the tree from the leaves received on ch until
+// it is closed. It fails as soon as more than totalSize leaves arrive, without
+// draining the channel. The tree is not locked while waiting for leaves, so
+// producers may query it meanwhile
+func (self *SMT) GenerateFromChannel(ch <-chan []byte, totalSize int) error {
+	if err := checkTotalSize(0, totalSize); err != nil {
+		return err
+	}
+	leaves := [][]byte{}
+	for leaf := range ch {
+		if len(leaves) == totalSize {
+			return errors.New("NonEmptyLeaves is bigger than totalSize")
+		}
+		leaves = append(leaves, leaf)
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.generate(leaves, totalSize)
+}
+
+// GenerateWithMinCapacity generates the tree with the smallest power of 2
+// capacity holding both minCapacity and all leaves. See Capacity
+func (self *SMT) GenerateWithMinCapacity(leaves [][]byte, minCapacity int) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(leaves) > minCapacity {
+		minCapacity = len(leaves)
+	}
+	return self.generate(leaves, NextCapacity(minCapacity))
+}
+
+// Capacity returns the number of leaves the tree holds, 0 if not filled
+func (self *SMT) Capacity() int {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return 0
+	}
+	return self.capacity()
+}
+
+// HashSize returns the size of the internal node hashes and the root. Leaves
+// hashed with WithLeafHash may have another size
+func (self *SMT) HashSize() int {
+	return self.hashFunc.Size()
+}
+
+// RemainingCapacity returns the number of leaves that can still be written:
+// the positions right of the non empty leaves plus, with WithIndexedLeaves,
+// the unset positions among them. It returns 0 if the tree is not filled
+func (self *SMT) RemainingCapacity() int {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return 0
+	}
+	return self.capacity() - self.countOfNonEmptyLeaves + len(self.unsetLeaves)
+}
+
+// Leaf mumber begins with 0
+func (self *SMT) GetMerkleProof(leafNo uint) ([]ProofNode, error) {
+	self.mu.RLock()
+	proof, err := self.getMerkleProof(leafNo)
+	_, unset := self.unsetLeaves[leafNo]
+	empty := err == nil && (leafNo >= uint(self.countOfNonEmptyLeaves) || unset)
+	self.mu.RUnlock()
+	if empty && self.emptyLeafHook != nil {
+		self.emptyLeafHook(leafNo)
+	}
+	return proof, err
+}
+
+// GetSampleProofs returns the proofs of n distinct non empty leaves chosen
+// pseudorandomly from seed, for auditing a sample of the tree against its
+// root. The same seed picks the same leaves of the same tree
+func (self *SMT) GetSampleProofs(n int, seed int64) (map[uint][]ProofNode, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return nil, errors.New("SMT tree is not filled")
+	}
+	var candidates []uint
+	count := self.countOfNonEmptyLeaves
+	if len(self.unsetLeaves) != 0 {
+		candidates = make([]uint, 0, count-len(self.unsetLeaves))
+		for leafNo := uint(0); leafNo < uint(count); leafNo++ {
+			if _, unset := self.unsetLeaves[leafNo]; !unset {
+				candidates = append(candidates, leafNo)
+			}
+		}
+		count = len(candidates)
+	}
+	if n < 0 || n > count {
+		return nil, errors.New("Sample size is out of range")
+	}
+	// A partial Fisher-Yates shuffle keeping only the swapped positions, so
+	// sampling a tree without unset positions costs O(n)
+	random := rand.New(rand.NewSource(seed))
+	swapped := map[int]int{}
+	at := func(i int) int {
+		if j, ok := swapped[i]; ok {
+			return j
+		}
+		return i
+	}
+	proofs := make(map[uint][]ProofNode, n)
+	for i := 0; i < n; i++ {
+		j := i + random.Intn(count-i)
+		chosen := at(j)
+		swapped[j] = at(i)
+		leafNo := uint(chosen)
+		if candidates != nil {
+			leafNo = candidates[chosen]
+		}
+		proofs[leafNo] = self.proofToLevel(leafNo, 0)
+	}
+	return proofs, nil
+}
+
+// NodeHash returns the hash of the node at (level, index), where level 0 is
+// the root and treeHeight-1 the leaves, synthesizing the roots of empty
+// subtrees. Level 0 holds the top node before any root binding
+func (self *SMT) NodeHash(level, index int) (Hash, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return nil, errors.New("SMT tree is not filled")
+	}
+	if err := self.checkCoordinate(level, index); err != nil {
+		return nil, err
+	}
+	return self.nodeHash(level, index), nil
+}
+
+// NodeInputs returns the children hashed together into the node at (level,
+// index), with the coordinates of NodeHash, synthesizing the roots of empty
+// subtrees. Empty nodes of a tree created with WithEmptyNodeSeed also hash
+// the seed, see the option
+func (self *SMT) NodeInputs(level, index int) (left Hash, right Hash, err error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return nil, nil, errors.New("SMT tree is not filled")
+	}
+	if err := self.checkCoordinate(level, index); err != nil {
+		return nil, nil, err
+	}
+	if level == self.treeHeight-1 {
+		return nil, nil, errors.New("Leaves have no children")
+	}
+	return self.nodeHash(level+1, 2*index), self.nodeHash(level+1, 2*index+1), nil
+}
+
+// NodeLeafRange returns the range [start, end) of the leaves under the node
+// at (level, index), with the coordinates of NodeHash
+func (self *SMT) NodeLeafRange(level, index int) (start, end uint, err error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.nodeLeafRange(level, index)
+}
+
+// LeavesUnder returns the non empty leaves below the node at (level, index),
+// whose proofs all go through it, or nil if the coordinate is invalid. Only
+// the stored leaves are listed, so it stays cheap for high nodes of large
+// sparse trees; NodeLeafRange gives the whole span
+func (self *SMT) LeavesUnder(level, index int) []uint {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	start, end, err := self.nodeLeafRange(level, index)
+	if err != nil {
+		return nil
+	}
+	if end > uint(self.countOfNonEmptyLeaves) {
+		end = uint(self.countOfNonEmptyLeaves)
+	}
+	leaves := []uint{}
+	for leafNo := start; leafNo < end; leafNo++ {
+		if _, unset := self.unsetLeaves[leafNo]; !unset {
+			leaves = append(leaves, leafNo)
+		}
+	}
+	return leaves
+}
+
+// GetMerkleProofToLevel returns the part of the proof of leafNo that ends at
+// its ancestor on stopLevel, level 0 being the root: folding the leaf with it
+// yields that ancestor's hash, which a proof of the subtree root can then
+// carry on to the root. stopLevel 0 gives the full proof
+func (self *SMT) GetMerkleProofToLevel(leafNo uint, stopLevel int) ([]ProofNode, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return nil, errors.New("SMT tree is not filled")
+	}
+	if stopLevel < 0 || stopLevel >= self.treeHeight {
+		return nil, errors.New("Level is out of range")
+	}
+	if leafNo >= uint(self.capacity()) {
+		return nil, errors.New("Leaf number is out of range")
+	}
+	return self.proofToLevel(leafNo, stopLevel), nil
+}
+
+// GetMerkleProofCoords returns the proof of leafNo with the coordinate of
+// every sibling
+func (self *SMT) GetMerkleProofCoords(leafNo uint) ([]CoordProofNode, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return nil, errors.New("SMT tree is not filled")
+	}
+	if leafNo >= uint(self.capacity()) {
+		return nil, errors.New("Leaf number is out of range")
+	}
+	proof := self.proofToLevel(leafNo, 0)
+	nodes := make([]CoordProofNode, 0, len(proof))
+	index := int(leafNo)
+	for i, node := range proof {
+		nodes = append(nodes, CoordProofNode{Left: node.Left, Hash: node.Hash, Level: self.treeHeight - 1 - i, Index: index ^ 1})
+		index = index / 2
+	}
+	return nodes, nil
+}
+
+// WithExternalParent embeds the tree as a child of an external node: it
+// returns the hash of the root with siblingRoot, the tree on the left if
+// selfOnLeft, and the node to append to proofs of this tree so they verify
+// against the combined root. Roots binding the capacity are not supported
+func (self *SMT) WithExternalParent(siblingRoot Hash, selfOnLeft bool) (combinedRoot []byte, extension ProofNode, err error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return nil, ProofNode{}, errors.New("SMT tree is not filled")
+	}
+	if self.capacityInRoot {
+		return nil, ProofNode{}, errors.New("External parents do not support capacity bound roots")
+	}
+	if self.rootTag != nil {
+		return nil, ProofNode{}, errors.New("External parents do not support tagged roots")
+	}
+	root := self.nodeHash(0, 0)
+	if selfOnLeft {
+		combinedRoot, err = self.parentHash(root, siblingRoot)
+	} else {
+		combinedRoot, err = self.parentHash(siblingRoot, root)
+	}
+	if err != nil {
+		return nil, ProofNode{}, err
+	}
+	return combinedRoot, ProofNode{Left: !selfOnLeft, Hash: siblingRoot}, nil
+}
+
+// AppendLeaves appends leaves right after the last non empty leaf and
+// recomputes the affected nodes once for the whole batch. It returns the
+// index of the first appended leaf. The tree is left untouched on error
+func (self *SMT) AppendLeaves(leaves [][]byte) (uint, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.appendLeaves(leaves)
+}
+
+// AppendLeaf appends a single leaf, see AppendLeaves
+func (self *SMT) AppendLeaf(leaf []byte) (uint, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.appendLeaves([][]byte{leaf})
+}
+
+// UpdateLeaf replaces a non empty leaf and recomputes the nodes on its path
+func (self *SMT) UpdateLeaf(leafNo uint, leaf []byte) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.fullNodes) == 0 {
+		return errors.New("SMT tree is not filled")
+	}
+	if leafNo >= uint(self.countOfNonEmptyLeaves) {
+		return errors.New("Leaf number is beyond the non empty leaves")
+	}
+	hashes, err := self.leafHashes(leafNo, [][]byte{leaf})
+	if err != nil {
+		return err
+	}
+	err = self.setLeafHash(leafNo, hashes[0])
+	if err != nil {
+		return err
+	}
+	self.record(Operation{Kind: OpUpdateLeaf, Index: leafNo, Leaves: [][]byte{leaf}})
+	return nil
+}
+
+// SetLeaf writes a leaf at any position within capacity. Positions up to the
+// last non empty leaf are updated in place and the next one is appended.
+// Writing further right requires WithIndexedLeaves: the positions in between
+// are filled with empty leaves, which are tracked as unset
+func (self *SMT) SetLeaf(leafNo uint, leaf []byte) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.fullNodes) == 0 {
+		return errors.New("SMT tree is not filled")
+	}
+	if leafNo >= uint(self.capacity()) {
+		return errors.New("Leaf number is out of range")
+	}
+	count := uint(self.countOfNonEmptyLeaves)
+	if leafNo > count && !self.indexedLeaves {
+		return errors.New("Leaf number is beyond the non empty leaves")
+	}
+	if leafNo > count && self.sortedLeaves {
+		return errors.New("Sorted leaves cannot leave unset positions")
+	}
+	hashes, err := self.leafHashes(leafNo, [][]byte{leaf})
+	if err != nil {
+		return err
+	}
+
+	if leafNo < count {
+		err = self.setLeafHash(leafNo, hashes[0])
+	} else {
+		_, err = self.appendHashes(self.gapLeaves(leafNo, hashes[0]))
+		if err == nil {
+			for i := count; i < leafNo; i++ {
+				self.markUnset(i)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	self.record(Operation{Kind: OpSetLeaf, Index: leafNo, Leaves: [][]byte{leaf}})
+	return nil
+}
+
+// RootWithLeaf returns the root the tree would have if SetLeaf wrote leaf at
+// leafNo, folding it with the current siblings. The tree is not modified
+func (self *SMT) RootWithLeaf(leafNo uint, leaf []byte) ([]byte, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return nil, errors.New("SMT tree is not filled")
+	}
+	if leafNo >= uint(self.capacity()) {
+		return nil, errors.New("Leaf number is out of range")
+	}
+	if leafNo > uint(self.countOfNonEmptyLeaves) && !self.indexedLeaves {
+		return nil, errors.New("Leaf number is beyond the non empty leaves")
+	}
+	hashes, err := self.leafHashes(leafNo, [][]byte{leaf})
+	if err != nil {
+		return nil, err
+	}
+	count := self.countOfNonEmptyLeaves
+	if leafNo < uint(count) {
+		path, err := self.pathHashes(int(leafNo), hashes[0])
+		if err != nil {
+			return nil, err
+		}
+		return self.finalizeRoot(path[len(path)-1])
+	}
+	// Beyond the non empty leaves the gaps are stored as SetLeaf stores them
+	leaves := append(self.fullNodes[0][:count:count], self.gapLeaves(leafNo, hashes[0])...)
+	rows, err := self.rebuildFrom(count, leaves)
+	if err != nil {
+		return nil, err
+	}
+	return self.finalizeRoot(rows[len(rows)-1][0])
+}
+
+// Truncate keeps the first newLeafCount non empty leaves, turns the others
+// into empty leaves and recomputes the nodes right of the kept ones. With
+// WithIndexedLeaves the unset positions the cut leaves last are dropped too
+func (self *SMT) Truncate(newLeafCount int) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.fullNodes) == 0 {
+		return errors.New("SMT tree is not filled")
+	}
+	if newLeafCount < 0 || newLeafCount > self.countOfNonEmptyLeaves {
+		return errors.New("Leaf count is beyond the non empty leaves")
+	}
+	if err := self.truncate(newLeafCount); err != nil {
+		return err
+	}
+	self.record(Operation{Kind: OpTruncate, Size: newLeafCount})
+	return nil
+}
+
+// DeleteLeaf turns a non empty leaf back into an empty leaf, keeping the
+// indices of the others. With right packed leaves only the last one can be
+// deleted, and the tree shrinks by one leaf. With WithIndexedLeaves any leaf
+// can be deleted: an interior one becomes an unset position, and deleting the
+// last one also drops the unset positions left of it
+func (self *SMT) DeleteLeaf(leafNo uint) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.fullNodes) == 0 {
+		return errors.New("SMT tree is not filled")
+	}
+	count := uint(self.countOfNonEmptyLeaves)
+	if leafNo >= count {
+		return errors.New("Leaf number is beyond the non empty leaves")
+	}
+	if _, ok := self.unsetLeaves[leafNo]; ok {
+		return errors.New("Leaf is already empty")
+	}
+	var err error
+	if leafNo == count-1 {
+		err = self.truncate(int(leafNo))
+	} else {
+		if !self.indexedLeaves {
+			return errors.New("Only the last leaf can be deleted without indexed leaves")
+		}
+		if self.sortedLeaves {
+			return errors.New("Sorted leaves cannot leave unset positions")
+		}
+		err = self.setLeafHash(leafNo, append(Hash{}, self.emptyHash...))
+		if err == nil {
+			self.markUnset(leafNo)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	self.record(Operation{Kind: OpDeleteLeaf, Index: leafNo})
+	return nil
+}
+
+// IsValidPrefix reports whether leaves form a left packed non empty region:
+// none of them, in stored form, equals the empty leaf (or the padding leaf),
+// so the non empty leaves of a tree generated from them are exactly leaves.
+// When the tree is filled they must also fit its capacity
+func (self *SMT) IsValidPrefix(leaves [][]byte) bool {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) != 0 && len(leaves) > self.capacity() {
+		return false
+	}
+	hashes, err := self.leafHashes(0, leaves)
+	if err != nil {
+		return false
+	}
+	for _, hash := range hashes {
+		if bytes.Equal(hash, self.emptyHash) || bytes.Equal(hash, self.emptyTreeRootHash[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchesLeaves reports whether the non empty leaves of the tree are exactly
+// expected, in stored form, and otherwise the first index at which they
+// differ. When one is a prefix of the other that is the length of the
+// shorter one. Unset positions of WithIndexedLeaves are compared as stored,
+// i.e. as empty leaves. An unfilled tree, or a failure to hash expected,
+// mismatches at 0
+func (self *SMT) MatchesLeaves(expected [][]byte) (bool, int) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return false, 0
+	}
+	hashes, err := self.leafHashes(0, expected)
+	if err != nil {
+		return false, 0
+	}
+	stored := self.fullNodes[0][:self.countOfNonEmptyLeaves]
+	for i := 0; i < len(hashes) && i < len(stored); i++ {
+		if !bytes.Equal(hashes[i], stored[i]) {
+			return false, i
+		}
+	}
+	if len(hashes) != len(stored) {
+		if len(hashes) < len(stored) {
+			return false, len(hashes)
+		}
+		return false, len(stored)
+	}
+	return true, -1
+}
+
+// SharedProofNodes returns the number of nodes the proofs of leafA and leafB
+// have in common: the siblings of their common ancestor and of every node
+// above it. Below the ancestor the proofs differ. It returns 0 if the tree is
+// not filled or either leaf is out of range
+func (self *SMT) SharedProofNodes(leafA, leafB uint) int {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 || leafA >= uint(self.capacity()) || leafB >= uint(self.capacity()) {
+		return 0
+	}
+	// The common ancestor is as high as the highest differing bit
+	height := 0
+	for diff := leafA ^ leafB; diff != 0; diff >>= 1 {
+		height++
+	}
+	return self.treeHeight - 1 - height
+}
+
+// AffectedProofIndices returns the non empty leaves whose proofs change when
+// leaf updatedLeafNo is updated. Every other leaf's proof holds, at the level
+// where its path meets the updated one, the root of the subtree containing
+// the updated leaf, so all of them are affected; only the updated leaf keeps
+// its proof. Unset positions of WithIndexedLeaves are not listed. It returns
+// nil if the tree is not filled or updatedLeafNo is out of range
+func (self *SMT) AffectedProofIndices(updatedLeafNo uint) []uint {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 || updatedLeafNo >= uint(self.capacity()) {
+		return nil
+	}
+	affected := []uint{}
+	for i := uint(0); i < uint(self.countOfNonEmptyLeaves); i++ {
+		if _, ok := self.unsetLeaves[i]; ok || i == updatedLeafNo {
+			continue
+		}
+		affected = append(affected, i)
+	}
+	return affected
+}
+
+// Reset discards all nodes so the tree can be generated again
+func (self *SMT) Reset() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.reset()
+	self.record(Operation{Kind: OpReset})
+}
+
+// BuildMetrics returns the wall clock time the last Generate spent computing
+// each level of internal nodes, the parents of the leaves first. It is empty
+// unless the tree was created with WithBuildMetrics
+func (self *SMT) BuildMetrics() []time.Duration {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return append([]time.Duration{}, self.levelDurations...)
+}
+
+// TreeStats is a snapshot of the shape of a tree
+type TreeStats struct {
+	// Nodes of the complete tree, leaves included
+	TotalNodes int
+	// Nodes held in memory, and nodes standing for an empty subtree whose
+	// hash is taken from the empty subtree roots
+	StoredNodes int
+	EmptyNodes  int
+	// Number of levels, leaves included
+	Height   int
+	Capacity int
+	// Fraction of the capacity holding non empty leaves
+	Occupancy float64
+}
+
+// QuickCheck checks the shape of the tree without hashing, in O(levels): one
+// stored row per level, each holding half the nodes of the row below rounded
+// up, the leaves fitting the capacity, and enough empty subtree roots to pad
+// every row. It does not check the hashes themselves
+func (self *SMT) QuickCheck() error {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.emptyTreeRootHash) == 0 {
+		return errors.New("Empty subtree roots are missing")
+	}
+	if len(self.fullNodes) == 0 {
+		if self.countOfNonEmptyLeaves != 0 {
+			return errors.New("Unfilled tree has non empty leaves")
+		}
+		return nil
+	}
+	if self.treeHeight < 1 || self.treeHeight > 64 {
+		return errors.New("Tree height is out of range")
+	}
+	if len(self.fullNodes) != self.treeHeight {
+		return fmt.Errorf("Tree has %d stored levels, expected %d", len(self.fullNodes), self.treeHeight)
+	}
+	if len(self.fullNodes[0]) != self.countOfNonEmptyLeaves {
+		return errors.New("Stored leaves do not match the non empty leaves count")
+	}
+	if self.countOfNonEmptyLeaves > self.capacity() {
+		return errors.New("NonEmptyLeaves is bigger than totalSize")
+	}
+	for height := 1; height < self.treeHeight; height++ {
+		if len(self.fullNodes[height]) != (len(self.fullNodes[height-1])+1)/2 {
+			return fmt.Errorf("Stored row at height %d has %d nodes, expected %d", height, len(self.fullNodes[height]), (len(self.fullNodes[height-1])+1)/2)
+		}
+	}
+	needed := 0
+	for empty := self.capacity() - self.countOfNonEmptyLeaves; empty > 0; empty >>= 1 {
+		needed++
+	}
+	if len(self.emptyTreeRootHash) < needed {
+		return errors.New("Empty subtree roots are missing")
+	}
+	return nil
+}
+
+// Stats returns the shape of the tree, computed from the row lengths. It
+// returns the zero TreeStats if the tree is not filled
+func (self *SMT) Stats() TreeStats {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return TreeStats{}
+	}
+	stats := TreeStats{
+		TotalNodes: 2*self.capacity() - 1,
+		Height:     self.treeHeight,
+		Capacity:   self.capacity(),
+		Occupancy:  float64(self.countOfNonEmptyLeaves-len(self.unsetLeaves)) / float64(self.capacity()),
+	}
+	for _, row := range self.fullNodes {
+		stats.StoredNodes += len(row)
+	}
+	stats.EmptyNodes = stats.TotalNodes - stats.StoredNodes
+	return stats
+}
+
+// EmptyHash returns a copy of the empty leaf hash the tree was created with
+func (self *SMT) EmptyHash() Hash {
+	if self.emptyHash == nil {
+		return nil
+	}
+	return append(Hash{}, self.emptyHash...)
+}
+
+// EmptySubtreeRoots returns the roots of empty subtrees for every height of
+// the tree, the empty leaf hash first and the root of an empty tree last.
+// With WithPaddingLeaf they are built from the padding leaf
+func (self *SMT) EmptySubtreeRoots() ([]Hash, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.fullNodes) == 0 {
+		return nil, errors.New("SMT tree is not filled")
+	}
+	err := self.computeEmptyLeavesSubTreeHash(self.treeHeight)
+	if err != nil {
+		return nil, err
+	}
+	return append([]Hash{}, self.emptyTreeRootHash[:self.treeHeight]...), nil
+}
+
+// IsEmptySubtreeRoot reports whether h is the root of an empty subtree of
+// the tree and returns the height of that subtree, 0 being the empty leaf.
+// This is also the index of the proof nodes h can stand for. It returns
+// false if the tree is not filled
+func (self *SMT) IsEmptySubtreeRoot(h Hash) (level int, ok bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(self.fullNodes) == 0 {
+		return 0, false
+	}
+	if err := self.computeEmptyLeavesSubTreeHash(self.treeHeight); err != nil {
+		return 0, false
+	}
+	for height, hash := range self.emptyTreeRootHash[:self.treeHeight] {
+		if bytes.Equal(hash, h) {
+			return height, true
+		}
+	}
+	return 0, false
+}
+
+// MemoryFootprint returns the approximate number of bytes used by the stored
+// nodes and the empty subtree cache, counting slice headers and hash bytes
+func (self *SMT) MemoryFootprint() int {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	size := sliceHeaderSize
+	for _, hashes := range self.fullNodes {
+		size += sliceHeaderSize
+		for _, hash := range hashes {
+			size += sliceHeaderSize + len(hash)
+		}
+	}
+	size += sliceHeaderSize
+	for _, hash := range self.emptyTreeRootHash {
+		size += sliceHeaderSize + len(hash)
+	}
+	return size
 }
 
-func NewSMT(emptyHash Hash, hashFunc hash.Hash) *SMT {
-	return &SMT{fullNodes: [][]Hash{}, emptyTreeRootHash: []Hash{emptyHash}, emptyHash: emptyHash, hashFunc: hashFunc}
+// EstimateMemory returns the approximate number of bytes MemoryFootprint will
+// report for a tree of totalSize leaves, all of them non empty
+func EstimateMemory(totalSize, hashSize int) int {
+	if totalSize <= 0 {
+		return 0
+	}
+	height := int(logBaseTwo(nextPowerOfTwo(uint64(totalSize)))) + 1
+	nodeCount := int(calculateNodeCount(uint64(height), uint64(totalSize)))
+	size := sliceHeaderSize + height*sliceHeaderSize + nodeCount*(sliceHeaderSize+hashSize)
+	// A full tree only caches the empty leaf hash itself
+	size += sliceHeaderSize + sliceHeaderSize + hashSize
+	return size
 }
 
-func (self *SMT) RootHash() []byte {
-	if len(self.fullNodes) == 0 {
-		return nil
+// ComputeRoot returns the root of the SMT holding leaves with the given
+// capacity, without keeping the tree: only the row being reduced and its
+// parents are alive at any time. It equals RootHash after Generate
+func ComputeRoot(leaves [][]byte, totalSize int, emptyHash Hash, hashFunc hash.Hash) ([]byte, error) {
+	if err := checkTotalSize(len(leaves), totalSize); err != nil {
+		return nil, err
 	}
-	if self.countOfNonEmptyLeaves == 0 {
-		return self.emptyTreeRootHash[len(self.emptyTreeRootHash)-1]
+	tree := NewSMT(emptyHash, hashFunc)
+	tree.treeHeight = int(logBaseTwo(uint64(totalSize)) + 1)
+	err := tree.computeEmptySubtreesFor(totalSize - len(leaves))
+	if err != nil {
+		return nil, err
 	}
-	return self.fullNodes[self.treeHeight-1][0]
+	return tree.reduceRoot(leaves)
 }
 
-func (self *SMT) Generate(leaves [][]byte, totalSize int) error {
-	if len(self.fullNodes) != 0 {
-		return errors.New("SMT tree already filled")
+// ComputeRoots returns the root of every batch of leaves as ComputeRoot would,
+// for trees of the same capacity. The empty subtree roots are computed once
+// and the batches are spread over GOMAXPROCS workers, each with its own hash
+// from factory
+func ComputeRoots(batches [][][]byte, totalSize int, emptyHash Hash, factory func() hash.Hash) ([][]byte, error) {
+	if err := checkTotalSize(0, totalSize); err != nil {
+		return nil, err
+	}
+	for _, leaves := range batches {
+		if err := checkTotalSize(len(leaves), totalSize); err != nil {
+			return nil, err
+		}
+	}
+	template := NewSMT(emptyHash, factory())
+	template.treeHeight = levelsFor(totalSize)
+	if err := template.computeEmptyLeavesSubTreeHash(template.treeHeight); err != nil {
+		return nil, err
+	}
+	chain := template.emptyTreeRootHash
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(batches) {
+		workers = len(batches)
+	}
+	roots := make([][]byte, len(batches))
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			tree := NewSMT(emptyHash, factory())
+			tree.treeHeight = template.treeHeight
+			// The chain is only read, every worker may share it
+			tree.emptyTreeRootHash = chain[:len(chain):len(chain)]
+			for i := worker * len(batches) / workers; i < (worker+1)*len(batches)/workers; i++ {
+				root, err := tree.reduceRoot(batches[i])
+				if err != nil {
+					errs[worker] = err
+					return
+				}
+				roots[i] = root
+			}
+		}(worker)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return roots, nil
+}
+
+// UniformRoot returns the root of a tree of totalSize leaves whose first
+// count leaves all equal value, computed from the structure alone with
+// O(log totalSize) hashes: every level holds perfect subtrees of value, at
+// most one partially filled node and empty subtrees. It is meant as an
+// independent oracle for Generate
+func UniformRoot(value Hash, count int, totalSize int, emptyHash Hash, hashFunc hash.Hash) ([]byte, error) {
+	if count < 0 {
+		return nil, errors.New("Leaf count must not be negative")
+	}
+	if err := checkTotalSize(count, totalSize); err != nil {
+		return nil, err
+	}
+	// Roots of a perfect subtree of value, of an empty subtree and of the
+	// partially filled node at the current height, nil if there is none
+	full, empty, partial := []byte(value), []byte(emptyHash), []byte(nil)
+	for height := uint(0); 1<<height < totalSize; height++ {
+		var err error
+		right := partial
+		if right == nil {
+			right = empty
+		}
+		if (count>>height)%2 == 1 {
+			partial, err = hashPair(hashFunc, full, right)
+		} else if partial != nil {
+			partial, err = hashPair(hashFunc, partial, empty)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if full, err = hashPair(hashFunc, full, full); err != nil {
+			return nil, err
+		}
+		if empty, err = hashPair(hashFunc, empty, empty); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case count == totalSize:
+		return full, nil
+	case partial != nil:
+		return partial, nil
+	}
+	return empty, nil
+}
+
+// Following are non public function
+
+// Reduces leaves one row at a time up to the root, keeping no level. The empty
+// subtree roots must already be computed
+func (self *SMT) reduceRoot(leaves [][]byte) ([]byte, error) {
+	row := make([]Hash, 0, len(leaves))
+	for _, leaf := range leaves {
+		row = append(row, leaf)
+	}
+	for height := 0; height < self.treeHeight-1; height++ {
+		var err error
+		row, err = self.parentRow(row, height)
+		if err != nil {
+			return nil, err
+		}
 	}
+	if len(row) == 0 {
+		return self.emptyTreeRootHash[self.treeHeight-1], nil
+	}
+	return row[0], nil
+}
+
+// Returns the number of levels, leaves included, of a tree of totalSize leaves
+func levelsFor(totalSize int) int {
+	return int(logBaseTwo(nextPowerOfTwo(uint64(totalSize))) + 1)
+}
+
+// Checks that a tree of totalSize leaves can be built holding count leaves
+func checkTotalSize(count int, totalSize int) error {
 	if !isPowerOfTwo(uint64(totalSize)) {
 		return errors.New("Leaves number of SMT tree should be power of 2")
 	}
-	count := len(leaves)
 	if count > totalSize {
 		return errors.New("NonEmptyLeaves is bigger than totalSize")
 	}
-	self.treeHeight = int(logBaseTwo(uint64(totalSize)) + 1)
-	self.countOfNonEmptyLeaves = len(leaves)
+	return nil
+}
 
-	noOfEmtpyLeaves := totalSize - len(leaves)
-	maxEmtySubTreeHeight := 0
-	for i := noOfEmtpyLeaves; i > 0; i = i >> 1 {
-		maxEmtySubTreeHeight++
+func (self *SMT) rootHash() []byte {
+	if len(self.fullNodes) == 0 {
+		return nil
 	}
-	err := self.computeEmptyLeavesSubTreeHash(maxEmtySubTreeHeight)
+	root, err := self.finalizeRoot(self.nodeHash(0, 0))
 	if err != nil {
-		return err
+		return nil
 	}
+	return root
+}
 
-	hashes := []Hash{}
-	for i := 0; i < count; i++ {
-		hashes = append(hashes, leaves[i])
+// Builds the tree from stored leaves whose gaps, holding the empty leaf, are
+// unset with WithIndexedLeaves, and records it as OpGenerateFunc
+func (self *SMT) buildWithGaps(hashes []Hash, totalSize int, gaps []uint) error {
+	if err := self.build(hashes, totalSize); err != nil {
+		return err
 	}
-	self.fullNodes = append(self.fullNodes, hashes)
+	if self.indexedLeaves {
+		for _, gap := range gaps {
+			self.markUnset(gap)
+		}
+	}
+	leaves := make([][]byte, 0, len(hashes))
+	for _, hash := range hashes {
+		leaves = append(leaves, hash)
+	}
+	self.record(Operation{Kind: OpGenerateFunc, Leaves: leaves, Size: totalSize, Gaps: gaps})
+	return nil
+}
 
-	err = self.computeAllLevelNodes(leaves)
+func (self *SMT) generate(leaves [][]byte, totalSize int) error {
+	if len(self.fullNodes) != 0 && !self.allowRebuild {
+		return errors.New("SMT tree already filled")
+	}
+	if err := checkTotalSize(len(leaves), totalSize); err != nil {
+		return err
+	}
+	if self.uniqueLeaves {
+		if err := checkUniqueLeaves(leaves); err != nil {
+			return err
+		}
+	}
+	hashes, err := self.leafHashes(0, leaves)
 	if err != nil {
 		return err
 	}
+	if err := self.build(hashes, totalSize); err != nil {
+		return err
+	}
+	self.record(Operation{Kind: OpGenerate, Leaves: leaves, Size: totalSize})
 	return nil
 }
 
-// Leaf mumber begins with 0
-func (self *SMT) GetMerkleProof(leafNo uint) ([]ProofNode, error) {
+// Builds the tree on top of the stored form of the leaves
+func (self *SMT) build(hashes []Hash, totalSize int) error {
+	if self.sortedLeaves && !isStrictlyIncreasing(hashes) {
+		return errors.New("Leaves are not strictly increasing")
+	}
+	// A rebuilt tree is only cleared once the new leaves are known to be valid
+	if len(self.fullNodes) != 0 {
+		self.reset()
+	}
+	self.treeHeight = levelsFor(totalSize)
+	self.countOfNonEmptyLeaves = len(hashes)
+
+	err := self.computeEmptySubtreesFor(totalSize - len(hashes))
+	if err != nil {
+		return err
+	}
+	self.fullNodes = append(self.fullNodes, hashes)
+	return self.computeAllLevelNodes()
+}
+
+func (self *SMT) getMerkleProof(leafNo uint) ([]ProofNode, error) {
 	if len(self.fullNodes) == 0 {
 		return nil, errors.New("SMT tree is not filled")
 	}
+	if leafNo >= uint(self.capacity()) {
+		return nil, errors.New("Leaf number is out of range")
+	}
+	return self.proofToLevel(leafNo, 0), nil
+}
 
+// Returns the siblings on the path from leaf leafNo up to, excluding, the
+// node at stopLevel
+func (self *SMT) proofToLevel(leafNo uint, stopLevel int) []ProofNode {
 	proofs := []ProofNode{}
 	level := int(self.treeHeight - 1)
 	index := leafNo
-	for i := level; i > 0; i-- {
+	for i := level; i > stopLevel; i-- {
 		proofNode := self.proofNodeAt(int(index), int(i))
 		proofs = append(proofs, proofNode)
 		index = index / 2
 	}
-	return proofs, nil
+	return proofs
 }
 
-// Following are non public function
+func (self *SMT) appendLeaves(leaves [][]byte) (uint, error) {
+	if len(self.fullNodes) == 0 {
+		return 0, errors.New("SMT tree is not filled")
+	}
+	if len(leaves) > self.capacity()-self.countOfNonEmptyLeaves {
+		return 0, errors.New("Leaves exceed remaining capacity")
+	}
+	appended, err := self.leafHashes(uint(self.countOfNonEmptyLeaves), leaves)
+	if err != nil {
+		return 0, err
+	}
+	start, err := self.appendHashes(appended)
+	if err != nil {
+		return 0, err
+	}
+	self.record(Operation{Kind: OpAppendLeaves, Leaves: leaves})
+	return start, nil
+}
+
+// Computes the empty subtree roots needed to fill noOfEmtpyLeaves right
+// packed empty leaves
+func (self *SMT) computeEmptySubtreesFor(noOfEmtpyLeaves int) error {
+	maxEmtySubTreeHeight := 0
+	for i := noOfEmtpyLeaves; i > 0; i = i >> 1 {
+		maxEmtySubTreeHeight++
+	}
+	return self.computeEmptyLeavesSubTreeHash(maxEmtySubTreeHeight)
+}
 
+// Extends the cached empty subtree roots to the first maxHeight heights. Only
+// the missing heights are hashed, so repeated calls reuse earlier work
 func (self *SMT) computeEmptyLeavesSubTreeHash(maxHeight int) error {
-	lastLevelHash := self.emptyHash
-	var err error
-	for i := 1; i < maxHeight; i++ {
-		lastLevelHash, err = self.parentHash(lastLevelHash, lastLevelHash)
+	for len(self.emptyTreeRootHash) < maxHeight {
+		lastLevelHash := self.emptyTreeRootHash[len(self.emptyTreeRootHash)-1]
+		hash, err := self.emptyParentHash(lastLevelHash)
 		if err != nil {
 			return err
 		}
-		self.emptyTreeRootHash = append(self.emptyTreeRootHash, lastLevelHash)
+		self.emptyTreeRootHash = append(self.emptyTreeRootHash, hash)
 	}
 	return nil
 }
 
-func (self *SMT) computeAllLevelNodes(leaves [][]byte) error {
+func (self *SMT) computeAllLevelNodes() error {
+	self.levelDurations = nil
 	for i := self.treeHeight; i > 1; i-- {
+		var start time.Time
+		if self.buildMetrics {
+			start = time.Now()
+		}
 		err := self.computeNodesAt(i - 1)
 		if err != nil {
 			return err
 		}
+		if self.buildMetrics {
+			self.levelDurations = append(self.levelDurations, time.Since(start))
+		}
 	}
 	return nil
 }
 
 func (self *SMT) computeNodesAt(level int) error {
-	lastLevelNodesHash := self.fullNodes[self.treeHeight-1-level]
+	hashes, err := self.parentRow(self.fullNodes[self.treeHeight-1-level], self.treeHeight-1-level)
+	if err != nil {
+		return err
+	}
+	self.fullNodes = append(self.fullNodes, hashes)
+	return nil
+}
+
+// Returns the stored parents of the stored row at the given height, pairing
+// the last node with the empty subtree root if the row has an odd length
+func (self *SMT) parentRow(lastLevelNodesHash []Hash, height int) ([]Hash, error) {
 	count := len(lastLevelNodesHash)
-	hashes := []Hash{}
+	hashes := make([]Hash, 0, (count+1)/2)
+	var slab []byte
+	if self.bufferPool != nil {
+		slab = make([]byte, 0, (count+1)/2*self.hashFunc.Size())
+	}
 	countRoundToEven := (count / 2) * 2
+	uniform := self.uniformLevels && isUniform(lastLevelNodesHash[:countRoundToEven])
 	for i := 0; i < countRoundToEven; i += 2 {
-		hash, err := self.parentHash(lastLevelNodesHash[i], lastLevelNodesHash[i+1])
+		if uniform && i > 0 {
+			// Equal pairs have equal parents. Every parent gets its own
+			// copy, erasing one must not touch the others
+			hashes = append(hashes, append(Hash{}, hashes[0]...))
+			continue
+		}
+		hash, err := self.pooledParentHash(&slab, lastLevelNodesHash[i], lastLevelNodesHash[i+1])
 		if err != nil {
-			return err
+			return nil, err
 		}
 		hashes = append(hashes, hash)
 	}
 	if count%2 != 0 {
-		siblingEmptyTreeHash := self.emptyTreeRootHash[self.treeHeight-1-level]
-		hash, err := self.parentHash(lastLevelNodesHash[count-1], siblingEmptyTreeHash)
+		siblingEmptyTreeHash := self.emptyTreeRootHash[height]
+		hash, err := self.pooledParentHash(&slab, lastLevelNodesHash[count-1], siblingEmptyTreeHash)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		hashes = append(hashes, hash)
 	}
-	self.fullNodes = append(self.fullNodes, hashes)
+	return hashes, nil
+}
+
+// Computes the parent hash in a pooled scratch buffer and copies it to the end
+// of slab, so a whole level shares one allocation. Without a pool, or with a
+// combiner or a salt, it falls back to parentHash
+func (self *SMT) pooledParentHash(slab *[]byte, item1 Hash, item2 Hash) ([]byte, error) {
+	if self.bufferPool == nil || self.combiner != nil || self.salt != nil {
+		return self.parentHash(item1, item2)
+	}
+	buf, _ := self.bufferPool.Get().(*[]byte)
+	if buf == nil {
+		buf = new([]byte)
+	}
+	defer self.bufferPool.Put(buf)
+
+	sum, err := hashPairTo(self.hashFunc, (*buf)[:0], item1, item2)
+	if err != nil {
+		return []byte{}, err
+	}
+	*buf = sum[:0]
+	start := len(*slab)
+	*slab = append(*slab, sum...)
+	return (*slab)[start:len(*slab):len(*slab)], nil
+}
+
+// Returns the stored form of leaves, the first of them at position first,
+// checking its size with WithUniformLeafSize
+func (self *SMT) leafHashes(first uint, leaves [][]byte) ([]Hash, error) {
+	hashes, err := self.storedLeaves(first, leaves)
+	if err != nil {
+		return nil, err
+	}
+	if self.uniformLeafSize {
+		for _, hash := range hashes {
+			if len(hash) != self.hashFunc.Size() {
+				return nil, errors.New("Leaf size does not match the hash size")
+			}
+		}
+	}
+	return hashes, nil
+}
+
+// Hashes leaves with the leaf hash when one is configured
+func (self *SMT) storedLeaves(first uint, leaves [][]byte) ([]Hash, error) {
+	hashes := make([]Hash, 0, len(leaves))
+	if self.leafHashFactory == nil && self.leafIndexBound {
+		self.hashMu.Lock()
+		defer self.hashMu.Unlock()
+		for i, leaf := range leaves {
+			hash, err := hashBoundLeaf(self.hashFunc, first+uint(i), leaf)
+			if err != nil {
+				return nil, err
+			}
+			hashes = append(hashes, hash)
+		}
+		return hashes, nil
+	}
+	if self.leafHashFactory == nil {
+		for _, leaf := range leaves {
+			if self.secureErase {
+				// Erasing must never touch the caller's own slices
+				leaf = append([]byte{}, leaf...)
+			}
+			hashes = append(hashes, leaf)
+		}
+		return hashes, nil
+	}
+	if self.leafHashWorkers > 1 && len(leaves) > 1 {
+		return self.parallelLeafHashes(first, leaves)
+	}
+	leafHash := self.leafHashFactory()
+	for i, leaf := range leaves {
+		hash, err := self.hashStoredLeaf(leafHash, first+uint(i), leaf)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// Hashes leaves with the leaf hash on up to leafHashWorkers goroutines, each
+// with its own hash and a contiguous share of the leaves
+func (self *SMT) parallelLeafHashes(first uint, leaves [][]byte) ([]Hash, error) {
+	workers := self.leafHashWorkers
+	if workers > len(leaves) {
+		workers = len(leaves)
+	}
+	hashes := make([]Hash, len(leaves))
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			leafHash := self.leafHashFactory()
+			for i := worker * len(leaves) / workers; i < (worker+1)*len(leaves)/workers; i++ {
+				hash, err := self.hashStoredLeaf(leafHash, first+uint(i), leaves[i])
+				if err != nil {
+					errs[worker] = err
+					return
+				}
+				hashes[i] = hash
+			}
+		}(worker)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// Hashes the leaf at leafNo with leafHash, binding leafNo with
+// WithLeafIndexBinding
+func (self *SMT) hashStoredLeaf(leafHash hash.Hash, leafNo uint, leaf []byte) ([]byte, error) {
+	if self.leafIndexBound {
+		return hashBoundLeaf(leafHash, leafNo, leaf)
+	}
+	return hashLeaf(leafHash, leaf)
+}
+
+// Returns a *DuplicateLeafError for the first leaf equal to an earlier one
+func checkUniqueLeaves(leaves [][]byte) error {
+	seen := make(map[string]int, len(leaves))
+	for i, leaf := range leaves {
+		if first, ok := seen[string(leaf)]; ok {
+			return &DuplicateLeafError{First: first, Second: i}
+		}
+		seen[string(leaf)] = i
+	}
 	return nil
 }
 
-func (self *SMT) proofNodeAt(index int, level int) ProofNode {
+// Returns true if every hash is bytewise bigger than the previous one
+func isStrictlyIncreasing(hashes []Hash) bool {
+	for i := 1; i < len(hashes); i++ {
+		if bytes.Compare(hashes[i-1], hashes[i]) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if all hashes are equal
+func isUniform(hashes []Hash) bool {
+	for i := 1; i < len(hashes); i++ {
+		if !bytes.Equal(hashes[0], hashes[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Appends already hashed leaves after the last non empty leaf and returns the
+// index of the first one. The tree is left untouched on error
+func (self *SMT) appendHashes(appended []Hash) (uint, error) {
+	start := self.countOfNonEmptyLeaves
+	if len(appended) > self.capacity()-start {
+		return 0, errors.New("Leaves exceed remaining capacity")
+	}
+	hashes := append(self.fullNodes[0][:start:start], appended...)
+	// The first appended leaf must also follow the last existing one
+	from := start
+	if from > 0 {
+		from--
+	}
+	if self.sortedLeaves && !isStrictlyIncreasing(hashes[from:]) {
+		return 0, errors.New("Leaves are not strictly increasing")
+	}
+	rows, err := self.rebuildFrom(start, hashes)
+	if err != nil {
+		return 0, err
+	}
+	self.fullNodes = rows
+	self.countOfNonEmptyLeaves = len(hashes)
+	return uint(start), nil
+}
+
+// Returns the leaves appended to write leafHash at leafNo, at or beyond the
+// non empty leaves: a copy of the empty leaf for every position in between,
+// then leafHash
+func (self *SMT) gapLeaves(leafNo uint, leafHash Hash) []Hash {
+	appended := []Hash{}
+	for i := uint(self.countOfNonEmptyLeaves); i < leafNo; i++ {
+		// Every unset leaf gets its own copy, erasing it must not touch the
+		// empty hash
+		appended = append(appended, append(Hash{}, self.emptyHash...))
+	}
+	return append(appended, leafHash)
+}
+
+// Replaces the stored leaf leafNo, which must lie within the non empty
+// leaves, and recomputes the nodes on its path
+func (self *SMT) setLeafHash(leafNo uint, leafHash Hash) error {
+	if self.sortedLeaves {
+		leaves := self.fullNodes[0]
+		if leafNo > 0 && bytes.Compare(leaves[leafNo-1], leafHash) >= 0 {
+			return errors.New("Leaves are not strictly increasing")
+		}
+		if int(leafNo)+1 < len(leaves) && bytes.Compare(leafHash, leaves[leafNo+1]) >= 0 {
+			return errors.New("Leaves are not strictly increasing")
+		}
+	}
+	path, err := self.pathHashes(int(leafNo), leafHash)
+	if err != nil {
+		return err
+	}
+	for level, hash := range path {
+		index := int(leafNo) >> uint(level)
+		self.erase(self.fullNodes[level][index])
+		self.fullNodes[level][index] = hash
+	}
+	delete(self.unsetLeaves, leafNo)
+	return nil
+}
+
+// Clears the nodes and the leaf counts
+func (self *SMT) reset() {
+	for _, hashes := range self.fullNodes {
+		for _, hash := range hashes {
+			self.erase(hash)
+		}
+	}
+	// The empty subtree roots do not depend on the leaves and are kept
+	self.fullNodes = [][]Hash{}
+	self.levelDurations = nil
+	self.treeHeight = 0
+	self.countOfNonEmptyLeaves = 0
+	self.unsetLeaves = nil
+}
+
+// Keeps the first newLeafCount stored leaves, less the unset positions they
+// end with, and recomputes the nodes right of them
+func (self *SMT) truncate(newLeafCount int) error {
+	for newLeafCount > 0 {
+		if _, ok := self.unsetLeaves[uint(newLeafCount-1)]; !ok {
+			break
+		}
+		newLeafCount--
+	}
+	err := self.computeEmptySubtreesFor(self.capacity() - newLeafCount)
+	if err != nil {
+		return err
+	}
+	rows, err := self.rebuildFrom(newLeafCount, self.fullNodes[0][:newLeafCount:newLeafCount])
+	if err != nil {
+		return err
+	}
+	for level, hashes := range self.fullNodes {
+		for _, hash := range hashes[newLeafCount>>uint(level):] {
+			self.erase(hash)
+		}
+	}
+	self.fullNodes = rows
+	self.countOfNonEmptyLeaves = newLeafCount
+	for leafNo := range self.unsetLeaves {
+		if leafNo >= uint(newLeafCount) {
+			delete(self.unsetLeaves, leafNo)
+		}
+	}
+	return nil
+}
+
+// Records that a stored leaf is an empty placeholder
+func (self *SMT) markUnset(leafNo uint) {
+	if self.unsetLeaves == nil {
+		self.unsetLeaves = map[uint]struct{}{}
+	}
+	self.unsetLeaves[leafNo] = struct{}{}
+}
+
+// Returns the hashes on the path from leaf index up to the root, leaf first,
+// as they would be if the leaf held leafHash. The tree is not modified
+func (self *SMT) pathHashes(index int, leafHash Hash) ([]Hash, error) {
+	path := []Hash{leafHash}
+	current := leafHash
+	for level := self.treeHeight - 1; level > 0; level-- {
+		sibling := self.proofNodeAt(index, level)
+		var err error
+		if sibling.Left {
+			current, err = self.parentHash(sibling.Hash, current)
+		} else {
+			current, err = self.parentHash(current, sibling.Hash)
+		}
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, current)
+		index = index / 2
+	}
+	return path, nil
+}
+
+// Overwrites a discarded hash with zeros when secure erase is enabled
+func (self *SMT) erase(hash Hash) {
+	if !self.secureErase {
+		return
+	}
+	for i := range hash {
+		hash[i] = 0
+	}
+}
+
+// Returns new levels built on top of leaves, reusing the stored nodes left of
+// the path of leaf index and recomputing everything right of it. The stored
+// levels are not modified
+func (self *SMT) rebuildFrom(index int, leaves []Hash) ([][]Hash, error) {
+	rows := make([][]Hash, self.treeHeight)
+	rows[0] = leaves
+	for level := 1; level < self.treeHeight; level++ {
+		index = index / 2
+		below := rows[level-1]
+		hashes := self.fullNodes[level][:index:index]
+		for i := 2 * index; i < len(below); i += 2 {
+			var sibling Hash
+			if i+1 < len(below) {
+				sibling = below[i+1]
+			} else {
+				sibling = self.emptyTreeRootHash[level-1]
+			}
+			hash, err := self.parentHash(below[i], sibling)
+			if err != nil {
+				return nil, err
+			}
+			hashes = append(hashes, hash)
+		}
+		rows[level] = hashes
+	}
+	return rows, nil
+}
+
+// Applies the configured root binding to the top node of the tree
+func (self *SMT) finalizeRoot(top []byte) ([]byte, error) {
+	if !self.capacityInRoot && self.rootTag == nil {
+		return top, nil
+	}
+	self.hashMu.Lock()
+	defer self.hashMu.Unlock()
+	if self.capacityInRoot {
+		var err error
+		top, err = bindCapacity(self.hashFunc, top, self.capacity())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if self.rootTag != nil {
+		return hashPair(self.hashFunc, self.rootTag, top)
+	}
+	return top, nil
+}
+
+// Returns the span of leaves [start, end) below the node at (level, index)
+func (self *SMT) nodeLeafRange(level, index int) (start, end uint, err error) {
+	if len(self.fullNodes) == 0 {
+		return 0, 0, errors.New("SMT tree is not filled")
+	}
+	if err := self.checkCoordinate(level, index); err != nil {
+		return 0, 0, err
+	}
+	span := uint(1) << uint(self.treeHeight-1-level)
+	start = uint(index) * span
+	return start, start + span, nil
+}
+
+// Checks that (level, index) is a node of the tree
+func (self *SMT) checkCoordinate(level, index int) error {
+	if level < 0 || level >= self.treeHeight {
+		return errors.New("Level is out of range")
+	}
+	if index < 0 || index >= 1<<uint(level) {
+		return errors.New("Index is out of range")
+	}
+	return nil
+}
+
+// Returns the number of leaves the tree can hold
+func (self *SMT) capacity() int {
+	return 1 << uint(self.treeHeight-1)
+}
 
-	hashes := self.fullNodes[int(self.treeHeight)-1-level]
-	var hash Hash
+func (self *SMT) proofNodeAt(index int, level int) ProofNode {
 	left := false
 	if index%2 == 1 {
 		left = true
 	}
 	if left {
-		hash = hashes[index-1]
-	} else {
-		if len(hashes)-1 < index+1 {
-			hash = self.emptyTreeRootHash[int(self.treeHeight)-1-level]
-		} else {
-			hash = hashes[index+1]
-		}
+		return ProofNode{Hash: self.nodeHash(level, index-1), Left: left}
 	}
-	return ProofNode{Hash: hash, Left: left}
+	return ProofNode{Hash: self.nodeHash(level, index+1), Left: left}
 }
 
-func (self *SMT) parentHash(item1 Hash, item2 Hash) ([]byte, error) {
-	hash := self.hashFunc
-	defer hash.Reset()
+// Returns the hash of the node at (level, index), where level 0 is the root.
+// Nodes right of the stored ones are roots of fully empty subtrees
+func (self *SMT) nodeHash(level int, index int) Hash {
+	hashes := self.fullNodes[self.treeHeight-1-level]
+	if index < len(hashes) {
+		return hashes[index]
+	}
+	return self.emptyTreeRootHash[self.treeHeight-1-level]
+}
 
-	_, err := hash.Write(item1)
-	if err != nil {
-		return []byte{}, err
+// Returns the root of an empty subtree whose children are both child
+func (self *SMT) emptyParentHash(child Hash) ([]byte, error) {
+	if self.emptyNodeSeed == nil {
+		return self.parentHash(child, child)
 	}
-	_, err = hash.Write(item2)
-	if err != nil {
-		return []byte{}, err
+	return self.parentHash(append(append([]byte{}, self.emptyNodeSeed...), child...), child)
+}
+
+func (self *SMT) parentHash(item1 Hash, item2 Hash) ([]byte, error) {
+	self.hashMu.Lock()
+	defer self.hashMu.Unlock()
+	if self.combiner != nil {
+		return self.combiner(item1, item2)
+	}
+	if self.salt != nil {
+		return saltedHashPair(self.hashFunc, self.salt, item1, item2)
 	}
-	return hash.Sum(nil), nil
+	return hashPair(self.hashFunc, item1, item2)
 }
@@ -1,10 +1,18 @@
 package merkle
 
 import (
+	"bytes"
 	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"errors"
 	"github.com/stretchr/testify/assert"
 	"hash"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
 	"testing"
 )
 
@@ -127,6 +135,67 @@ func TestSMTAlreadyFilled(t *testing.T) {
 	assert.Equal(t, err.Error(), "SMT tree already filled")
 }
 
+func TestGenerateFromChannel(t *testing.T) {
+	for _, count := range []int{0, 1, 5, 16} {
+		ch := make(chan []byte)
+		go func() {
+			for _, leaf := range testHashes[:count] {
+				ch <- leaf
+			}
+			close(ch)
+		}()
+		tree := NewSMT(emptyHash, hashFunc)
+		err := tree.GenerateFromChannel(ch, 16)
+		assert.Nil(t, err)
+
+		expected := NewSMT(emptyHash, hashFunc)
+		err = expected.Generate(testHashes[:count], 16)
+		assert.Nil(t, err)
+		assert.Equal(t, expected.RootHash(), tree.RootHash())
+	}
+
+	ch := make(chan []byte, 16)
+	for _, leaf := range testHashes[:9] {
+		ch <- leaf
+	}
+	close(ch)
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.GenerateFromChannel(ch, 8)
+	assert.Equal(t, "NonEmptyLeaves is bigger than totalSize", err.Error())
+	assert.Nil(t, tree.RootHash())
+	err = tree.GenerateFromChannel(ch, 7)
+	assert.Equal(t, "Leaves number of SMT tree should be power of 2", err.Error())
+}
+
+func TestAllowRebuild(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc, WithAllowRebuild(), WithIndexedLeaves())
+	err := tree.Generate(testHashes, 32)
+	assert.Nil(t, err)
+	err = tree.SetLeaf(20, testHashes[0])
+	assert.Nil(t, err)
+	err = tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+
+	expected := NewSMT(emptyHash, hashFunc)
+	err = expected.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.fullNodes, tree.fullNodes)
+	assert.Equal(t, expected.RootHash(), tree.RootHash())
+	assert.Equal(t, 3, tree.RemainingCapacity())
+
+	//an invalid rebuild leaves the tree alone
+	err = tree.Generate(testHashes, 8)
+	assert.NotNil(t, err)
+	assert.Equal(t, expected.RootHash(), tree.RootHash())
+
+	lowMemory := NewLowMemorySMT(emptyHash, hashFunc, WithAllowRebuild())
+	err = lowMemory.Generate(testHashes, 32)
+	assert.Nil(t, err)
+	err = lowMemory.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.RootHash(), lowMemory.RootHash())
+}
+
 func TestHashError(t *testing.T) {
 	hash := md5.New()
 	items := testHashes
@@ -358,3 +427,1913 @@ func TestGetMerkleProofs2(t *testing.T) {
 
 	assert.Equal(t, expectedProof, proof)
 }
+
+func TestMemoryFootprint(t *testing.T) {
+	for _, size := range []int{1, 2, 16, 1024} {
+		leaves := make([][]byte, size)
+		for i := range leaves {
+			leaves[i] = hashValue([]byte{byte(i), byte(i >> 8)}, hashFunc)
+		}
+		tree := NewSMT(emptyHash, hashFunc)
+		err := tree.Generate(leaves, size)
+		assert.Nil(t, err)
+
+		estimate := EstimateMemory(size, hashFunc.Size())
+		assert.Equal(t, estimate, tree.MemoryFootprint())
+
+		// Compare with the real allocation, including the copied leaves but
+		// not the tree struct itself, which MemoryFootprint does not count
+		tree = NewSMT(emptyHash, hashFunc)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		copied := make([][]byte, size)
+		for i := range leaves {
+			copied[i] = append([]byte{}, leaves[i]...)
+		}
+		err = tree.Generate(copied, size)
+		runtime.ReadMemStats(&after)
+		assert.Nil(t, err)
+		allocated := int(after.TotalAlloc - before.TotalAlloc)
+		//growing the levels with append may over allocate
+		assert.True(t, allocated > estimate/2 && allocated < estimate*3, "estimate %d, allocated %d", estimate, allocated)
+	}
+}
+
+func TestMemoryFootprintSparse(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:3], 16)
+	assert.Nil(t, err)
+
+	//8 stored hashes and 4 cached empty subtree roots
+	expected := sliceHeaderSize + 5*sliceHeaderSize + 8*(sliceHeaderSize+16) + sliceHeaderSize + 4*(sliceHeaderSize+16)
+	assert.Equal(t, expected, tree.MemoryFootprint())
+	assert.True(t, tree.MemoryFootprint() < EstimateMemory(16, 16))
+	assert.Equal(t, 0, EstimateMemory(0, 16))
+}
+
+func newBufferPool() *sync.Pool {
+	return &sync.Pool{New: func() interface{} {
+		buf := make([]byte, 0, 64)
+		return &buf
+	}}
+}
+
+func TestBufferPool(t *testing.T) {
+	pool := newBufferPool()
+	for _, count := range []int{0, 1, 3, 9, 16} {
+		expected := NewSMT(emptyHash, hashFunc)
+		err := expected.Generate(testHashes[:count], 16)
+		assert.Nil(t, err)
+
+		tree := NewSMT(emptyHash, hashFunc, WithBufferPool(pool))
+		err = tree.Generate(testHashes[:count], 16)
+		assert.Nil(t, err)
+		assert.Equal(t, expected.RootHash(), tree.RootHash())
+		assert.Equal(t, expected.fullNodes, tree.fullNodes)
+
+		for i := uint(0); i < 16; i++ {
+			expectedProof, _ := expected.GetMerkleProof(i)
+			proof, _ := tree.GetMerkleProof(i)
+			assert.Equal(t, expectedProof, proof)
+		}
+	}
+
+	//a pool without New still works
+	tree := NewSMT(emptyHash, hashFunc, WithBufferPool(&sync.Pool{}))
+	err := tree.Generate(testHashes, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0xac, 0xef, 0x51, 0x94, 0xbc, 0xa5, 0x1e, 0xe8, 0x6a, 0x1a, 0x2a, 0x5, 0xfd, 0x73, 0xa2, 0x3b}, tree.RootHash())
+}
+
+func benchmarkSMTGenerate(b *testing.B, opts ...Option) {
+	leaves := make([][]byte, 1<<14)
+	for i := range leaves {
+		leaves[i] = hashValue([]byte{byte(i), byte(i >> 8)}, hashFunc)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree := NewSMT(emptyHash, md5.New(), opts...)
+		if err := tree.Generate(leaves, len(leaves)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSMTGenerate_16K(b *testing.B) {
+	benchmarkSMTGenerate(b)
+}
+
+func BenchmarkSMTGenerate_16K_BufferPool(b *testing.B) {
+	benchmarkSMTGenerate(b, WithBufferPool(newBufferPool()))
+}
+
+func BenchmarkSMTGenerate_16K_ExpectedLeaves(b *testing.B) {
+	benchmarkSMTGenerate(b, WithExpectedLeaves(1<<14))
+}
+
+func benchmarkUniformGenerate(b *testing.B, opts ...Option) {
+	leaves := make([][]byte, 1<<14)
+	for i := range leaves {
+		leaves[i] = testHashes[0]
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree := NewSMT(emptyHash, md5.New(), opts...)
+		if err := tree.Generate(leaves, len(leaves)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSMTGenerate_16K_Uniform(b *testing.B) {
+	benchmarkUniformGenerate(b)
+}
+
+func BenchmarkSMTGenerate_16K_UniformLevels(b *testing.B) {
+	benchmarkUniformGenerate(b, WithUniformLevels())
+}
+
+func BenchmarkSMTGenerate_16K_LeafHash(b *testing.B) {
+	benchmarkSMTGenerate(b, WithLeafHash(sha256.New))
+}
+
+func BenchmarkSMTGenerate_16K_LeafHashWorkers(b *testing.B) {
+	benchmarkSMTGenerate(b, WithLeafHash(sha256.New), WithLeafHashWorkers(runtime.NumCPU()))
+}
+
+func TestEmptySubtreesNotStored(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:2], 1<<16)
+	assert.Nil(t, err)
+
+	//one stored node per level above the leaves, plus the two leaves
+	assert.Equal(t, 2+16, totalHashes(tree.fullNodes))
+	assert.Equal(t, 16, len(tree.emptyTreeRootHash))
+	assert.True(t, tree.MemoryFootprint() < 4096)
+
+	for _, i := range []uint{0, 1, 2, 3, 1 << 15, 1<<16 - 1} {
+		leaf := emptyHash
+		if i < 2 {
+			leaf = testHashes[i]
+		}
+		proof, err := tree.GetMerkleProof(i)
+		assert.Nil(t, err)
+		assert.Equal(t, 16, len(proof))
+		assert.Nil(t, VerifyProof(leaf, i, proof, tree.RootHash(), hashFunc))
+	}
+}
+
+func TestAppendLeaves(t *testing.T) {
+	batched := NewSMT(emptyHash, hashFunc)
+	err := batched.Generate(testHashes[:3], 16)
+	assert.Nil(t, err)
+	start, err := batched.AppendLeaves(testHashes[3:9])
+	assert.Nil(t, err)
+	assert.Equal(t, uint(3), start)
+
+	single := NewSMT(emptyHash, hashFunc)
+	err = single.Generate(testHashes[:3], 16)
+	assert.Nil(t, err)
+	for i := 3; i < 9; i++ {
+		index, err := single.AppendLeaf(testHashes[i])
+		assert.Nil(t, err)
+		assert.Equal(t, uint(i), index)
+	}
+	assert.Equal(t, batched.RootHash(), single.RootHash())
+	assert.Equal(t, batched.fullNodes, single.fullNodes)
+
+	expected := NewSMT(emptyHash, hashFunc)
+	err = expected.Generate(testHashes[:9], 16)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.RootHash(), batched.RootHash())
+	assert.Equal(t, expected.fullNodes, batched.fullNodes)
+
+	//append to an empty tree until it is full
+	tree := NewSMT(emptyHash, hashFunc)
+	err = tree.Generate(nil, 16)
+	assert.Nil(t, err)
+	_, err = tree.AppendLeaves(testHashes[:7])
+	assert.Nil(t, err)
+	_, err = tree.AppendLeaves(testHashes[7:])
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0xac, 0xef, 0x51, 0x94, 0xbc, 0xa5, 0x1e, 0xe8, 0x6a, 0x1a, 0x2a, 0x5, 0xfd, 0x73, 0xa2, 0x3b}, tree.RootHash())
+}
+
+func TestAppendLeavesExceedCapacity(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	_, err := tree.AppendLeaves(testHashes[:1])
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+
+	err = tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	root := tree.RootHash()
+	nodes := totalHashes(tree.fullNodes)
+
+	_, err = tree.AppendLeaves(testHashes[5:9])
+	assert.Equal(t, "Leaves exceed remaining capacity", err.Error())
+	assert.Equal(t, root, tree.RootHash())
+	assert.Equal(t, nodes, totalHashes(tree.fullNodes))
+	assert.Equal(t, 5, tree.countOfNonEmptyLeaves)
+}
+
+// Produces one byte more than its Size() announces
+type WrongSizeHash struct {
+	hash.Hash
+}
+
+func (decor WrongSizeHash) Sum(b []byte) []byte {
+	return append(decor.Hash.Sum(b), 0)
+}
+
+func TestWrongHashOutputSize(t *testing.T) {
+	tree := NewSMT(emptyHash, WrongSizeHash{md5.New()})
+	err := tree.Generate(testHashes[:3], 8)
+	assert.Equal(t, "Hash output size does not match hash size", err.Error())
+
+	tree = NewSMT(emptyHash, WrongSizeHash{md5.New()})
+	err = tree.Generate(nil, 8)
+	assert.Equal(t, "Hash output size does not match hash size", err.Error())
+
+	tree = NewSMT(emptyHash, md5.New(), WithLeafHash(func() hash.Hash { return WrongSizeHash{md5.New()} }))
+	err = tree.Generate(testHashes[:3], 8)
+	assert.Equal(t, "Hash output size does not match hash size", err.Error())
+}
+
+func TestUpdateLeaf(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	err = tree.UpdateLeaf(2, testHashes[10])
+	assert.Nil(t, err)
+
+	leaves := append([][]byte{}, testHashes[:5]...)
+	leaves[2] = testHashes[10]
+	expected := NewSMT(emptyHash, hashFunc)
+	err = expected.Generate(leaves, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.RootHash(), tree.RootHash())
+	assert.Equal(t, expected.fullNodes, tree.fullNodes)
+
+	err = tree.UpdateLeaf(5, testHashes[10])
+	assert.Equal(t, "Leaf number is beyond the non empty leaves", err.Error())
+}
+
+func TestReset(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	tree.Reset()
+	assert.Nil(t, tree.RootHash())
+	err = tree.Generate(testHashes[:9], 16)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{152, 2, 216, 141, 25, 184, 18, 213, 247, 132, 128, 128, 213, 9, 64, 121}, tree.RootHash())
+}
+
+func TestSecureErase(t *testing.T) {
+	leaves := [][]byte{}
+	for _, leaf := range testHashes[:5] {
+		leaves = append(leaves, append([]byte{}, leaf...))
+	}
+	tree := NewSMT(emptyHash, hashFunc, WithSecureErase())
+	err := tree.Generate(leaves, 8)
+	assert.Nil(t, err)
+
+	stored := []Hash{}
+	for _, hashes := range tree.fullNodes {
+		stored = append(stored, hashes...)
+	}
+	oldLeaf := tree.fullNodes[0][1]
+	oldRoot := tree.fullNodes[3][0]
+	err = tree.UpdateLeaf(1, testHashes[10])
+	assert.Nil(t, err)
+	assert.Equal(t, make([]byte, 16), []byte(oldLeaf))
+	assert.Equal(t, make([]byte, 16), []byte(oldRoot))
+
+	tree.Reset()
+	for _, hash := range stored {
+		assert.Equal(t, make([]byte, len(hash)), []byte(hash))
+	}
+	//the caller's leaves are left intact
+	assert.Equal(t, testHashes[:5], leaves)
+
+	//without the option nothing is overwritten
+	tree = NewSMT(emptyHash, hashFunc)
+	err = tree.Generate(leaves, 8)
+	assert.Nil(t, err)
+	root := tree.RootHash()
+	tree.Reset()
+	assert.NotEqual(t, make([]byte, 16), root)
+}
+
+func TestGenerateWithMinCapacity(t *testing.T) {
+	cases := []struct {
+		leaves      int
+		minCapacity int
+		capacity    int
+	}{
+		{0, 0, 1},
+		{0, 1, 1},
+		{1, 0, 1},
+		{3, 0, 4},
+		{3, 4, 4},
+		{3, 5, 8},
+		{9, 2, 16},
+		{16, 16, 16},
+		{5, 100, 128},
+	}
+	for _, c := range cases {
+		tree := NewSMT(emptyHash, hashFunc)
+		assert.Equal(t, 0, tree.Capacity())
+		err := tree.GenerateWithMinCapacity(testHashes[:c.leaves], c.minCapacity)
+		assert.Nil(t, err)
+		assert.Equal(t, c.capacity, tree.Capacity())
+
+		expected := NewSMT(emptyHash, hashFunc)
+		err = expected.Generate(testHashes[:c.leaves], c.capacity)
+		assert.Nil(t, err)
+		assert.Equal(t, expected.RootHash(), tree.RootHash())
+	}
+}
+
+func TestOperationLog(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc, WithOperationLog())
+	err := tree.Generate(testHashes[:3], 16)
+	assert.Nil(t, err)
+	_, err = tree.AppendLeaves(testHashes[3:6])
+	assert.Nil(t, err)
+	err = tree.UpdateLeaf(1, testHashes[12])
+	assert.Nil(t, err)
+	_, err = tree.AppendLeaf(testHashes[6])
+	assert.Nil(t, err)
+	//failed mutations are not recorded
+	err = tree.UpdateLeaf(10, testHashes[12])
+	assert.NotNil(t, err)
+
+	ops := tree.OperationLog()
+	assert.Equal(t, 4, len(ops))
+	assert.Equal(t, Operation{Kind: OpUpdateLeaf, Index: 1, Leaves: [][]byte{testHashes[12]}}, ops[2])
+
+	replayed, err := ReplayLog(ops, emptyHash, hashFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, tree.RootHash(), replayed.RootHash())
+	assert.Equal(t, tree.fullNodes, replayed.fullNodes)
+
+	tree.Reset()
+	err = tree.Generate(testHashes[:2], 4)
+	assert.Nil(t, err)
+	replayed, err = ReplayLog(tree.OperationLog(), emptyHash, hashFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, tree.RootHash(), replayed.RootHash())
+
+	_, err = ReplayLog([]Operation{{Kind: OpUpdateLeaf}}, emptyHash, hashFunc)
+	assert.Equal(t, "Update operation must hold exactly one leaf", err.Error())
+
+	//nothing is recorded without the option
+	tree = NewSMT(emptyHash, hashFunc)
+	err = tree.Generate(testHashes[:3], 16)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(tree.OperationLog()))
+}
+
+func sortedTestHashes() [][]byte {
+	sorted := append([][]byte{}, testHashes...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	return sorted
+}
+
+func TestSortedLeaves(t *testing.T) {
+	sorted := sortedTestHashes()
+	tree := NewSMT(emptyHash, hashFunc, WithSortedLeaves())
+	err := tree.Generate(sorted[:10], 16)
+	assert.Nil(t, err)
+
+	unsorted := append([][]byte{}, sorted[:10]...)
+	unsorted[3], unsorted[4] = unsorted[4], unsorted[3]
+	tree = NewSMT(emptyHash, hashFunc, WithSortedLeaves())
+	err = tree.Generate(unsorted, 16)
+	assert.Equal(t, "Leaves are not strictly increasing", err.Error())
+	assert.Nil(t, tree.RootHash())
+
+	duplicated := append([][]byte{}, sorted[:10]...)
+	duplicated[4] = duplicated[3]
+	tree = NewSMT(emptyHash, hashFunc, WithSortedLeaves())
+	err = tree.Generate(duplicated, 16)
+	assert.Equal(t, "Leaves are not strictly increasing", err.Error())
+
+	//unsorted input is fine without the option
+	tree = NewSMT(emptyHash, hashFunc)
+	err = tree.Generate(unsorted, 16)
+	assert.Nil(t, err)
+}
+
+func TestSortedLeavesMutations(t *testing.T) {
+	sorted := sortedTestHashes()
+	tree := NewSMT(emptyHash, hashFunc, WithSortedLeaves())
+	err := tree.Generate([][]byte{sorted[1], sorted[3], sorted[5]}, 8)
+	assert.Nil(t, err)
+
+	_, err = tree.AppendLeaf(sorted[4])
+	assert.Equal(t, "Leaves are not strictly increasing", err.Error())
+	_, err = tree.AppendLeaves([][]byte{sorted[7], sorted[6]})
+	assert.Equal(t, "Leaves are not strictly increasing", err.Error())
+	_, err = tree.AppendLeaves([][]byte{sorted[6], sorted[7]})
+	assert.Nil(t, err)
+
+	err = tree.UpdateLeaf(1, sorted[2])
+	assert.Nil(t, err)
+	err = tree.UpdateLeaf(0, sorted[0])
+	assert.Nil(t, err)
+	err = tree.UpdateLeaf(4, sorted[8])
+	assert.Nil(t, err)
+	err = tree.UpdateLeaf(1, sorted[5])
+	assert.Equal(t, "Leaves are not strictly increasing", err.Error())
+	err = tree.UpdateLeaf(0, sorted[2])
+	assert.Equal(t, "Leaves are not strictly increasing", err.Error())
+}
+
+func TestEmptySubtreeRoots(t *testing.T) {
+	hashCount := 0
+	tree := NewSMT(emptyHash, NewHashCountDecorator(md5.New(), &hashCount))
+	err := tree.Generate(testHashes, 1<<62)
+	assert.Nil(t, err)
+
+	//Generate needs empty subtrees up to height 61, only the empty tree root is missing
+	hashCount = 0
+	roots, err := tree.EmptySubtreeRoots()
+	assert.Nil(t, err)
+	assert.Equal(t, 63, len(roots))
+	assert.Equal(t, 1, hashCount)
+	_, err = tree.EmptySubtreeRoots()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, hashCount)
+	assert.Equal(t, emptyHash, []byte(roots[0]))
+	for i := 1; i < len(roots); i++ {
+		assert.Equal(t, hash2Value(roots[i-1], roots[i-1], md5.New()), []byte(roots[i]))
+	}
+
+	//a full tree only caches the empty leaf until the chain is requested
+	tree = NewSMT(emptyHash, NewHashCountDecorator(md5.New(), &hashCount))
+	err = tree.Generate(testHashes, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(tree.emptyTreeRootHash))
+	hashCount = 0
+	roots, err = tree.EmptySubtreeRoots()
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(roots))
+	assert.Equal(t, 4, hashCount)
+
+	//the chain survives a reset and is not computed again
+	tree.Reset()
+	hashCount = 0
+	err = tree.Generate(nil, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, hashCount)
+	assert.Equal(t, roots[4], Hash(tree.RootHash()))
+
+	_, err = NewSMT(emptyHash, hashFunc).EmptySubtreeRoots()
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+}
+
+func TestEmptyRootAfterLongerChain(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(nil, 16)
+	assert.Nil(t, err)
+	tree.Reset()
+	err = tree.Generate(nil, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, hash2Value(hash2Value(emptyHash, emptyHash, hashFunc), hash2Value(emptyHash, emptyHash, hashFunc), hashFunc), tree.RootHash())
+}
+
+func TestEmptyHashAccessor(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:3], 8)
+	assert.Nil(t, err)
+	root := tree.RootHash()
+
+	empty := tree.EmptyHash()
+	assert.Equal(t, emptyHash, []byte(empty))
+	empty[0]++
+	assert.Equal(t, emptyHash, []byte(tree.EmptyHash()))
+	assert.Equal(t, root, tree.RootHash())
+
+	assert.Nil(t, NewSMT(nil, hashFunc).EmptyHash())
+}
+
+func TestAffectedProofIndices(t *testing.T) {
+	for _, updated := range []uint{0, 4, 8} {
+		tree := NewSMT(emptyHash, hashFunc)
+		err := tree.Generate(testHashes[:9], 16)
+		assert.Nil(t, err)
+
+		before := [][]ProofNode{}
+		for i := uint(0); i < 9; i++ {
+			proof, _ := tree.GetMerkleProof(i)
+			before = append(before, proof)
+		}
+		affected := tree.AffectedProofIndices(updated)
+		err = tree.UpdateLeaf(updated, testHashes[15])
+		assert.Nil(t, err)
+
+		changed := []uint{}
+		for i := uint(0); i < 9; i++ {
+			proof, _ := tree.GetMerkleProof(i)
+			if !reflect.DeepEqual(before[i], proof) {
+				changed = append(changed, i)
+			}
+		}
+		assert.Equal(t, changed, affected)
+	}
+
+	tree := NewSMT(emptyHash, hashFunc, WithIndexedLeaves())
+	assert.Nil(t, tree.AffectedProofIndices(0))
+	err := tree.Generate(testHashes[:3], 8)
+	assert.Nil(t, err)
+	err = tree.SetLeaf(5, testHashes[5])
+	assert.Nil(t, err)
+	assert.Nil(t, tree.AffectedProofIndices(8))
+	//neither unset positions nor empty leaves are listed
+	assert.Equal(t, []uint{0, 2, 5}, tree.AffectedProofIndices(1))
+	assert.Equal(t, []uint{0, 1, 2}, tree.AffectedProofIndices(5))
+	assert.Equal(t, []uint{0, 1, 2, 5}, tree.AffectedProofIndices(7))
+}
+
+func TestSetLeaf(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc, WithIndexedLeaves(), WithOperationLog())
+	err := tree.Generate(nil, 16)
+	assert.Nil(t, err)
+
+	positions := []uint{9, 2, 14, 3, 9}
+	values := [][]byte{testHashes[0], testHashes[1], testHashes[2], testHashes[3], testHashes[4]}
+	for i, position := range positions {
+		err = tree.SetLeaf(position, values[i])
+		assert.Nil(t, err)
+	}
+
+	leaves := make([][]byte, 15)
+	for i := range leaves {
+		leaves[i] = emptyHash
+	}
+	leaves[2], leaves[3], leaves[9], leaves[14] = testHashes[1], testHashes[3], testHashes[4], testHashes[2]
+	expected := NewSMT(emptyHash, hashFunc)
+	err = expected.Generate(leaves, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.RootHash(), tree.RootHash())
+
+	for i := uint(0); i < 16; i++ {
+		proof, err := tree.GetMerkleProof(i)
+		assert.Nil(t, err)
+		_, set := map[uint]bool{2: true, 3: true, 9: true, 14: true}[i]
+		if set {
+			assert.Nil(t, VerifyProof(leaves[i], i, proof, tree.RootHash(), hashFunc))
+			assert.NotNil(t, VerifyProof(emptyHash, i, proof, tree.RootHash(), hashFunc))
+		} else {
+			assert.Nil(t, VerifyProof(emptyHash, i, proof, tree.RootHash(), hashFunc))
+		}
+	}
+	assert.Equal(t, 11, len(tree.unsetLeaves))
+
+	replayed, err := ReplayLog(tree.OperationLog(), emptyHash, hashFunc, WithIndexedLeaves())
+	assert.Nil(t, err)
+	assert.Equal(t, tree.RootHash(), replayed.RootHash())
+
+	err = tree.SetLeaf(16, testHashes[0])
+	assert.Equal(t, "Leaf number is out of range", err.Error())
+}
+
+func TestSetLeafWithoutIndexedMode(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc, WithSecureErase())
+	err := tree.Generate(testHashes[:3], 8)
+	assert.Nil(t, err)
+	err = tree.SetLeaf(1, testHashes[5])
+	assert.Nil(t, err)
+	err = tree.SetLeaf(3, testHashes[6])
+	assert.Nil(t, err)
+	err = tree.SetLeaf(5, testHashes[7])
+	assert.Equal(t, "Leaf number is beyond the non empty leaves", err.Error())
+
+	expected := NewSMT(emptyHash, hashFunc)
+	err = expected.Generate([][]byte{testHashes[0], testHashes[5], testHashes[2], testHashes[6]}, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.RootHash(), tree.RootHash())
+
+	//filling an unset position with secure erase keeps the empty hash intact
+	tree = NewSMT(emptyHash, hashFunc, WithSecureErase(), WithIndexedLeaves())
+	err = tree.Generate(nil, 8)
+	assert.Nil(t, err)
+	err = tree.SetLeaf(3, testHashes[0])
+	assert.Nil(t, err)
+	err = tree.SetLeaf(1, testHashes[1])
+	assert.Nil(t, err)
+	assert.Equal(t, hashValue([]byte{}, md5.New()), emptyHash)
+	assert.Equal(t, 2, len(tree.unsetLeaves))
+}
+
+func TestPaddingLeaf(t *testing.T) {
+	pad := hashValue([]byte("padding"), md5.New())
+	padded := NewSMT(emptyHash, hashFunc, WithPaddingLeaf(pad))
+	err := padded.Generate(testHashes[:3], 4)
+	assert.Nil(t, err)
+	plain := NewSMT(emptyHash, hashFunc)
+	err = plain.Generate(testHashes[:3], 4)
+	assert.Nil(t, err)
+	assert.NotEqual(t, plain.RootHash(), padded.RootHash())
+
+	left := hash2Value(testHashes[0], testHashes[1], hashFunc)
+	right := hash2Value(testHashes[2], pad, hashFunc)
+	assert.Equal(t, hash2Value(left, right, hashFunc), padded.RootHash())
+	assert.Equal(t, Hash(emptyHash), padded.EmptyHash())
+
+	proof, err := padded.GetMerkleProof(3)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyProof(pad, 3, proof, padded.RootHash(), hashFunc))
+	assert.NotNil(t, VerifyProof(emptyHash, 3, proof, padded.RootHash(), hashFunc))
+
+	//unset positions of an indexed tree stay empty, the tail stays padded
+	indexed := NewSMT(emptyHash, hashFunc, WithPaddingLeaf(pad), WithIndexedLeaves())
+	err = indexed.Generate(testHashes[:1], 8)
+	assert.Nil(t, err)
+	err = indexed.SetLeaf(3, testHashes[3])
+	assert.Nil(t, err)
+	for leafNo, leaf := range [][]byte{testHashes[0], emptyHash, emptyHash, testHashes[3], pad, pad, pad, pad} {
+		proof, err := indexed.GetMerkleProof(uint(leafNo))
+		assert.Nil(t, err)
+		assert.Nil(t, VerifyProof(leaf, uint(leafNo), proof, indexed.RootHash(), hashFunc))
+	}
+}
+
+func TestConcurrentReadersAndWriter(t *testing.T) {
+	roots := [][]byte{}
+	for _, first := range [][]byte{testHashes[0], testHashes[15]} {
+		tree := NewSMT(emptyHash, md5.New(), WithCapacityInRoot())
+		err := tree.Generate(append([][]byte{first}, testHashes[1:9]...), 16)
+		assert.Nil(t, err)
+		roots = append(roots, tree.RootHash())
+	}
+
+	tree := NewSMT(emptyHash, md5.New(), WithCapacityInRoot())
+	err := tree.Generate(testHashes[:9], 16)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				root := tree.RootHash()
+				assert.True(t, bytes.Equal(roots[0], root) || bytes.Equal(roots[1], root))
+				proof, err := tree.GetMerkleProof(5)
+				assert.Nil(t, err)
+				//the root of either state must be reproduced from the proof
+				top, err := foldProof(testHashes[5], proof, md5.New())
+				assert.Nil(t, err)
+				bound, _ := bindCapacity(md5.New(), top, 16)
+				assert.True(t, bytes.Equal(roots[0], bound) || bytes.Equal(roots[1], bound))
+				assert.NotNil(t, tree.Frontier())
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		err := tree.UpdateLeaf(0, [][]byte{testHashes[0], testHashes[15]}[i%2])
+		assert.Nil(t, err)
+	}
+	wg.Wait()
+}
+
+func TestRemainingCapacity(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc, WithIndexedLeaves())
+	assert.Equal(t, 0, tree.RemainingCapacity())
+
+	err := tree.Generate(testHashes[:0], 8)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, tree.RemainingCapacity())
+	_, err = tree.AppendLeaves(testHashes[:3])
+	assert.Nil(t, err)
+	assert.Equal(t, 5, tree.RemainingCapacity())
+
+	//unset positions left by an indexed write still count
+	err = tree.SetLeaf(6, testHashes[6])
+	assert.Nil(t, err)
+	assert.Equal(t, 4, tree.RemainingCapacity())
+	err = tree.SetLeaf(4, testHashes[4])
+	assert.Nil(t, err)
+	assert.Equal(t, 3, tree.RemainingCapacity())
+
+	full := NewSMT(emptyHash, hashFunc)
+	err = full.Generate(testHashes[:8], 8)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, full.RemainingCapacity())
+}
+
+func TestEmptyNodeSeed(t *testing.T) {
+	seed := []byte("empty node")
+	emptyNode := func(child []byte) []byte {
+		h := md5.New()
+		h.Write(seed)
+		h.Write(child)
+		h.Write(child)
+		return h.Sum(nil)
+	}
+
+	tree := NewSMT(emptyHash, hashFunc, WithEmptyNodeSeed(seed))
+	err := tree.Generate(testHashes[:3], 8)
+	assert.Nil(t, err)
+
+	//reference construction with the distinct constants
+	e1 := emptyNode(emptyHash)
+	e2 := emptyNode(e1)
+	n01 := hash2Value(testHashes[0], testHashes[1], hashFunc)
+	n23 := hash2Value(testHashes[2], emptyHash, hashFunc)
+	left := hash2Value(n01, n23, hashFunc)
+	assert.Equal(t, hash2Value(left, e2, hashFunc), tree.RootHash())
+
+	roots, err := tree.EmptySubtreeRoots()
+	assert.Nil(t, err)
+	assert.Equal(t, []Hash{emptyHash, e1, e2, emptyNode(e2)}, roots)
+
+	plain := NewSMT(emptyHash, hashFunc)
+	err = plain.Generate(testHashes[:3], 8)
+	assert.Nil(t, err)
+	assert.NotEqual(t, plain.RootHash(), tree.RootHash())
+
+	for leafNo, leaf := range [][]byte{testHashes[0], testHashes[1], testHashes[2], emptyHash} {
+		proof, err := tree.GetMerkleProof(uint(leafNo))
+		assert.Nil(t, err)
+		assert.Nil(t, VerifyProof(leaf, uint(leafNo), proof, tree.RootHash(), hashFunc))
+	}
+	//leaf 5 lies in an empty subtree whose root is an empty node
+	proof, err := tree.GetMerkleProof(5)
+	assert.Nil(t, err)
+	assert.NotNil(t, VerifyProof(emptyHash, 5, proof, tree.RootHash(), hashFunc))
+
+	frontier, err := NewFrontierTree(emptyHash, hashFunc, 8, WithEmptyNodeSeed(seed))
+	assert.Nil(t, err)
+	for _, leaf := range testHashes[:3] {
+		assert.Nil(t, frontier.PushLeaf(leaf))
+	}
+	assert.Equal(t, tree.RootHash(), frontier.RootHash())
+}
+
+func TestComputeRoot(t *testing.T) {
+	for _, size := range []int{1, 2, 4, 16, 32} {
+		for count := 0; count <= size && count <= len(testHashes); count++ {
+			tree := NewSMT(emptyHash, hashFunc)
+			err := tree.Generate(testHashes[:count], size)
+			assert.Nil(t, err)
+			root, err := ComputeRoot(testHashes[:count], size, emptyHash, hashFunc)
+			assert.Nil(t, err)
+			assert.Equal(t, tree.RootHash(), root)
+		}
+	}
+
+	_, err := ComputeRoot(testHashes[:3], 6, emptyHash, hashFunc)
+	assert.Equal(t, "Leaves number of SMT tree should be power of 2", err.Error())
+	_, err = ComputeRoot(testHashes[:5], 4, emptyHash, hashFunc)
+	assert.Equal(t, "NonEmptyLeaves is bigger than totalSize", err.Error())
+}
+
+func TestComputeRoots(t *testing.T) {
+	batches := [][][]byte{}
+	for count := 0; count <= 16; count++ {
+		batches = append(batches, testHashes[:count])
+		batches = append(batches, testHashes[16-count:])
+	}
+	roots, err := ComputeRoots(batches, 16, emptyHash, md5.New)
+	assert.Nil(t, err)
+	assert.Len(t, roots, len(batches))
+	for i, leaves := range batches {
+		tree := NewSMT(emptyHash, hashFunc)
+		err := tree.Generate(leaves, 16)
+		assert.Nil(t, err)
+		assert.Equal(t, tree.RootHash(), roots[i])
+	}
+
+	roots, err = ComputeRoots(nil, 16, emptyHash, md5.New)
+	assert.Nil(t, err)
+	assert.Empty(t, roots)
+	_, err = ComputeRoots(batches, 6, emptyHash, md5.New)
+	assert.Equal(t, "Leaves number of SMT tree should be power of 2", err.Error())
+	_, err = ComputeRoots(batches, 8, emptyHash, md5.New)
+	assert.Equal(t, "NonEmptyLeaves is bigger than totalSize", err.Error())
+}
+
+func BenchmarkComputeRoots_4K_Batches(b *testing.B) {
+	batches := make([][][]byte, 1<<12)
+	for i := range batches {
+		batches[i] = testHashes[:i%9]
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ComputeRoots(batches, 8, emptyHash, md5.New); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkComputeRoot_4K_Batches(b *testing.B) {
+	batches := make([][][]byte, 1<<12)
+	for i := range batches {
+		batches[i] = testHashes[:i%9]
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, leaves := range batches {
+			if _, err := ComputeRoot(leaves, 8, emptyHash, md5.New()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestBuildMetrics(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc, WithBuildMetrics())
+	assert.Empty(t, tree.BuildMetrics())
+	err := tree.Generate(testHashes[:11], 16)
+	assert.Nil(t, err)
+	metrics := tree.BuildMetrics()
+	assert.Len(t, metrics, 4)
+	for _, duration := range metrics {
+		assert.True(t, duration >= 0)
+	}
+	tree.Reset()
+	assert.Empty(t, tree.BuildMetrics())
+
+	plain := NewSMT(emptyHash, hashFunc)
+	err = plain.Generate(testHashes[:11], 16)
+	assert.Nil(t, err)
+	assert.Empty(t, plain.BuildMetrics())
+}
+
+func TestIsValidPrefix(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	assert.True(t, tree.IsValidPrefix(testHashes[:16]))
+	assert.True(t, tree.IsValidPrefix(nil))
+	assert.False(t, tree.IsValidPrefix([][]byte{testHashes[0], emptyHash, testHashes[2]}))
+
+	err := tree.Generate(testHashes[:3], 8)
+	assert.Nil(t, err)
+	assert.True(t, tree.IsValidPrefix(testHashes[:8]))
+	assert.False(t, tree.IsValidPrefix(testHashes[:9]))
+
+	//the stored leaves of an indexed tree with unset positions are not a prefix
+	indexed := NewSMT(emptyHash, hashFunc, WithIndexedLeaves())
+	err = indexed.Generate(testHashes[:1], 8)
+	assert.Nil(t, err)
+	err = indexed.SetLeaf(3, testHashes[3])
+	assert.Nil(t, err)
+	stored := [][]byte{}
+	for _, leaf := range indexed.fullNodes[0] {
+		stored = append(stored, leaf)
+	}
+	assert.False(t, indexed.IsValidPrefix(stored))
+
+	pad := hashValue([]byte("padding"), md5.New())
+	padded := NewSMT(emptyHash, hashFunc, WithPaddingLeaf(pad))
+	assert.False(t, padded.IsValidPrefix([][]byte{testHashes[0], pad}))
+
+	//leaves are checked in their stored form
+	raw := [][]byte{{}}
+	assert.True(t, tree.IsValidPrefix(raw))
+	hashed := NewSMT(emptyHash, hashFunc, WithLeafHash(md5.New))
+	assert.False(t, hashed.IsValidPrefix(raw))
+}
+
+func TestNodeHash(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	_, err := tree.NodeHash(0, 0)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+	err = tree.Generate(testHashes[:3], 8)
+	assert.Nil(t, err)
+
+	e1 := hash2Value(emptyHash, emptyHash, hashFunc)
+	n01 := hash2Value(testHashes[0], testHashes[1], hashFunc)
+	n23 := hash2Value(testHashes[2], emptyHash, hashFunc)
+	left := hash2Value(n01, n23, hashFunc)
+	right := hash2Value(e1, e1, hashFunc)
+	expected := map[[2]int][]byte{
+		{0, 0}: hash2Value(left, right, hashFunc),
+		{1, 0}: left,
+		{1, 1}: right,
+		{2, 0}: n01,
+		{2, 1}: n23,
+		{2, 3}: e1,
+		{3, 2}: testHashes[2],
+		{3, 3}: emptyHash,
+		{3, 7}: emptyHash,
+	}
+	for coordinate, hash := range expected {
+		node, err := tree.NodeHash(coordinate[0], coordinate[1])
+		assert.Nil(t, err)
+		assert.Equal(t, hash, []byte(node))
+	}
+
+	for _, coordinate := range [][2]int{{-1, 0}, {4, 0}} {
+		_, err = tree.NodeHash(coordinate[0], coordinate[1])
+		assert.Equal(t, "Level is out of range", err.Error())
+	}
+	for _, coordinate := range [][2]int{{0, 1}, {2, 4}, {3, -1}} {
+		_, err = tree.NodeHash(coordinate[0], coordinate[1])
+		assert.Equal(t, "Index is out of range", err.Error())
+	}
+}
+
+func TestNodeLeafRange(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	_, _, err := tree.NodeLeafRange(0, 0)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+	err = tree.Generate(testHashes[:3], 16)
+	assert.Nil(t, err)
+
+	start, end, err := tree.NodeLeafRange(0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint{0, 16}, []uint{start, end})
+
+	//the children of every node split its range in two halves
+	for level := 0; level < 4; level++ {
+		for index := 0; index < 1<<uint(level); index++ {
+			start, end, err := tree.NodeLeafRange(level, index)
+			assert.Nil(t, err)
+			leftStart, leftEnd, err := tree.NodeLeafRange(level+1, 2*index)
+			assert.Nil(t, err)
+			rightStart, rightEnd, err := tree.NodeLeafRange(level+1, 2*index+1)
+			assert.Nil(t, err)
+			assert.Equal(t, start, leftStart)
+			assert.Equal(t, leftEnd, rightStart)
+			assert.Equal(t, end, rightEnd)
+			assert.Equal(t, (end-start)/2, leftEnd-leftStart)
+		}
+	}
+
+	start, end, err = tree.NodeLeafRange(4, 9)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint{9, 10}, []uint{start, end})
+
+	_, _, err = tree.NodeLeafRange(5, 0)
+	assert.Equal(t, "Level is out of range", err.Error())
+	_, _, err = tree.NodeLeafRange(1, 2)
+	assert.Equal(t, "Index is out of range", err.Error())
+}
+
+func TestExpectedLeaves(t *testing.T) {
+	for _, count := range []int{0, 5, 16} {
+		tree := NewSMT(emptyHash, hashFunc, WithExpectedLeaves(16))
+		assert.Equal(t, 5, cap(tree.fullNodes))
+		err := tree.Generate(testHashes[:count], 16)
+		assert.Nil(t, err)
+		assert.Equal(t, 5, cap(tree.fullNodes))
+
+		plain := NewSMT(emptyHash, hashFunc)
+		err = plain.Generate(testHashes[:count], 16)
+		assert.Nil(t, err)
+		assert.Equal(t, plain.fullNodes, tree.fullNodes)
+		assert.Equal(t, plain.RootHash(), tree.RootHash())
+	}
+}
+
+func TestLeafHashWorkers(t *testing.T) {
+	raw := [][]byte{}
+	for i := 0; i < 13; i++ {
+		raw = append(raw, []byte{byte(i)})
+	}
+	serial := NewSMT(emptyHash, hashFunc, WithLeafHash(sha256.New))
+	err := serial.Generate(raw, 16)
+	assert.Nil(t, err)
+
+	for _, workers := range []int{2, 3, 4, 13, 32} {
+		parallel := NewSMT(emptyHash, hashFunc, WithLeafHash(sha256.New), WithLeafHashWorkers(workers))
+		err := parallel.Generate(raw, 16)
+		assert.Nil(t, err)
+		assert.Equal(t, serial.fullNodes[0], parallel.fullNodes[0])
+		assert.Equal(t, serial.RootHash(), parallel.RootHash())
+
+		_, err = parallel.AppendLeaves([][]byte{{20}, {21}})
+		assert.Nil(t, err)
+		proof, err := parallel.GetMerkleProof(14)
+		assert.Nil(t, err)
+		assert.Nil(t, VerifyLeafProof([]byte{21}, 14, proof, parallel.RootHash(), sha256.New(), hashFunc))
+	}
+
+	failing := NewSMT(emptyHash, hashFunc, WithLeafHashWorkers(4), WithLeafHash(func() hash.Hash {
+		return NewHashCountErrorDecorator(sha256.New(), new(int), 1)
+	}))
+	err = failing.Generate(raw, 16)
+	assert.NotNil(t, err)
+}
+
+func TestMerkleTreeInterface(t *testing.T) {
+	check := func(tree MerkleTree) {
+		err := tree.Generate(testHashes[:4], 4)
+		assert.Nil(t, err)
+		proof, err := tree.GetMerkleProof(2)
+		assert.Nil(t, err)
+		assert.Nil(t, VerifyProof(testHashes[2], 2, proof, tree.RootHash(), hashFunc))
+	}
+	check(NewSMT(emptyHash, hashFunc))
+	check(NewTree(md5.New()))
+}
+
+func TestTruncate(t *testing.T) {
+	for _, kept := range []int{0, 1, 4, 5, 10, 11} {
+		tree := NewSMT(emptyHash, hashFunc, WithOperationLog(), WithSecureErase())
+		err := tree.Generate(testHashes[:11], 16)
+		assert.Nil(t, err)
+		err = tree.Truncate(kept)
+		assert.Nil(t, err)
+
+		expected := NewSMT(emptyHash, hashFunc)
+		err = expected.Generate(testHashes[:kept], 16)
+		assert.Nil(t, err)
+		assert.Equal(t, expected.fullNodes, tree.fullNodes)
+		assert.Equal(t, expected.RootHash(), tree.RootHash())
+		assert.Equal(t, 16-kept, tree.RemainingCapacity())
+
+		//the tree keeps growing from the truncated size
+		_, err = tree.AppendLeaf(testHashes[15])
+		assert.Nil(t, err)
+		_, err = expected.AppendLeaf(testHashes[15])
+		assert.Nil(t, err)
+		assert.Equal(t, expected.RootHash(), tree.RootHash())
+
+		replayed, err := ReplayLog(tree.OperationLog(), emptyHash, hashFunc)
+		assert.Nil(t, err)
+		assert.Equal(t, tree.RootHash(), replayed.RootHash())
+	}
+	//the caller's leaves are left alone by the erasure
+	assert.Equal(t, hashValue([]byte("alpha10"), md5.New()), testHashes[10])
+
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Truncate(0)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+	err = tree.Generate(testHashes[:3], 4)
+	assert.Nil(t, err)
+	for _, count := range []int{-1, 4} {
+		err = tree.Truncate(count)
+		assert.Equal(t, "Leaf count is beyond the non empty leaves", err.Error())
+	}
+
+	//the unset positions left at the end of the kept leaves are dropped
+	indexed := NewSMT(emptyHash, hashFunc, WithIndexedLeaves(), WithOperationLog())
+	err = indexed.Generate(testHashes[:1], 8)
+	assert.Nil(t, err)
+	err = indexed.SetLeaf(4, testHashes[4])
+	assert.Nil(t, err)
+	err = indexed.Truncate(3)
+	assert.Nil(t, err)
+	expected := NewSMT(emptyHash, hashFunc)
+	err = expected.Generate(testHashes[:1], 8)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.fullNodes, indexed.fullNodes)
+	assert.Equal(t, 7, indexed.RemainingCapacity())
+	assert.Equal(t, 0, len(indexed.unsetLeaves))
+	replayed, err := ReplayLog(indexed.OperationLog(), emptyHash, hashFunc, WithIndexedLeaves())
+	assert.Nil(t, err)
+	assert.Equal(t, indexed.RootHash(), replayed.RootHash())
+	_, err = indexed.AppendLeaf(testHashes[1])
+	assert.Nil(t, err)
+	_, err = expected.AppendLeaf(testHashes[1])
+	assert.Nil(t, err)
+	assert.Equal(t, expected.RootHash(), indexed.RootHash())
+}
+
+func TestDeleteLeaf(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.DeleteLeaf(0)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+	err = tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	err = tree.DeleteLeaf(5)
+	assert.Equal(t, "Leaf number is beyond the non empty leaves", err.Error())
+	err = tree.DeleteLeaf(2)
+	assert.Equal(t, "Only the last leaf can be deleted without indexed leaves", err.Error())
+
+	err = tree.DeleteLeaf(4)
+	assert.Nil(t, err)
+	expected := NewSMT(emptyHash, hashFunc)
+	err = expected.Generate(testHashes[:4], 8)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.fullNodes, tree.fullNodes)
+	assert.Equal(t, expected.RootHash(), tree.RootHash())
+	assert.Equal(t, 4, tree.RemainingCapacity())
+}
+
+func TestDeleteLeafIndexed(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc, WithIndexedLeaves(), WithOperationLog())
+	err := tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	err = tree.DeleteLeaf(2)
+	assert.Nil(t, err)
+	err = tree.DeleteLeaf(2)
+	assert.Equal(t, "Leaf is already empty", err.Error())
+
+	expected := NewSMT(emptyHash, hashFunc)
+	err = expected.Generate([][]byte{testHashes[0], testHashes[1], emptyHash, testHashes[3], testHashes[4]}, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.RootHash(), tree.RootHash())
+	assert.Equal(t, 4, tree.RemainingCapacity())
+	proof, err := tree.GetMerkleProof(3)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyProof(testHashes[3], 3, proof, tree.RootHash(), hashFunc))
+
+	replayed, err := ReplayLog(tree.OperationLog(), emptyHash, hashFunc, WithIndexedLeaves())
+	assert.Nil(t, err)
+	assert.Equal(t, tree.RootHash(), replayed.RootHash())
+
+	//deleting the last leaves drops the unset position left of them
+	err = tree.DeleteLeaf(4)
+	assert.Nil(t, err)
+	err = tree.DeleteLeaf(3)
+	assert.Nil(t, err)
+	expected = NewSMT(emptyHash, hashFunc)
+	err = expected.Generate(testHashes[:2], 8)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.fullNodes, tree.fullNodes)
+	assert.Equal(t, 6, tree.RemainingCapacity())
+	err = tree.SetLeaf(2, testHashes[2])
+	assert.Nil(t, err)
+}
+
+func TestUniformLevels(t *testing.T) {
+	for _, count := range []int{1, 2, 7, 8, 13, 16} {
+		leaves := make([][]byte, count)
+		for i := range leaves {
+			leaves[i] = testHashes[3]
+		}
+		plain := NewSMT(emptyHash, hashFunc)
+		err := plain.Generate(leaves, 16)
+		assert.Nil(t, err)
+
+		hashCount := 0
+		uniform := NewSMT(emptyHash, NewHashCountDecorator(md5.New(), &hashCount), WithUniformLevels())
+		err = uniform.Generate(leaves, 16)
+		assert.Nil(t, err)
+		assert.Equal(t, plain.fullNodes, uniform.fullNodes)
+		assert.Equal(t, plain.RootHash(), uniform.RootHash())
+		//at most one pair hash and one hash with an empty sibling per level,
+		//plus the empty subtree chain
+		assert.True(t, hashCount <= 2*4+len(uniform.emptyTreeRootHash))
+	}
+
+	//stored nodes do not share memory, updating one leaf keeps the others
+	leaves := [][]byte{testHashes[3], testHashes[3], testHashes[3], testHashes[3]}
+	tree := NewSMT(emptyHash, hashFunc, WithUniformLevels(), WithSecureErase())
+	err := tree.Generate(leaves, 4)
+	assert.Nil(t, err)
+	err = tree.UpdateLeaf(0, testHashes[4])
+	assert.Nil(t, err)
+	expected := NewSMT(emptyHash, hashFunc)
+	err = expected.Generate([][]byte{testHashes[4], testHashes[3], testHashes[3], testHashes[3]}, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.RootHash(), tree.RootHash())
+
+	mixed := NewSMT(emptyHash, hashFunc, WithUniformLevels())
+	err = mixed.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	reference := NewSMT(emptyHash, hashFunc)
+	err = reference.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	assert.Equal(t, reference.RootHash(), mixed.RootHash())
+}
+
+func TestGetMerkleProofToLevel(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:11], 16)
+	assert.Nil(t, err)
+
+	for _, leafNo := range []uint{0, 6, 10, 14} {
+		leaf := []byte(emptyHash)
+		if leafNo < 11 {
+			leaf = testHashes[leafNo]
+		}
+		full, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		for stopLevel := 0; stopLevel < 5; stopLevel++ {
+			partial, err := tree.GetMerkleProofToLevel(leafNo, stopLevel)
+			assert.Nil(t, err)
+			assert.Len(t, partial, 4-stopLevel)
+
+			//the partial proof reaches the subtree root...
+			subtreeIndex := int(leafNo >> uint(4-stopLevel))
+			subtreeRoot, err := tree.NodeHash(stopLevel, subtreeIndex)
+			assert.Nil(t, err)
+			computed, err := foldProof(leaf, partial, hashFunc)
+			assert.Nil(t, err)
+			assert.Equal(t, []byte(subtreeRoot), computed)
+
+			//...whose own proof carries it on to the root
+			assert.Nil(t, VerifyProof(subtreeRoot, uint(subtreeIndex), full[len(partial):], tree.RootHash(), hashFunc))
+		}
+	}
+
+	_, err = tree.GetMerkleProofToLevel(0, 5)
+	assert.Equal(t, "Level is out of range", err.Error())
+	_, err = tree.GetMerkleProofToLevel(0, -1)
+	assert.Equal(t, "Level is out of range", err.Error())
+	_, err = tree.GetMerkleProofToLevel(16, 2)
+	assert.Equal(t, "Leaf number is out of range", err.Error())
+}
+
+func TestUniformRoot(t *testing.T) {
+	for _, size := range []int{1, 2, 4, 8, 32} {
+		for count := 0; count <= size; count++ {
+			leaves := make([][]byte, count)
+			for i := range leaves {
+				leaves[i] = testHashes[7]
+			}
+			tree := NewSMT(emptyHash, hashFunc)
+			err := tree.Generate(leaves, size)
+			assert.Nil(t, err)
+			root, err := UniformRoot(testHashes[7], count, size, emptyHash, hashFunc)
+			assert.Nil(t, err)
+			assert.Equal(t, tree.RootHash(), root)
+		}
+	}
+
+	_, err := UniformRoot(testHashes[7], 3, 6, emptyHash, hashFunc)
+	assert.Equal(t, "Leaves number of SMT tree should be power of 2", err.Error())
+	_, err = UniformRoot(testHashes[7], 5, 4, emptyHash, hashFunc)
+	assert.Equal(t, "NonEmptyLeaves is bigger than totalSize", err.Error())
+	_, err = UniformRoot(testHashes[7], -1, 4, emptyHash, hashFunc)
+	assert.Equal(t, "Leaf count must not be negative", err.Error())
+}
+
+func TestIsEmptySubtreeRoot(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	_, ok := tree.IsEmptySubtreeRoot(emptyHash)
+	assert.False(t, ok)
+	err := tree.Generate(testHashes[:9], 16)
+	assert.Nil(t, err)
+
+	empty := []byte(emptyHash)
+	for height := 0; height < 5; height++ {
+		level, ok := tree.IsEmptySubtreeRoot(empty)
+		assert.True(t, ok)
+		assert.Equal(t, height, level)
+		empty = hash2Value(empty, empty, hashFunc)
+	}
+	//the root of an empty tree twice the size is not part of this tree
+	_, ok = tree.IsEmptySubtreeRoot(empty)
+	assert.False(t, ok)
+	_, ok = tree.IsEmptySubtreeRoot(testHashes[3])
+	assert.False(t, ok)
+
+	//the empty siblings of a proof are found at their own index
+	proof, err := tree.GetMerkleProof(8)
+	assert.Nil(t, err)
+	for i, node := range proof {
+		level, ok := tree.IsEmptySubtreeRoot(node.Hash)
+		assert.Equal(t, i != 3, ok)
+		if ok {
+			assert.Equal(t, i, level)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	assert.Equal(t, TreeStats{}, tree.Stats())
+
+	err := tree.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+	//rows of 5, 3, 2, 1 and 1 stored nodes out of 16, 8, 4, 2 and 1
+	expected := TreeStats{
+		TotalNodes:  31,
+		StoredNodes: 12,
+		EmptyNodes:  19,
+		Height:      5,
+		Capacity:    16,
+		Occupancy:   5.0 / 16,
+	}
+	assert.Equal(t, expected, tree.Stats())
+
+	_, err = tree.AppendLeaves(testHashes[5:])
+	assert.Nil(t, err)
+	stats := tree.Stats()
+	assert.Equal(t, 31, stats.StoredNodes)
+	assert.Equal(t, 0, stats.EmptyNodes)
+	assert.Equal(t, 1.0, stats.Occupancy)
+}
+
+func TestWithExternalParent(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	_, _, err := tree.WithExternalParent(testHashes[0], true)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+	err = tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+
+	sibling := NewSMT(emptyHash, hashFunc)
+	err = sibling.Generate(testHashes[8:], 8)
+	assert.Nil(t, err)
+	for _, selfOnLeft := range []bool{true, false} {
+		combined, extension, err := tree.WithExternalParent(sibling.RootHash(), selfOnLeft)
+		assert.Nil(t, err)
+		for leafNo := uint(0); leafNo < 5; leafNo++ {
+			proof, err := tree.GetMerkleProof(leafNo)
+			assert.Nil(t, err)
+			proof = append(proof, extension)
+			position := leafNo
+			if !selfOnLeft {
+				position += 8
+			}
+			assert.Nil(t, VerifyProof(testHashes[leafNo], position, proof, combined, hashFunc))
+			assert.Nil(t, NewVerifier(hashFunc, WithStrictDirections()).VerifyProof(testHashes[leafNo], position, proof, combined))
+		}
+	}
+	//the combined root is the root of the tree of both leaf sets
+	combined, _, err := tree.WithExternalParent(sibling.RootHash(), true)
+	assert.Nil(t, err)
+	expected := NewSMT(emptyHash, hashFunc)
+	err = expected.Generate(append(append([][]byte{}, testHashes[:5]...), emptyHash, emptyHash, emptyHash, testHashes[8], testHashes[9], testHashes[10], testHashes[11], testHashes[12], testHashes[13], testHashes[14], testHashes[15]), 16)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.RootHash(), combined)
+
+	bound := NewSMT(emptyHash, hashFunc, WithCapacityInRoot())
+	err = bound.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	_, _, err = bound.WithExternalParent(sibling.RootHash(), true)
+	assert.Equal(t, "External parents do not support capacity bound roots", err.Error())
+}
+
+func TestNodeInputs(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	_, _, err := tree.NodeInputs(0, 0)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+	err = tree.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+
+	for level := 0; level < 4; level++ {
+		for index := 0; index < 1<<uint(level); index++ {
+			left, right, err := tree.NodeInputs(level, index)
+			assert.Nil(t, err)
+			parent, err := tree.parentHash(left, right)
+			assert.Nil(t, err)
+			node, err := tree.NodeHash(level, index)
+			assert.Nil(t, err)
+			assert.Equal(t, node, Hash(parent))
+		}
+	}
+	//the odd last leaf is paired with the empty leaf
+	left, right, err := tree.NodeInputs(3, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, Hash(testHashes[4]), left)
+	assert.Equal(t, Hash(emptyHash), right)
+
+	_, _, err = tree.NodeInputs(4, 0)
+	assert.Equal(t, "Leaves have no children", err.Error())
+	_, _, err = tree.NodeInputs(5, 0)
+	assert.Equal(t, "Level is out of range", err.Error())
+	_, _, err = tree.NodeInputs(2, 4)
+	assert.Equal(t, "Index is out of range", err.Error())
+}
+
+func TestMatchesLeaves(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	ok, index := tree.MatchesLeaves(nil)
+	assert.False(t, ok)
+	assert.Equal(t, 0, index)
+	err := tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+
+	ok, index = tree.MatchesLeaves(testHashes[:5])
+	assert.True(t, ok)
+	assert.Equal(t, -1, index)
+
+	swapped := [][]byte{testHashes[0], testHashes[1], testHashes[3], testHashes[2], testHashes[4]}
+	ok, index = tree.MatchesLeaves(swapped)
+	assert.False(t, ok)
+	assert.Equal(t, 2, index)
+
+	ok, index = tree.MatchesLeaves(testHashes[:3])
+	assert.False(t, ok)
+	assert.Equal(t, 3, index)
+	ok, index = tree.MatchesLeaves(testHashes[:6])
+	assert.False(t, ok)
+	assert.Equal(t, 5, index)
+
+	//raw leaves are compared after the leaf hash
+	hashed := NewSMT(emptyHash, hashFunc, WithLeafHash(sha256.New))
+	err = hashed.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	ok, index = hashed.MatchesLeaves(testHashes[:5])
+	assert.True(t, ok)
+	assert.Equal(t, -1, index)
+}
+
+func TestGetMerkleProofCoords(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	_, err := tree.GetMerkleProofCoords(0)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+	err = tree.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+
+	for leafNo := uint(0); leafNo < 16; leafNo++ {
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		nodes, err := tree.GetMerkleProofCoords(leafNo)
+		assert.Nil(t, err)
+		assert.Len(t, nodes, len(proof))
+		for i, node := range nodes {
+			assert.Equal(t, proof[i], ProofNode{Left: node.Left, Hash: node.Hash})
+			hash, err := tree.NodeHash(node.Level, node.Index)
+			assert.Nil(t, err)
+			assert.Equal(t, Hash(node.Hash), hash)
+		}
+	}
+
+	//leaves 0 and 1 share every sibling above the leaves
+	first, err := tree.GetMerkleProofCoords(0)
+	assert.Nil(t, err)
+	second, err := tree.GetMerkleProofCoords(1)
+	assert.Nil(t, err)
+	assert.Equal(t, CoordProofNode{Left: false, Hash: testHashes[1], Level: 4, Index: 1}, first[0])
+	assert.Equal(t, first[1:], second[1:])
+
+	_, err = tree.GetMerkleProofCoords(16)
+	assert.Equal(t, "Leaf number is out of range", err.Error())
+}
+
+func TestUniformLeafSize(t *testing.T) {
+	long := [][]byte{}
+	for _, leaf := range testHashes[:5] {
+		long = append(long, hashValue(leaf, sha256.New()))
+	}
+
+	//by default the leaf level may be wider than the nodes
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(long, 8)
+	assert.Nil(t, err)
+	proof, err := tree.GetMerkleProof(2)
+	assert.Nil(t, err)
+	assert.Len(t, proof[0].Hash, sha256.Size)
+	assert.Len(t, proof[1].Hash, hashFunc.Size())
+	assert.Nil(t, VerifyProof(long[2], 2, proof, tree.RootHash(), hashFunc))
+
+	tree = NewSMT(emptyHash, hashFunc, WithUniformLeafSize())
+	err = tree.Generate(long, 8)
+	assert.Equal(t, "Leaf size does not match the hash size", err.Error())
+	err = tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	_, err = tree.AppendLeaf(long[0])
+	assert.Equal(t, "Leaf size does not match the hash size", err.Error())
+	err = tree.UpdateLeaf(0, long[0])
+	assert.Equal(t, "Leaf size does not match the hash size", err.Error())
+
+	//a leaf hash of the node hash size makes any raw leaf acceptable
+	tree = NewSMT(emptyHash, hashFunc, WithUniformLeafSize(), WithLeafHash(md5.New))
+	err = tree.Generate(long, 8)
+	assert.Nil(t, err)
+}
+
+func TestBuildFromLeafHashes(t *testing.T) {
+	raw := [][]byte{}
+	hashes := []Hash{}
+	for _, leaf := range testHashes[:5] {
+		raw = append(raw, append([]byte("raw"), leaf...))
+		hashes = append(hashes, hashValue(append([]byte("raw"), leaf...), sha256.New()))
+	}
+	expected := NewSMT(emptyHash, hashFunc, WithLeafHash(sha256.New))
+	err := expected.Generate(raw, 8)
+	assert.Nil(t, err)
+
+	tree := NewSMT(emptyHash, hashFunc, WithLeafHash(sha256.New), WithOperationLog())
+	err = tree.BuildFromLeafHashes(hashes, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.fullNodes, tree.fullNodes)
+	assert.Equal(t, expected.RootHash(), tree.RootHash())
+	err = tree.BuildFromLeafHashes(hashes, 8)
+	assert.Equal(t, "SMT tree already filled", err.Error())
+
+	replayed, err := ReplayLog(tree.OperationLog(), emptyHash, hashFunc, WithLeafHash(sha256.New))
+	assert.Nil(t, err)
+	assert.Equal(t, tree.RootHash(), replayed.RootHash())
+
+	//without a leaf hash the leaves must have the node hash size
+	plain := NewSMT(emptyHash, hashFunc)
+	err = plain.BuildFromLeafHashes(hashes, 8)
+	assert.Equal(t, "Leaf hash size does not match the hash size", err.Error())
+	hashes = hashes[:0]
+	for _, leaf := range testHashes[:5] {
+		hashes = append(hashes, leaf)
+	}
+	err = plain.BuildFromLeafHashes(hashes, 4)
+	assert.Equal(t, "NonEmptyLeaves is bigger than totalSize", err.Error())
+	err = plain.BuildFromLeafHashes(hashes, 8)
+	assert.Nil(t, err)
+	expected = NewSMT(emptyHash, hashFunc)
+	err = expected.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.RootHash(), plain.RootHash())
+}
+
+func TestSharedProofNodes(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	assert.Equal(t, 0, tree.SharedProofNodes(0, 1))
+	err := tree.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+
+	cases := []struct {
+		leafA, leafB uint
+		expected     int
+	}{
+		{3, 3, 4},
+		{2, 3, 3},
+		{0, 3, 2},
+		{1, 6, 1},
+		{0, 15, 0},
+		{7, 8, 0},
+		{16, 0, 0},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.expected, tree.SharedProofNodes(c.leafA, c.leafB))
+		assert.Equal(t, c.expected, tree.SharedProofNodes(c.leafB, c.leafA))
+	}
+
+	//the count matches the proofs themselves
+	for leafA := uint(0); leafA < 16; leafA++ {
+		for leafB := uint(0); leafB < 16; leafB++ {
+			proofA, err := tree.GetMerkleProof(leafA)
+			assert.Nil(t, err)
+			proofB, err := tree.GetMerkleProof(leafB)
+			assert.Nil(t, err)
+			shared := 0
+			for i := range proofA {
+				if proofA[i].Left == proofB[i].Left && bytes.Equal(proofA[i].Hash, proofB[i].Hash) {
+					shared++
+				}
+			}
+			assert.True(t, shared >= tree.SharedProofNodes(leafA, leafB))
+		}
+	}
+}
+
+func TestLeavesUnder(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	assert.Nil(t, tree.LeavesUnder(0, 0))
+	err := tree.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []uint{0, 1, 2, 3}, tree.LeavesUnder(2, 0))
+	assert.Equal(t, []uint{4}, tree.LeavesUnder(2, 1))
+	assert.Equal(t, []uint{}, tree.LeavesUnder(4, 9))
+	assert.Len(t, tree.LeavesUnder(0, 0), 5)
+	assert.Nil(t, tree.LeavesUnder(2, 4))
+	assert.Nil(t, tree.LeavesUnder(5, 0))
+
+	//exactly the non empty leaves under the node fold through it
+	for level := 0; level < 5; level++ {
+		for index := 0; index < 1<<uint(level); index++ {
+			node, err := tree.NodeHash(level, index)
+			assert.Nil(t, err)
+			under := map[uint]bool{}
+			for _, leafNo := range tree.LeavesUnder(level, index) {
+				under[leafNo] = true
+			}
+			for leafNo := uint(0); leafNo < 16; leafNo++ {
+				leaf := Hash(emptyHash)
+				if leafNo < 5 {
+					leaf = testHashes[leafNo]
+				}
+				proof, err := tree.GetMerkleProofToLevel(leafNo, level)
+				assert.Nil(t, err)
+				computed, err := foldProof(leaf, proof, hashFunc)
+				assert.Nil(t, err)
+				if under[leafNo] {
+					assert.Equal(t, []byte(node), computed)
+				}
+				assert.Equal(t, under[leafNo], leafNo < 5 && leafNo>>uint(4-level) == uint(index))
+			}
+		}
+	}
+}
+
+func TestLeavesUnderSparse(t *testing.T) {
+	//a high node of a huge tree lists only its few stored leaves
+	tree := NewSMT(emptyHash, hashFunc, WithIndexedLeaves())
+	err := tree.Generate(testHashes[:3], 1<<40)
+	assert.Nil(t, err)
+	err = tree.SetLeaf(6, testHashes[6])
+	assert.Nil(t, err)
+	assert.Equal(t, []uint{0, 1, 2, 6}, tree.LeavesUnder(0, 0))
+	assert.Equal(t, []uint{0, 1, 2, 6}, tree.LeavesUnder(1, 0))
+	assert.Equal(t, []uint{}, tree.LeavesUnder(1, 1))
+	assert.Equal(t, []uint{6}, tree.LeavesUnder(39, 3))
+	start, end, err := tree.NodeLeafRange(1, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1)<<39, start)
+	assert.Equal(t, uint(1)<<40, end)
+}
+
+func TestRootWithLeaf(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	_, err := tree.RootWithLeaf(0, testHashes[0])
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+
+	for _, opts := range [][]Option{{}, {WithIndexedLeaves()}, {WithCapacityInRoot()}} {
+		for _, leafNo := range []uint{0, 3, 4, 5, 7} {
+			tree := NewSMT(emptyHash, hashFunc, opts...)
+			err := tree.Generate(testHashes[:5], 8)
+			assert.Nil(t, err)
+			before := tree.RootHash()
+			root, err := tree.RootWithLeaf(leafNo, testHashes[15])
+			if leafNo > 5 && !tree.indexedLeaves {
+				assert.Equal(t, "Leaf number is beyond the non empty leaves", err.Error())
+				continue
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, before, tree.RootHash())
+
+			if leafNo < 5 {
+				err = tree.UpdateLeaf(leafNo, testHashes[15])
+			} else {
+				err = tree.SetLeaf(leafNo, testHashes[15])
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tree.RootHash(), root)
+		}
+	}
+
+	tree = NewSMT(emptyHash, hashFunc)
+	err = tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	_, err = tree.RootWithLeaf(8, testHashes[15])
+	assert.Equal(t, "Leaf number is out of range", err.Error())
+}
+
+func TestRootWithLeafMatchesSetLeaf(t *testing.T) {
+	for _, opt := range []Option{WithEmptyNodeSeed([]byte("seed")), WithPaddingLeaf(testHashes[15])} {
+		for _, leafNo := range []uint{2, 3, 5, 6, 7, 12} {
+			tree := NewSMT(emptyHash, hashFunc, opt, WithIndexedLeaves())
+			err := tree.Generate(testHashes[:3], 16)
+			assert.Nil(t, err)
+			expected, err := tree.RootWithLeaf(leafNo, testHashes[leafNo])
+			assert.Nil(t, err)
+			err = tree.SetLeaf(leafNo, testHashes[leafNo])
+			assert.Nil(t, err)
+			assert.Equal(t, expected, tree.RootHash())
+		}
+	}
+}
+
+func TestEmptyLeafProofHook(t *testing.T) {
+	warned := []uint{}
+	tree := NewSMT(emptyHash, hashFunc, WithIndexedLeaves(), WithEmptyLeafProofHook(func(leafNo uint) {
+		warned = append(warned, leafNo)
+	}))
+	_, err := tree.GetMerkleProof(0)
+	assert.NotNil(t, err)
+	err = tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	err = tree.SetLeaf(6, testHashes[6])
+	assert.Nil(t, err)
+
+	for leafNo := uint(0); leafNo < 8; leafNo++ {
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		assert.Len(t, proof, 3)
+	}
+	assert.Equal(t, []uint{5, 7}, warned)
+
+	//the hook may use the tree
+	tree = NewSMT(emptyHash, hashFunc, WithEmptyLeafProofHook(func(leafNo uint) {
+		_, err := tree.AppendLeaf(testHashes[leafNo])
+		assert.Nil(t, err)
+	}))
+	err = tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	_, err = tree.GetMerkleProof(5)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, tree.RemainingCapacity())
+}
+
+func TestGenerateFunc(t *testing.T) {
+	occupied := map[uint]bool{0: true, 1: true, 4: true, 6: true}
+	valueAt := func(index uint) ([]byte, bool) {
+		if !occupied[index] {
+			return nil, false
+		}
+		return testHashes[index], true
+	}
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.GenerateFunc(valueAt, 16)
+	assert.Nil(t, err)
+	expected := NewSMT(emptyHash, hashFunc)
+	err = expected.Generate([][]byte{testHashes[0], testHashes[1], emptyHash, emptyHash, testHashes[4], emptyHash, testHashes[6]}, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.fullNodes, tree.fullNodes)
+	assert.Equal(t, expected.RootHash(), tree.RootHash())
+	err = tree.GenerateFunc(valueAt, 16)
+	assert.Equal(t, "SMT tree already filled", err.Error())
+
+	//with indexed leaves the gaps are unset and can be written later
+	indexed := NewSMT(emptyHash, hashFunc, WithIndexedLeaves(), WithLeafHash(sha256.New))
+	err = indexed.GenerateFunc(valueAt, 16)
+	assert.Nil(t, err)
+	assert.Equal(t, 12, indexed.RemainingCapacity())
+	hashed := NewSMT(emptyHash, hashFunc, WithLeafHash(sha256.New))
+	err = hashed.Generate(testHashes[:7], 16)
+	assert.Nil(t, err)
+	for _, index := range []uint{2, 3, 5} {
+		assert.NotEqual(t, hashed.RootHash(), indexed.RootHash())
+		err = indexed.SetLeaf(index, testHashes[index])
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, hashed.RootHash(), indexed.RootHash())
+
+	empty := NewSMT(emptyHash, hashFunc)
+	err = empty.GenerateFunc(func(index uint) ([]byte, bool) { return nil, false }, 8)
+	assert.Nil(t, err)
+	expected = NewSMT(emptyHash, hashFunc)
+	err = expected.Generate(nil, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.RootHash(), empty.RootHash())
+	err = NewSMT(emptyHash, hashFunc).GenerateFunc(valueAt, 6)
+	assert.Equal(t, "Leaves number of SMT tree should be power of 2", err.Error())
+}
+
+func TestGenerateFuncChecksLeaves(t *testing.T) {
+	repeated := func(index uint) ([]byte, bool) {
+		if index == 1 || index == 4 {
+			return testHashes[7], true
+		}
+		return testHashes[index], index < 6
+	}
+	tree := NewSMT(emptyHash, hashFunc, WithUniqueLeaves())
+	err := tree.GenerateFunc(repeated, 8)
+	assert.Equal(t, &DuplicateLeafError{First: 1, Second: 4}, err)
+	assert.Equal(t, 0, tree.Capacity())
+
+	sorted := sortedTestHashes()
+	unordered := func(index uint) ([]byte, bool) {
+		if index == 2 {
+			return sorted[0], true
+		}
+		return sorted[index], index < 4
+	}
+	tree = NewSMT(emptyHash, hashFunc, WithSortedLeaves())
+	err = tree.GenerateFunc(unordered, 8)
+	assert.Equal(t, "Leaves are not strictly increasing", err.Error())
+	gapped := func(index uint) ([]byte, bool) {
+		return sorted[index], index == 0 || index == 2
+	}
+	err = tree.GenerateFunc(gapped, 8)
+	assert.Equal(t, "Sorted leaves cannot leave unset positions", err.Error())
+
+	ordered := func(index uint) ([]byte, bool) {
+		return sorted[index], index < 4
+	}
+	err = tree.GenerateFunc(ordered, 8)
+	assert.Nil(t, err)
+	expected := NewSMT(emptyHash, hashFunc, WithSortedLeaves(), WithUniqueLeaves())
+	err = expected.Generate(sorted[:4], 8)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.RootHash(), tree.RootHash())
+}
+
+func TestGenerateFuncReplay(t *testing.T) {
+	//values of any size, with gaps left unset
+	valueAt := func(index uint) ([]byte, bool) {
+		if index == 0 || index == 3 || index == 5 {
+			return []byte{byte(index)}, true
+		}
+		return nil, false
+	}
+	for _, opts := range [][]Option{
+		{WithOperationLog()},
+		{WithOperationLog(), WithIndexedLeaves()},
+	} {
+		tree := NewSMT(emptyHash, hashFunc, opts...)
+		err := tree.GenerateFunc(valueAt, 8)
+		assert.Nil(t, err)
+		replayed, err := ReplayLog(tree.OperationLog(), emptyHash, hashFunc, opts...)
+		assert.Nil(t, err)
+		assert.Equal(t, tree.RootHash(), replayed.RootHash())
+		assert.Equal(t, tree.fullNodes, replayed.fullNodes)
+		assert.Equal(t, tree.unsetLeaves, replayed.unsetLeaves)
+		assert.Equal(t, tree.RemainingCapacity(), replayed.RemainingCapacity())
+	}
+	indexed := NewSMT(emptyHash, hashFunc, WithOperationLog(), WithIndexedLeaves())
+	err := indexed.GenerateFunc(valueAt, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, indexed.RemainingCapacity())
+	log := indexed.OperationLog()
+	assert.Equal(t, OpGenerateFunc, log[0].Kind)
+	assert.Equal(t, []uint{1, 2, 4}, log[0].Gaps)
+
+	log[0].Gaps = []uint{7}
+	_, err = ReplayLog(log, emptyHash, hashFunc, WithIndexedLeaves())
+	assert.Equal(t, "Gap is beyond the stored leaves", err.Error())
+}
+
+func TestQuickCheck(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	assert.Nil(t, tree.QuickCheck())
+	for _, count := range []int{0, 1, 5, 15, 16} {
+		tree := NewSMT(emptyHash, hashFunc)
+		err := tree.Generate(testHashes[:count], 16)
+		assert.Nil(t, err)
+		assert.Nil(t, tree.QuickCheck())
+	}
+	err := tree.Generate(testHashes[:3], 16)
+	assert.Nil(t, err)
+	_, err = tree.AppendLeaves(testHashes[3:12])
+	assert.Nil(t, err)
+	assert.Nil(t, tree.QuickCheck())
+
+	corrupt := func(change func(tree *SMT)) error {
+		tree := NewSMT(emptyHash, hashFunc)
+		err := tree.Generate(testHashes[:5], 16)
+		assert.Nil(t, err)
+		change(tree)
+		return tree.QuickCheck()
+	}
+	err = corrupt(func(tree *SMT) { tree.treeHeight = 6 })
+	assert.Equal(t, "Tree has 5 stored levels, expected 6", err.Error())
+	err = corrupt(func(tree *SMT) { tree.treeHeight = 100 })
+	assert.Equal(t, "Tree height is out of range", err.Error())
+	err = corrupt(func(tree *SMT) { tree.fullNodes[0] = tree.fullNodes[0][:4] })
+	assert.Equal(t, "Stored leaves do not match the non empty leaves count", err.Error())
+	err = corrupt(func(tree *SMT) { tree.fullNodes[2] = append(tree.fullNodes[2], tree.fullNodes[2][0]) })
+	assert.Equal(t, "Stored row at height 2 has 3 nodes, expected 2", err.Error())
+	err = corrupt(func(tree *SMT) { tree.emptyTreeRootHash = tree.emptyTreeRootHash[:2] })
+	assert.Equal(t, "Empty subtree roots are missing", err.Error())
+	err = corrupt(func(tree *SMT) {
+		for _, leaf := range testHashes[:12] {
+			tree.fullNodes[0] = append(tree.fullNodes[0], leaf)
+		}
+		tree.countOfNonEmptyLeaves = 17
+	})
+	assert.Equal(t, "NonEmptyLeaves is bigger than totalSize", err.Error())
+	err = corrupt(func(tree *SMT) { tree.fullNodes = [][]Hash{} })
+	assert.Equal(t, "Unfilled tree has non empty leaves", err.Error())
+}
+
+func TestHashSize(t *testing.T) {
+	for _, hashFunc := range []hash.Hash{md5.New(), sha1.New(), sha256.New(), sha512.New()} {
+		tree := NewSMT(emptyHash, hashFunc)
+		assert.Equal(t, hashFunc.Size(), tree.HashSize())
+		err := tree.Generate(testHashes[:3], 4)
+		assert.Nil(t, err)
+		assert.Equal(t, tree.HashSize(), len(tree.RootHash()))
+	}
+	tree := NewSMT(emptyHash, sha256.New(), WithLeafHash(md5.New))
+	assert.Equal(t, 32, tree.HashSize())
+}
+
+func TestGetSampleProofs(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc, WithIndexedLeaves())
+	err := tree.Generate(testHashes[:12], 16)
+	assert.Nil(t, err)
+	sample, err := tree.GetSampleProofs(5, 42)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(sample))
+	for leafNo, proof := range sample {
+		assert.True(t, leafNo < 12)
+		assert.Nil(t, VerifyProof(testHashes[leafNo], leafNo, proof, tree.RootHash(), hashFunc))
+	}
+
+	//the same seed samples the same leaves
+	again, err := tree.GetSampleProofs(5, 42)
+	assert.Nil(t, err)
+	assert.Equal(t, sample, again)
+	other, err := tree.GetSampleProofs(5, 43)
+	assert.Nil(t, err)
+	assert.NotEqual(t, sample, other)
+
+	//the whole set can be sampled, skipping unset positions
+	err = tree.DeleteLeaf(3)
+	assert.Nil(t, err)
+	all, err := tree.GetSampleProofs(11, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, 11, len(all))
+	_, sampled := all[3]
+	assert.False(t, sampled)
+	for leafNo, proof := range all {
+		assert.Nil(t, VerifyProof(testHashes[leafNo], leafNo, proof, tree.RootHash(), hashFunc))
+	}
+
+	_, err = tree.GetSampleProofs(12, 7)
+	assert.Equal(t, "Sample size is out of range", err.Error())
+	_, err = NewSMT(emptyHash, hashFunc).GetSampleProofs(1, 7)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+}
+
+func TestUniqueLeaves(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc, WithUniqueLeaves())
+	err := tree.Generate(testHashes[:10], 16)
+	assert.Nil(t, err)
+
+	leaves := [][]byte{testHashes[0], testHashes[1], testHashes[2], testHashes[1], testHashes[0]}
+	tree = NewSMT(emptyHash, hashFunc, WithUniqueLeaves())
+	err = tree.Generate(leaves, 8)
+	assert.Equal(t, &DuplicateLeafError{First: 1, Second: 3}, err)
+	assert.Equal(t, "Leaves 1 and 3 are equal", err.Error())
+	assert.Nil(t, tree.RootHash())
+
+	//duplicates are allowed without the option
+	tree = NewSMT(emptyHash, hashFunc)
+	err = tree.Generate(leaves, 8)
+	assert.Nil(t, err)
+}
@@ -7,13 +7,50 @@ package merkle
 
 type Hash []byte
 
+// ProofNode is one sibling on the path from a leaf to the root. Left reports
+// the side of the sibling, not of the node being proven: when Left is true the
+// parent is hash(Hash || current), otherwise it is hash(current || Hash).
+// Proofs are ordered bottom up: the sibling of the leaf comes first and the
+// child of the root last, see NormalizeProof for proofs from other tools
 type ProofNode struct {
 	Left bool
 	Hash []byte
 }
 
+// SelfLeft reports whether the node being proven is the left child at this
+// level, i.e. whether it is hashed before the sibling
+func (node ProofNode) SelfLeft() bool {
+	return !node.Left
+}
+
+// CompressedProofNode is a ProofNode whose hash may be omitted when the
+// sibling is the root of an empty subtree, which Empty flags. See ExpandProof
+type CompressedProofNode struct {
+	Left  bool
+	Hash  []byte
+	Empty bool
+}
+
+// CoordProofNode is a ProofNode together with the coordinate of the sibling,
+// level 0 being the root as in NodeHash, so siblings shared by the proofs of
+// several leaves can be cached once
+type CoordProofNode struct {
+	Left  bool
+	Hash  []byte
+	Level int
+	Index int
+}
+
+// MerkleTree is the common interface of the tree implementations, so callers
+// can swap or mock them
 type MerkleTree interface {
 	Generate(leaves [][]byte, totalLeavesSize int) error
 	RootHash() []byte
 	GetMerkleProof(leafIndex uint) ([]ProofNode, error)
 }
+
+var (
+	_ MerkleTree = (*SMT)(nil)
+	_ MerkleTree = (*Tree)(nil)
+	_ MerkleTree = (*LowMemorySMT)(nil)
+)
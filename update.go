@@ -0,0 +1,133 @@
+package merkle
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+)
+
+// UpdateProof shows that leaf LeafNo held OldLeaf under one root and NewLeaf
+// under another while every other leaf stayed the same: both leaves fold into
+// their root with the same siblings
+type UpdateProof struct {
+	LeafNo   uint
+	OldLeaf  Hash
+	NewLeaf  Hash
+	Siblings []ProofNode
+}
+
+// GetUpdateProof proves the transition of leaf leafNo from oldTree to this
+// tree. Both trees must have the same capacity, hash algorithm and empty
+// leaf, and must not bind the capacity into the root, salt their nodes or
+// combine them with WithCombiner. It fails if any other leaf differs between
+// them
+func (self *SMT) GetUpdateProof(leafNo uint, oldTree *SMT) (UpdateProof, error) {
+	if err := self.Compatible(oldTree); err != nil {
+		return UpdateProof{}, err
+	}
+	if self.capacityInRoot || oldTree.capacityInRoot {
+		return UpdateProof{}, errors.New("Update proofs do not support capacity bound roots")
+	}
+	if self.rootTag != nil || oldTree.rootTag != nil {
+		return UpdateProof{}, errors.New("Update proofs do not support tagged roots")
+	}
+	if self.salt != nil || oldTree.salt != nil {
+		return UpdateProof{}, errors.New("Update proofs do not support salted nodes")
+	}
+	if self.combiner != nil || oldTree.combiner != nil {
+		return UpdateProof{}, errors.New("Update proofs do not support node combiners")
+	}
+	oldSiblings, oldLeaf, err := oldTree.leafAndProof(leafNo)
+	if err != nil {
+		return UpdateProof{}, err
+	}
+	siblings, newLeaf, err := self.leafAndProof(leafNo)
+	if err != nil {
+		return UpdateProof{}, err
+	}
+	if DivergenceLevel(oldSiblings, siblings) != -1 {
+		return UpdateProof{}, errors.New("Trees differ in more than the proven leaf")
+	}
+	return UpdateProof{LeafNo: leafNo, OldLeaf: oldLeaf, NewLeaf: newLeaf, Siblings: siblings}, nil
+}
+
+// GetTransitionSiblings returns the siblings of leaf leafNo, which are the
+// same whether the leaf is present or empty: folding the leaf with them gives
+// the root with the leaf present, folding the empty leaf gives the root with
+// it absent. Trees binding the capacity into the root or seeding empty nodes
+// are rejected, their roots do not fold that way
+func (self *SMT) GetTransitionSiblings(leafNo uint) ([]ProofNode, error) {
+	if self.capacityInRoot {
+		return nil, errors.New("Transition siblings do not support capacity bound roots")
+	}
+	if self.rootTag != nil {
+		return nil, errors.New("Transition siblings do not support tagged roots")
+	}
+	if self.emptyNodeSeed != nil {
+		return nil, errors.New("Transition siblings do not support seeded empty nodes")
+	}
+	return self.GetMerkleProof(leafNo)
+}
+
+// VerifyUpdateProof checks that proof takes oldRoot to newRoot by changing
+// its leaf alone. The siblings must match the directions of LeafNo
+func VerifyUpdateProof(proof UpdateProof, oldRoot []byte, newRoot []byte, hashFunc hash.Hash) error {
+	if err := verifyPositionedProof(proof.OldLeaf, proof.LeafNo, proof.Siblings, oldRoot, hashFunc); err != nil {
+		return err
+	}
+	return verifyPositionedProof(proof.NewLeaf, proof.LeafNo, proof.Siblings, newRoot, hashFunc)
+}
+
+// Compatible returns why proofs of other cannot be compared with proofs of
+// this tree, naming the first difference, or nil if they can: both must be
+// filled and share capacity, hash output size, hash algorithm and empty leaf
+func (self *SMT) Compatible(other *SMT) error {
+	selfHeight, selfHash, selfEmpty := self.identity()
+	otherHeight, otherHash, otherEmpty := other.identity()
+	if selfHeight == 0 || otherHeight == 0 {
+		return errors.New("SMT tree is not filled")
+	}
+	if selfHeight != otherHeight {
+		return errors.New("Trees have different capacities")
+	}
+	if self.hashFunc.Size() != other.hashFunc.Size() {
+		return errors.New("Trees have different hash sizes")
+	}
+	if selfHash != otherHash {
+		return errors.New("Trees use different hash algorithms")
+	}
+	if !bytes.Equal(selfEmpty, otherEmpty) {
+		return errors.New("Trees use different empty leaves")
+	}
+	return nil
+}
+
+// Following are non public function
+
+// Returns the tree height, hash algorithm and empty leaf, a zero height if
+// the tree is not filled
+func (self *SMT) identity() (int, string, Hash) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return 0, "", nil
+	}
+	return self.treeHeight, hashAlgorithmID(self.hashFunc), self.emptyTreeRootHash[0]
+}
+
+// Returns the proof and the stored hash of a leaf as of one point in time
+func (self *SMT) leafAndProof(leafNo uint) ([]ProofNode, Hash, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return nil, nil, errors.New("SMT tree is not filled")
+	}
+	if leafNo >= uint(self.capacity()) {
+		return nil, nil, errors.New("Leaf number is out of range")
+	}
+	proof, err := self.getMerkleProof(leafNo)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proof, self.nodeHash(self.treeHeight-1, int(leafNo)), nil
+}
@@ -0,0 +1,147 @@
+package merkle
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"github.com/stretchr/testify/assert"
+	"hash"
+	"testing"
+)
+
+func TestUpdateProof(t *testing.T) {
+	oldTree := NewSMT(emptyHash, hashFunc)
+	err := oldTree.Generate(testHashes[:6], 8)
+	assert.Nil(t, err)
+	newTree := NewSMT(emptyHash, hashFunc)
+	err = newTree.Generate(testHashes[:6], 8)
+	assert.Nil(t, err)
+	err = newTree.UpdateLeaf(2, testHashes[12])
+	assert.Nil(t, err)
+
+	proof, err := newTree.GetUpdateProof(2, oldTree)
+	assert.Nil(t, err)
+	assert.Equal(t, Hash(testHashes[2]), proof.OldLeaf)
+	assert.Equal(t, Hash(testHashes[12]), proof.NewLeaf)
+	assert.Nil(t, VerifyUpdateProof(proof, oldTree.RootHash(), newTree.RootHash(), hashFunc))
+	assert.NotNil(t, VerifyUpdateProof(proof, newTree.RootHash(), oldTree.RootHash(), hashFunc))
+
+	//the proof is bound to its leaf number
+	relabelled := proof
+	relabelled.LeafNo = 1
+	err = VerifyUpdateProof(relabelled, oldTree.RootHash(), newTree.RootHash(), hashFunc)
+	assert.Equal(t, errDirectionMismatch, err)
+
+	//the change is not attributed to another leaf
+	_, err = newTree.GetUpdateProof(3, oldTree)
+	assert.Equal(t, "Trees differ in more than the proven leaf", err.Error())
+
+	//a second changed leaf shows up in the siblings
+	err = newTree.UpdateLeaf(5, testHashes[13])
+	assert.Nil(t, err)
+	_, err = newTree.GetUpdateProof(2, oldTree)
+	assert.Equal(t, "Trees differ in more than the proven leaf", err.Error())
+	siblings, err := newTree.GetMerkleProof(2)
+	assert.Nil(t, err)
+	forged := UpdateProof{LeafNo: 2, OldLeaf: testHashes[2], NewLeaf: testHashes[12], Siblings: siblings}
+	assert.NotNil(t, VerifyUpdateProof(forged, oldTree.RootHash(), newTree.RootHash(), hashFunc))
+
+	_, err = newTree.GetUpdateProof(8, oldTree)
+	assert.Equal(t, "Leaf number is out of range", err.Error())
+
+	larger := NewSMT(emptyHash, hashFunc)
+	err = larger.Generate(testHashes[:6], 16)
+	assert.Nil(t, err)
+	_, err = larger.GetUpdateProof(2, oldTree)
+	assert.Equal(t, "Trees have different capacities", err.Error())
+	other := NewSMT(emptyHash, sha256.New())
+	err = other.Generate(testHashes[:6], 8)
+	assert.Nil(t, err)
+	_, err = other.GetUpdateProof(2, oldTree)
+	assert.Equal(t, "Trees have different hash sizes", err.Error())
+	_, err = NewSMT(emptyHash, hashFunc).GetUpdateProof(2, oldTree)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+	bound := NewSMT(emptyHash, hashFunc, WithCapacityInRoot())
+	err = bound.Generate(testHashes[:6], 8)
+	assert.Nil(t, err)
+	_, err = bound.GetUpdateProof(2, oldTree)
+	assert.Equal(t, "Update proofs do not support capacity bound roots", err.Error())
+	salted := NewSMT(emptyHash, hashFunc, WithSalt([]byte("salt")))
+	err = salted.Generate(testHashes[:6], 8)
+	assert.Nil(t, err)
+	_, err = salted.GetUpdateProof(2, oldTree)
+	assert.Equal(t, "Update proofs do not support salted nodes", err.Error())
+	_, err = oldTree.GetUpdateProof(2, salted)
+	assert.Equal(t, "Update proofs do not support salted nodes", err.Error())
+	combined := NewSMT(emptyHash, hashFunc, WithCombiner(swapCombiner))
+	err = combined.Generate(testHashes[:6], 8)
+	assert.Nil(t, err)
+	_, err = combined.GetUpdateProof(2, oldTree)
+	assert.Equal(t, "Update proofs do not support node combiners", err.Error())
+}
+
+func TestGetTransitionSiblings(t *testing.T) {
+	before := NewSMT(emptyHash, hashFunc)
+	err := before.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	after := NewSMT(emptyHash, hashFunc)
+	err = after.Generate(testHashes[:6], 8)
+	assert.Nil(t, err)
+
+	siblings, err := before.GetTransitionSiblings(5)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyProof(emptyHash, 5, siblings, before.RootHash(), hashFunc))
+	assert.Nil(t, VerifyProof(testHashes[5], 5, siblings, after.RootHash(), hashFunc))
+
+	//the siblings of a present leaf also give the root without it
+	siblings, err = after.GetTransitionSiblings(5)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyProof(emptyHash, 5, siblings, before.RootHash(), hashFunc))
+
+	for _, opt := range []Option{WithCapacityInRoot(), WithEmptyNodeSeed([]byte("seed"))} {
+		tree := NewSMT(emptyHash, hashFunc, opt)
+		err = tree.Generate(testHashes[:5], 8)
+		assert.Nil(t, err)
+		_, err = tree.GetTransitionSiblings(5)
+		assert.NotNil(t, err)
+	}
+
+	full := NewSMT(emptyHash, hashFunc)
+	err = full.Generate(testHashes[:8], 8)
+	assert.Nil(t, err)
+	for _, tree := range []*SMT{before, full} {
+		_, err = tree.GetTransitionSiblings(8)
+		assert.Equal(t, "Leaf number is out of range", err.Error())
+	}
+}
+
+func TestCompatible(t *testing.T) {
+	generate := func(emptyHash Hash, hashFunc hash.Hash, size int) *SMT {
+		tree := NewSMT(emptyHash, hashFunc)
+		err := tree.Generate(nil, size)
+		assert.Nil(t, err)
+		return tree
+	}
+	tree := generate(emptyHash, hashFunc, 8)
+	assert.Nil(t, tree.Compatible(generate(emptyHash, md5.New(), 8)))
+
+	cases := []struct {
+		other    *SMT
+		expected string
+	}{
+		{NewSMT(emptyHash, hashFunc), "SMT tree is not filled"},
+		{generate(emptyHash, hashFunc, 16), "Trees have different capacities"},
+		{generate(emptyHash, sha256.New(), 8), "Trees have different hash sizes"},
+		{generate(testHashes[0], hashFunc, 8), "Trees use different empty leaves"},
+	}
+	for _, c := range cases {
+		err := tree.Compatible(c.other)
+		assert.Equal(t, c.expected, err.Error())
+		err = c.other.Compatible(tree)
+		assert.Equal(t, c.expected, err.Error())
+	}
+
+	//same sizes, different algorithms
+	err := generate(emptyHash, sha256.New(), 8).Compatible(generate(emptyHash, sha512.New512_256(), 8))
+	assert.Equal(t, "Trees use different hash algorithms", err.Error())
+}
@@ -24,6 +24,14 @@ func nextPowerOfTwo(n uint64) uint64 {
 	return n
 }
 
+// NextCapacity returns the smallest power of 2 that can hold n leaves
+func NextCapacity(n int) int {
+	if n <= 0 {
+		return 1
+	}
+	return int(nextPowerOfTwo(uint64(n)))
+}
+
 // Lookup table for integer log2 implementation
 var log2lookup []uint64 = []uint64{
 	0xFFFFFFFF00000000,
@@ -0,0 +1,370 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// DefaultMaxProofNodes is the longest proof accepted by the package level
+// verification functions and by a Verifier without WithMaxProofNodes
+const DefaultMaxProofNodes = 256
+
+// A Verifier checks proofs against roots without holding a tree. It applies
+// a limit on the proof length so untrusted proofs cannot make it hash for an
+// arbitrarily long time
+type Verifier struct {
+	hashFunc hash.Hash
+	// Running hash storage kept across calls with WithReusableBuffer
+	buffer []byte
+	config
+}
+
+// NewVerifier returns a verifier hashing internal nodes with hashFunc. It
+// panics if given an option that only applies to trees, such as
+// WithPaddingLeaf, rather than silently verifying as if it was not set; use
+// NewVerifierE for options not known in advance
+func NewVerifier(hashFunc hash.Hash, opts ...Option) *Verifier {
+	verifier, err := NewVerifierE(hashFunc, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return verifier
+}
+
+// NewVerifierE is NewVerifier returning an error instead of panicking on an
+// option that only applies to trees
+func NewVerifierE(hashFunc hash.Hash, opts ...Option) (*Verifier, error) {
+	verifier := &Verifier{hashFunc: hashFunc}
+	verifier.maxProofNodes = DefaultMaxProofNodes
+	verifier.maxLeafIndex = ^uint(0)
+	for _, opt := range opts {
+		opt(&verifier.config)
+	}
+	if name := treeOnlyOption(&verifier.config); name != "" {
+		return nil, fmt.Errorf("%s is not supported by Verifier", name)
+	}
+	return verifier, nil
+}
+
+// WithHash returns a verifier with the same options hashing internal nodes
+// with hashFunc, for proofs of trees built with another algorithm than the
+// one of this verifier. The package level functions take the hash of every
+// call instead
+func (self *Verifier) WithHash(hashFunc hash.Hash) *Verifier {
+	return &Verifier{hashFunc: hashFunc, config: self.config}
+}
+
+// VerifyProof checks that folding leafHash with proof yields root, see the
+// package level VerifyProof
+func (self *Verifier) VerifyProof(leafHash Hash, leafNo uint, proof []ProofNode, root []byte) error {
+	if err := self.checkLeaf(leafHash, leafNo); err != nil {
+		return err
+	}
+	if err := checkProofLength(len(proof), self.maxProofNodes); err != nil {
+		return err
+	}
+	if self.strict && !directionsMatch(leafNo, proof) {
+		return errDirectionMismatch
+	}
+	var buffer []byte
+	if self.reusableBuffer {
+		buffer = self.buffer
+	}
+	combine := self.combine()
+	computed, err := foldProofTo(buffer, leafHash, proof, self.hashFunc, combine)
+	if err != nil {
+		return err
+	}
+	// Only a hash folded into the buffer is ours to keep: an empty proof
+	// yields the caller's leaf hash, a combiner its own output
+	if self.reusableBuffer && len(proof) > 0 && combine == nil {
+		self.buffer = computed[:0]
+	}
+	computed, err = self.finalizeRoot(computed, len(proof))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(computed, root) {
+		return &ProofMismatchError{Index: len(proof) - 1}
+	}
+	return nil
+}
+
+// VerifyLeaf checks the proof of a raw leaf, storing it the way the tree
+// does: hashed with the leaf hash of WithLeafHash, and bound to leafNo with
+// WithLeafIndexBinding
+func (self *Verifier) VerifyLeaf(leaf []byte, leafNo uint, proof []ProofNode, root []byte) error {
+	leafHash, err := self.storedLeaf(leafNo, leaf)
+	if err != nil {
+		return err
+	}
+	return self.VerifyProof(leafHash, leafNo, proof, root)
+}
+
+// BatchItem is one proof of a batch verified by VerifyBatch
+type BatchItem struct {
+	LeafHash Hash
+	LeafNo   uint
+	Proof    []ProofNode
+}
+
+// VerifyBatch verifies every item against root. It returns the result of
+// each item, nil if its proof is valid, and the index of the first invalid
+// one or -1. With WithFailFast it stops there, and the results end with the
+// failing item
+func (self *Verifier) VerifyBatch(items []BatchItem, root []byte) ([]error, int) {
+	results := make([]error, 0, len(items))
+	failed := -1
+	for i, item := range items {
+		err := self.VerifyProof(item.LeafHash, item.LeafNo, item.Proof, root)
+		results = append(results, err)
+		if err != nil && failed == -1 {
+			failed = i
+			if self.failFast {
+				break
+			}
+		}
+	}
+	return results, failed
+}
+
+// VerifyProofStream reads and verifies a proof written by WriteProof, see the
+// package level VerifyProofStream. The node count announced by the stream is
+// checked before any node is read
+func (self *Verifier) VerifyProofStream(leafHash Hash, leafNo uint, r io.Reader, expectedRoot []byte) error {
+	if err := self.checkLeaf(leafHash, leafNo); err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return streamError(err)
+	}
+	count := binary.BigEndian.Uint32(header)
+	if uint64(count) > uint64(self.maxProofNodes) {
+		return errTooManyProofNodes
+	}
+
+	current := []byte(leafHash)
+	record := make([]byte, 1+self.hashFunc.Size())
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(r, record); err != nil {
+			return streamError(err)
+		}
+		node, err := parseStandardRecord(record)
+		if err != nil {
+			return err
+		}
+		if self.strict && node.Left != ((leafNo>>i)&1 == 1) {
+			return errDirectionMismatch
+		}
+		current, err = foldProofTo(nil, current, []ProofNode{node}, self.hashFunc, self.combine())
+		if err != nil {
+			return err
+		}
+	}
+	if self.strict && leafNo>>count != 0 {
+		return errDirectionMismatch
+	}
+	current, err := self.finalizeRoot(current, int(count))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(current, expectedRoot) {
+		return &ProofMismatchError{Index: int(count) - 1}
+	}
+	return nil
+}
+
+// StreamVerifier checks leaves received one at a time against a committed
+// root, and that together they form the non empty leaves of the tree: they
+// must arrive in order from leaf 0, and Done checks that the proof of the last
+// one shows only empty subtrees right of it. Raw leaves are stored as with
+// Verifier.VerifyLeaf. It is not safe for concurrent use
+type StreamVerifier struct {
+	verifier  *Verifier
+	root      []byte
+	emptyHash Hash
+	next      uint
+	lastProof []ProofNode
+}
+
+func NewStreamVerifier(root []byte, emptyHash Hash, hashFunc hash.Hash, opts ...Option) *StreamVerifier {
+	return &StreamVerifier{verifier: NewVerifier(hashFunc, opts...), root: root, emptyHash: emptyHash}
+}
+
+// Add verifies the next leaf. leafNo must follow the previous leaf and match
+// the directions of proof, and nothing is recorded if the leaf does not verify
+func (self *StreamVerifier) Add(leafNo uint, leaf []byte, proof []ProofNode) error {
+	if leafNo != self.next {
+		return errors.New("Leaf number does not follow the previous leaves")
+	}
+	if !directionsMatch(leafNo, proof) {
+		return errDirectionMismatch
+	}
+	if err := self.verifier.VerifyLeaf(leaf, leafNo, proof, self.root); err != nil {
+		return err
+	}
+	self.next++
+	self.lastProof = proof
+	return nil
+}
+
+// Done checks that no non empty leaf follows the added ones: every sibling
+// right of the path of the last leaf is the root of an empty subtree
+func (self *StreamVerifier) Done() error {
+	if self.next == 0 {
+		return errors.New("No leaves were verified")
+	}
+	emptyRight, err := isEmptyRight(self.lastProof, self.emptyHash, self.verifier.hashFunc, self.verifier.combine())
+	if err != nil {
+		return err
+	}
+	if !emptyRight {
+		return fmt.Errorf("Leaves are missing after leaf %d", self.next-1)
+	}
+	return nil
+}
+
+// Following are non public function
+
+// Applies the root binding of the tree to the top node folded from a proof of
+// proofLength nodes: the capacity of WithCapacityInRoot, which the proof
+// length implies, then the tag of WithRootTag
+func (self *Verifier) finalizeRoot(top []byte, proofLength int) ([]byte, error) {
+	if self.capacityInRoot {
+		if proofLength >= 63 {
+			return nil, errors.New("Proof length does not match capacity")
+		}
+		var err error
+		top, err = bindCapacity(self.hashFunc, top, 1<<uint(proofLength))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if self.rootTag == nil {
+		return top, nil
+	}
+	return hashPair(self.hashFunc, self.rootTag, top)
+}
+
+// Returns the name of the first option set in c that only applies to trees,
+// or "" if there is none
+func treeOnlyOption(c *config) string {
+	switch {
+	case c.bufferPool != nil:
+		return "WithBufferPool"
+	case c.secureErase:
+		return "WithSecureErase"
+	case c.operationLog:
+		return "WithOperationLog"
+	case c.sortedLeaves:
+		return "WithSortedLeaves"
+	case c.indexedLeaves:
+		return "WithIndexedLeaves"
+	case c.paddingLeaf != nil:
+		return "WithPaddingLeaf"
+	case c.emptyNodeSeed != nil:
+		return "WithEmptyNodeSeed"
+	case c.buildMetrics:
+		return "WithBuildMetrics"
+	case c.expectedLeaves != 0:
+		return "WithExpectedLeaves"
+	case c.leafHashWorkers != 0:
+		return "WithLeafHashWorkers"
+	case c.uniformLevels:
+		return "WithUniformLevels"
+	case c.hexPrefix:
+		return "WithHexPrefix"
+	case c.allowRebuild:
+		return "WithAllowRebuild"
+	case c.uniformLeafSize:
+		return "WithUniformLeafSize"
+	case c.emptyLeafHook != nil:
+		return "WithEmptyLeafProofHook"
+	case c.emptyChain != nil:
+		return "WithEmptyChain"
+	case c.uniqueLeaves:
+		return "WithUniqueLeaves"
+	}
+	return ""
+}
+
+// Returns true if every right sibling of proof is the root of an empty
+// subtree of emptyHash leaves, hashed with combine if not nil
+func isEmptyRight(proof []ProofNode, emptyHash Hash, hashFunc hash.Hash, combine func(left, right []byte) ([]byte, error)) (bool, error) {
+	empty := []byte(emptyHash)
+	for i, node := range proof {
+		if !node.Left && !bytes.Equal(node.Hash, empty) {
+			return false, nil
+		}
+		if i == len(proof)-1 {
+			break
+		}
+		var err error
+		if combine != nil {
+			empty, err = combine(empty, empty)
+		} else {
+			empty, err = hashPair(hashFunc, empty, empty)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Returns the stored form of the raw leaf at leafNo
+func (self *Verifier) storedLeaf(leafNo uint, leaf []byte) (Hash, error) {
+	switch {
+	case self.leafHashFactory != nil && self.leafIndexBound:
+		return hashBoundLeaf(self.leafHashFactory(), leafNo, leaf)
+	case self.leafHashFactory != nil:
+		return hashLeaf(self.leafHashFactory(), leaf)
+	case self.leafIndexBound:
+		return hashBoundLeaf(self.hashFunc, leafNo, leaf)
+	}
+	return leaf, nil
+}
+
+var (
+	errTooManyProofNodes = errors.New("Proof has too many nodes")
+	errDirectionMismatch = errors.New("Proof directions do not match the leaf number")
+	errLeafIndexTooLarge = errors.New("Leaf number exceeds the maximum leaf index")
+	errLeafPrefix        = errors.New("Leaf does not have the required prefix")
+)
+
+// Applies the policy checks on the leaf
+func (self *Verifier) checkLeaf(leafHash Hash, leafNo uint) error {
+	if leafNo > self.maxLeafIndex {
+		return errLeafIndexTooLarge
+	}
+	if !bytes.HasPrefix(leafHash, self.leafPrefix) {
+		return errLeafPrefix
+	}
+	return nil
+}
+
+// Returns how the verifier combines two children instead of hashing their
+// concatenation, nil for the plain hash
+func (self *Verifier) combine() func(left, right []byte) ([]byte, error) {
+	if self.combiner != nil {
+		return self.combiner
+	}
+	if self.salt != nil {
+		return func(left, right []byte) ([]byte, error) {
+			return saltedHashPair(self.hashFunc, self.salt, left, right)
+		}
+	}
+	return nil
+}
+
+func checkProofLength(length int, max int) error {
+	if length > max {
+		return errTooManyProofNodes
+	}
+	return nil
+}
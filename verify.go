@@ -0,0 +1,601 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+)
+
+// ProofMismatchError reports the position of the first ProofNode at which
+// the reconstructed hash diverged from the expected one
+type ProofMismatchError struct {
+	Index int
+}
+
+func (e *ProofMismatchError) Error() string {
+	return fmt.Sprintf("Proof mismatch at node %d", e.Index)
+}
+
+// DuplicateLeafError reports the indices of two equal input leaves rejected
+// by WithUniqueLeaves
+type DuplicateLeafError struct {
+	First  int
+	Second int
+}
+
+func (e *DuplicateLeafError) Error() string {
+	return fmt.Sprintf("Leaves %d and %d are equal", e.First, e.Second)
+}
+
+// VerifyProof checks that folding leafHash with proof yields root. A standalone
+// verifier only knows the final hash, so a mismatch is always reported at the
+// last proof node
+func VerifyProof(leafHash Hash, leafNo uint, proof []ProofNode, root []byte, hashFunc hash.Hash) error {
+	return NewVerifier(hashFunc).VerifyProof(leafHash, leafNo, proof, root)
+}
+
+// VerifyProof32 is VerifyProof for 32 byte hashes, working on arrays to avoid
+// allocating per level. dirs[i] is the Left flag of proof[i]. It returns false
+// for a hash of another size, dirs not matching leafNo or proof, or a proof
+// longer than DefaultMaxProofNodes
+func VerifyProof32(leaf [32]byte, leafNo uint, proof [][32]byte, dirs []bool, root [32]byte, h func() hash.Hash) bool {
+	if len(dirs) != len(proof) || len(proof) > DefaultMaxProofNodes {
+		return false
+	}
+	for i, left := range dirs {
+		if left != ((leafNo>>uint(i))&1 == 1) {
+			return false
+		}
+	}
+	if leafNo>>uint(len(dirs)) != 0 {
+		return false
+	}
+	hashFunc := h()
+	if hashFunc.Size() != 32 {
+		return false
+	}
+	// One buffer holds the pair and, after it, the sum
+	buffer := make([]byte, 64, 96)
+	current := leaf
+	for i := range proof {
+		if dirs[i] {
+			copy(buffer[:32], proof[i][:])
+			copy(buffer[32:], current[:])
+		} else {
+			copy(buffer[:32], current[:])
+			copy(buffer[32:], proof[i][:])
+		}
+		hashFunc.Reset()
+		hashFunc.Write(buffer)
+		copy(current[:], hashFunc.Sum(buffer)[64:])
+	}
+	return current == root
+}
+
+// VerifyBatch verifies every item against root, see Verifier.VerifyBatch
+func VerifyBatch(items []BatchItem, root []byte, hashFunc hash.Hash) ([]error, int) {
+	return NewVerifier(hashFunc).VerifyBatch(items, root)
+}
+
+// VerifyProofExpectHeight is VerifyProof for a tree known to have
+// expectedHeight levels, leaves included: proofs of any other length than
+// expectedHeight-1 are rejected before hashing
+func VerifyProofExpectHeight(leafHash Hash, leafNo uint, proof []ProofNode, root []byte, expectedHeight int, hashFunc hash.Hash) error {
+	if len(proof) != expectedHeight-1 {
+		return errors.New("Proof length does not match tree height")
+	}
+	return VerifyProof(leafHash, leafNo, proof, root, hashFunc)
+}
+
+// VerifyProofSplit is VerifyProof for proofs carried as parallel slices:
+// directions[i] is the Left flag of siblings[i]. Without a leaf number the
+// directions are trusted as given
+func VerifyProofSplit(leafHash Hash, siblings []Hash, directions []bool, root []byte, hashFunc hash.Hash) error {
+	if len(siblings) != len(directions) {
+		return errors.New("Siblings and directions have different lengths")
+	}
+	if err := checkProofLength(len(siblings), DefaultMaxProofNodes); err != nil {
+		return err
+	}
+	current := []byte(leafHash)
+	for i, sibling := range siblings {
+		var err error
+		if directions[i] {
+			current, err = hashPair(hashFunc, sibling, current)
+		} else {
+			current, err = hashPair(hashFunc, current, sibling)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(current, root) {
+		return &ProofMismatchError{Index: len(siblings) - 1}
+	}
+	return nil
+}
+
+// VerifyAgainstRoots computes the root implied by the proof once and returns
+// the index of the first candidate root it matches, or -1 if none does
+func VerifyAgainstRoots(leafHash Hash, leafNo uint, proof []ProofNode, roots [][]byte, hashFunc hash.Hash) (int, error) {
+	if err := checkProofLength(len(proof), DefaultMaxProofNodes); err != nil {
+		return -1, err
+	}
+	computed, err := foldProof(leafHash, proof, hashFunc)
+	if err != nil {
+		return -1, err
+	}
+	for i, root := range roots {
+		if bytes.Equal(computed, root) {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// VerifyProofStream reads a proof written by WriteProof from r one node at a
+// time, folding each into the running hash, and checks the result against
+// expectedRoot. Sibling hashes must be hashFunc.Size() bytes long
+func VerifyProofStream(leafHash Hash, leafNo uint, r io.Reader, expectedRoot []byte, hashFunc hash.Hash) error {
+	return NewVerifier(hashFunc).VerifyProofStream(leafHash, leafNo, r, expectedRoot)
+}
+
+// VerifyProofWithCapacity verifies a proof against a root built with
+// WithCapacityInRoot for a tree of the given capacity
+func VerifyProofWithCapacity(leafHash Hash, leafNo uint, proof []ProofNode, root []byte, capacity int, hashFunc hash.Hash) error {
+	return verifyBoundProof(leafHash, leafNo, proof, root, capacity, NewVerifier(hashFunc, WithCapacityInRoot()))
+}
+
+// VerifyTaggedProofWithCapacity verifies a proof against a root built with
+// both WithCapacityInRoot and WithRootTag(tag)
+func VerifyTaggedProofWithCapacity(leafHash Hash, leafNo uint, proof []ProofNode, root []byte, capacity int, tag []byte, hashFunc hash.Hash) error {
+	return verifyBoundProof(leafHash, leafNo, proof, root, capacity, NewVerifier(hashFunc, WithCapacityInRoot(), WithRootTag(tag)))
+}
+
+// VerifyFullSet verifies the proof of every leaf in leaves against root and
+// cross checks that all proofs agree on every node they have in common, so a
+// mutually contradictory set of proofs is rejected even if each proof could be
+// made to verify on its own
+func VerifyFullSet(leaves map[uint]Hash, proofs map[uint][]ProofNode, root []byte, hashFunc hash.Hash) error {
+	if len(leaves) != len(proofs) {
+		return errors.New("Leaves and proofs do not match")
+	}
+	leafNos := make([]uint, 0, len(leaves))
+	for leafNo := range leaves {
+		leafNos = append(leafNos, leafNo)
+	}
+	sort.Slice(leafNos, func(i, j int) bool { return leafNos[i] < leafNos[j] })
+
+	type coordinate struct {
+		height int
+		index  uint
+	}
+	known := map[coordinate]Hash{}
+	agree := func(height int, index uint, hash Hash) error {
+		key := coordinate{height, index}
+		if previous, ok := known[key]; ok && !bytes.Equal(previous, hash) {
+			return fmt.Errorf("Proofs disagree on node %d at height %d", index, height)
+		}
+		known[key] = hash
+		return nil
+	}
+
+	height := -1
+	for _, leafNo := range leafNos {
+		proof, ok := proofs[leafNo]
+		if !ok {
+			return fmt.Errorf("Missing proof for leaf %d", leafNo)
+		}
+		if height != -1 && len(proof) != height {
+			return errors.New("Proofs have different lengths")
+		}
+		if err := checkProofLength(len(proof), DefaultMaxProofNodes); err != nil {
+			return err
+		}
+		height = len(proof)
+		if !directionsMatch(leafNo, proof) {
+			return errDirectionMismatch
+		}
+
+		current := leaves[leafNo]
+		if err := agree(0, leafNo, current); err != nil {
+			return err
+		}
+		for i, node := range proof {
+			index := leafNo >> uint(i)
+			if err := agree(i, index^1, node.Hash); err != nil {
+				return err
+			}
+			parent, err := foldProof(current, []ProofNode{node}, hashFunc)
+			if err != nil {
+				return err
+			}
+			current = parent
+			if err := agree(i+1, index>>1, current); err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(current, root) {
+			return fmt.Errorf("Proof for leaf %d does not match the root", leafNo)
+		}
+	}
+	return nil
+}
+
+// DivergenceLevel compares the proofs of the same leaf in two trees and
+// returns the index of the lowest proof node, 0 being the sibling of the leaf,
+// at which they differ, or -1 if they are identical. Proofs of different
+// lengths diverge where the shorter one ends at the latest
+func DivergenceLevel(proofA, proofB []ProofNode) int {
+	for i := 0; i < len(proofA) && i < len(proofB); i++ {
+		if proofA[i].Left != proofB[i].Left || !bytes.Equal(proofA[i].Hash, proofB[i].Hash) {
+			return i
+		}
+	}
+	if len(proofA) != len(proofB) {
+		if len(proofA) < len(proofB) {
+			return len(proofA)
+		}
+		return len(proofB)
+	}
+	return -1
+}
+
+// LeafIndexFromProof returns the leaf number implied by the directions of a
+// bottom up proof, least significant bit first: bit i is set when proof[i] is
+// a left sibling, i.e. when the proven node is the right child at that level
+func LeafIndexFromProof(proof []ProofNode) uint {
+	leafNo := uint(0)
+	for i, node := range proof {
+		if node.Left {
+			leafNo |= 1 << uint(i)
+		}
+	}
+	return leafNo
+}
+
+// IsReversedProof reports whether proof is ordered top down for leaf leafNo:
+// its directions only match the leaf number when read from the end. A proof
+// whose directions read the same both ways is never reported as reversed
+func IsReversedProof(leafNo uint, proof []ProofNode) bool {
+	return !directionsMatch(leafNo, proof) && directionsMatch(leafNo, reverseProof(proof))
+}
+
+// NormalizeProof returns proof in the bottom up order the package uses,
+// reversing a copy if it is ordered top down. It fails if the directions match
+// leafNo in neither order. Directions that read the same both ways cannot tell
+// the orders apart, such a proof is returned as is
+func NormalizeProof(leafNo uint, proof []ProofNode) ([]ProofNode, error) {
+	if directionsMatch(leafNo, proof) {
+		return proof, nil
+	}
+	reversed := reverseProof(proof)
+	if !directionsMatch(leafNo, reversed) {
+		return nil, errDirectionMismatch
+	}
+	return reversed, nil
+}
+
+// ExpandProof returns proof with the hashes of Empty flagged nodes filled in.
+// The convention, shared with other implementations, is that node i of a
+// proof (bottom up, 0 being the sibling of the leaf) flagged Empty stands for
+// emptyChain[i], where emptyChain[0] is the empty leaf and emptyChain[i+1] is
+// hash(emptyChain[i] || emptyChain[i]). The hash of a flagged node is ignored.
+// emptyChain must hold at least the empty leaf; missing heights are derived
+// with hashFunc
+func ExpandProof(proof []CompressedProofNode, emptyChain []Hash, hashFunc hash.Hash) ([]ProofNode, error) {
+	if len(emptyChain) == 0 {
+		return nil, errors.New("Empty subtree chain is empty")
+	}
+	if err := checkProofLength(len(proof), DefaultMaxProofNodes); err != nil {
+		return nil, err
+	}
+	chain := emptyChain
+	expanded := make([]ProofNode, 0, len(proof))
+	for i, node := range proof {
+		if !node.Empty {
+			expanded = append(expanded, ProofNode{Left: node.Left, Hash: node.Hash})
+			continue
+		}
+		for len(chain) <= i {
+			last := chain[len(chain)-1]
+			parent, err := hashPair(hashFunc, last, last)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain[:len(chain):len(chain)], parent)
+		}
+		expanded = append(expanded, ProofNode{Left: node.Left, Hash: chain[i]})
+	}
+	return expanded, nil
+}
+
+// VerifyCompressedProof verifies a proof whose empty siblings may be omitted
+// and flagged Empty, see ExpandProof for the convention
+func VerifyCompressedProof(leafHash Hash, leafNo uint, proof []CompressedProofNode, root []byte, emptyChain []Hash, hashFunc hash.Hash) error {
+	expanded, err := ExpandProof(proof, emptyChain, hashFunc)
+	if err != nil {
+		return err
+	}
+	return VerifyProof(leafHash, leafNo, expanded, root, hashFunc)
+}
+
+// VerifyProofLazy verifies the proof of leafNo in a tree of the given height,
+// the number of proof nodes, asking fetchSibling for one sibling at a time,
+// level 0 being the sibling of the leaf. The directions follow leafNo. When
+// fetchSibling reports the sibling as empty the root of the empty subtree of
+// that level, built from emptyHash, is used instead of its hash
+func VerifyProofLazy(leafHash Hash, leafNo uint, height int, fetchSibling func(level int) (Hash, bool, error), expectedRoot []byte, emptyHash Hash, hashFunc hash.Hash) error {
+	if height < 0 {
+		return errors.New("Height must not be negative")
+	}
+	if err := checkProofLength(height, DefaultMaxProofNodes); err != nil {
+		return err
+	}
+	if height < 64 && leafNo>>uint(height) != 0 {
+		return errors.New("Leaf number is out of range")
+	}
+	chain := []Hash{emptyHash}
+	current := []byte(leafHash)
+	for level := 0; level < height; level++ {
+		sibling, empty, err := fetchSibling(level)
+		if err != nil {
+			return err
+		}
+		if empty {
+			for len(chain) <= level {
+				last := chain[len(chain)-1]
+				parent, err := hashPair(hashFunc, last, last)
+				if err != nil {
+					return err
+				}
+				chain = append(chain, parent)
+			}
+			sibling = chain[level]
+		}
+		node := ProofNode{Left: (leafNo>>uint(level))&1 == 1, Hash: sibling}
+		current, err = foldProof(current, []ProofNode{node}, hashFunc)
+		if err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(current, expectedRoot) {
+		return &ProofMismatchError{Index: height - 1}
+	}
+	return nil
+}
+
+// VerifyLeafProof hashes the raw leaf with leafHashFunc and verifies the result
+// against root using nodeHashFunc for the internal nodes, mirroring a tree
+// built with WithLeafHash
+func VerifyLeafProof(leaf []byte, leafNo uint, proof []ProofNode, root []byte, leafHashFunc hash.Hash, nodeHashFunc hash.Hash) error {
+	leafHash, err := hashLeaf(leafHashFunc, leaf)
+	if err != nil {
+		return err
+	}
+	return VerifyProof(leafHash, leafNo, proof, root, nodeHashFunc)
+}
+
+// RootedProof is a proof carrying the root it was made against, so it cannot
+// be checked against an unrelated root by mistake
+type RootedProof struct {
+	LeafNo uint
+	Proof  []ProofNode
+	Root   []byte
+}
+
+// GetRootedProof returns the proof of leafNo together with the current root,
+// both taken at the same point in time. Roots binding the capacity and nodes
+// of WithSalt or WithCombiner are not supported
+func (self *SMT) GetRootedProof(leafNo uint) (RootedProof, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if self.capacityInRoot {
+		return RootedProof{}, errors.New("Rooted proofs do not support capacity bound roots")
+	}
+	if self.rootTag != nil {
+		return RootedProof{}, errors.New("Rooted proofs do not support tagged roots")
+	}
+	if self.salt != nil {
+		return RootedProof{}, errors.New("Rooted proofs do not support salted nodes")
+	}
+	if self.combiner != nil {
+		return RootedProof{}, errors.New("Rooted proofs do not support node combiners")
+	}
+	if len(self.fullNodes) != 0 && leafNo >= uint(self.capacity()) {
+		return RootedProof{}, errors.New("Leaf number is out of range")
+	}
+	proof, err := self.getMerkleProof(leafNo)
+	if err != nil {
+		return RootedProof{}, err
+	}
+	return RootedProof{LeafNo: leafNo, Proof: proof, Root: self.rootHash()}, nil
+}
+
+// VerifyRootedProof checks that proof targets expectedRoot and that leafHash
+// folds into it
+func VerifyRootedProof(leafHash Hash, proof RootedProof, expectedRoot []byte, hashFunc hash.Hash) error {
+	if !bytes.Equal(proof.Root, expectedRoot) {
+		return errors.New("Proof targets a different root")
+	}
+	return VerifyProof(leafHash, proof.LeafNo, proof.Proof, proof.Root, hashFunc)
+}
+
+// VerifyProofDetailed checks a proof against the intermediate hashes stored in
+// the tree. It returns -1 if the proof is valid, otherwise the index of the
+// first ProofNode after which the reconstructed hash diverges, together with
+// a *ProofMismatchError
+func (self *SMT) VerifyProofDetailed(leafHash Hash, leafNo uint, proof []ProofNode) (int, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	if len(self.fullNodes) == 0 {
+		return -1, errors.New("SMT tree is not filled")
+	}
+	if leafNo >= uint(1)<<uint(self.treeHeight-1) {
+		return -1, errors.New("Leaf number is out of range")
+	}
+	if len(proof) != self.treeHeight-1 {
+		return -1, errors.New("Proof length does not match tree height")
+	}
+
+	current := leafHash
+	index := int(leafNo)
+	for i, node := range proof {
+		var err error
+		if node.Left {
+			current, err = self.parentHash(node.Hash, current)
+		} else {
+			current, err = self.parentHash(current, node.Hash)
+		}
+		if err != nil {
+			return -1, err
+		}
+		index = index / 2
+		if !bytes.Equal(current, self.nodeHash(self.treeHeight-2-i, index)) {
+			return i, &ProofMismatchError{Index: i}
+		}
+	}
+	return -1, nil
+}
+
+// Following are non public function
+
+// Folds leafHash with every node in proof, bottom up, and returns the result
+func foldProof(leafHash Hash, proof []ProofNode, hashFunc hash.Hash) ([]byte, error) {
+	return foldProofTo(nil, leafHash, proof, hashFunc, nil)
+}
+
+// Like foldProof, but writes every intermediate hash over the previous one in
+// the storage of buffer, growing it once if it is too small. The running hash
+// is fed to the hash function before the sum is written, so it may share
+// storage with the result. leafHash is never written. A non nil combine
+// replaces the hash of the concatenation and does not use the buffer
+func foldProofTo(buffer []byte, leafHash Hash, proof []ProofNode, hashFunc hash.Hash, combine func(left, right []byte) ([]byte, error)) ([]byte, error) {
+	current := []byte(leafHash)
+	for _, node := range proof {
+		var err error
+		if combine != nil {
+			if node.Left {
+				current, err = combine(node.Hash, current)
+			} else {
+				current, err = combine(current, node.Hash)
+			}
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if node.Left {
+			current, err = hashPairTo(hashFunc, buffer[:0], node.Hash, current)
+		} else {
+			current, err = hashPairTo(hashFunc, buffer[:0], current, node.Hash)
+		}
+		if err != nil {
+			return nil, err
+		}
+		buffer = current
+	}
+	return current, nil
+}
+
+// Checks that proof belongs to a tree of the given capacity before verifying
+// it with verifier, which binds the capacity into the root
+func verifyBoundProof(leafHash Hash, leafNo uint, proof []ProofNode, root []byte, capacity int, verifier *Verifier) error {
+	if len(proof) >= 63 || uint64(capacity) != uint64(1)<<uint(len(proof)) {
+		return errors.New("Proof length does not match capacity")
+	}
+	return verifier.VerifyProof(leafHash, leafNo, proof, root)
+}
+
+// Returns a copy of proof in the opposite order
+func reverseProof(proof []ProofNode) []ProofNode {
+	reversed := make([]ProofNode, len(proof))
+	for i, node := range proof {
+		reversed[len(proof)-1-i] = node
+	}
+	return reversed
+}
+
+// Returns hash(top || big endian uint64 capacity)
+func bindCapacity(hashFunc hash.Hash, top []byte, capacity int) ([]byte, error) {
+	encoded := make([]byte, 8)
+	binary.BigEndian.PutUint64(encoded, uint64(capacity))
+	return hashPair(hashFunc, top, encoded)
+}
+
+// Turns a premature end of the proof stream into a descriptive error
+func streamError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("Proof stream is truncated")
+	}
+	return err
+}
+
+func hashLeaf(hashFunc hash.Hash, leaf []byte) ([]byte, error) {
+	defer hashFunc.Reset()
+
+	_, err := hashFunc.Write(leaf)
+	if err != nil {
+		return []byte{}, err
+	}
+	return checkedSum(hashFunc, nil)
+}
+
+// Returns the hash of leafNo, as a big endian uint64, followed by leaf
+func hashBoundLeaf(hashFunc hash.Hash, leafNo uint, leaf []byte) ([]byte, error) {
+	defer hashFunc.Reset()
+
+	var index [8]byte
+	binary.BigEndian.PutUint64(index[:], uint64(leafNo))
+	for _, item := range [][]byte{index[:], leaf} {
+		if _, err := hashFunc.Write(item); err != nil {
+			return []byte{}, err
+		}
+	}
+	return checkedSum(hashFunc, nil)
+}
+
+func hashPair(hashFunc hash.Hash, item1 []byte, item2 []byte) ([]byte, error) {
+	return hashPairTo(hashFunc, nil, item1, item2)
+}
+
+// Returns the hash of salt || item1 || item2
+func saltedHashPair(hashFunc hash.Hash, salt []byte, item1 []byte, item2 []byte) ([]byte, error) {
+	defer hashFunc.Reset()
+
+	for _, item := range [][]byte{salt, item1, item2} {
+		if _, err := hashFunc.Write(item); err != nil {
+			return []byte{}, err
+		}
+	}
+	return checkedSum(hashFunc, nil)
+}
+
+// Appends the hash of item1 || item2 to dst
+func hashPairTo(hashFunc hash.Hash, dst []byte, item1 []byte, item2 []byte) ([]byte, error) {
+	defer hashFunc.Reset()
+
+	_, err := hashFunc.Write(item1)
+	if err != nil {
+		return []byte{}, err
+	}
+	_, err = hashFunc.Write(item2)
+	if err != nil {
+		return []byte{}, err
+	}
+	return checkedSum(hashFunc, dst)
+}
+
+// Appends the hash to dst, failing if the hash function produced an output
+// of a different length than it announces
+func checkedSum(hashFunc hash.Hash, dst []byte) ([]byte, error) {
+	sum := hashFunc.Sum(dst)
+	if len(sum)-len(dst) != hashFunc.Size() {
+		return []byte{}, errors.New("Hash output size does not match hash size")
+	}
+	return sum, nil
+}
@@ -0,0 +1,1231 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"hash"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestVerifyProof(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+
+	for i := uint(0); i < 8; i++ {
+		leaf := emptyHash
+		if i < 5 {
+			leaf = testHashes[i]
+		}
+		proof, err := tree.GetMerkleProof(i)
+		assert.Nil(t, err)
+		assert.Nil(t, VerifyProof(leaf, i, proof, tree.RootHash(), hashFunc))
+	}
+
+	proof, _ := tree.GetMerkleProof(1)
+	err = VerifyProof(testHashes[2], 1, proof, tree.RootHash(), hashFunc)
+	assert.Equal(t, &ProofMismatchError{Index: 2}, err)
+}
+
+func TestVerifyProofDetailed(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:9], 16)
+	assert.Nil(t, err)
+
+	proof, err := tree.GetMerkleProof(3)
+	assert.Nil(t, err)
+	index, err := tree.VerifyProofDetailed(testHashes[3], 3, proof)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, index)
+
+	for corrupt := 0; corrupt < len(proof); corrupt++ {
+		tampered := append([]ProofNode{}, proof...)
+		tampered[corrupt] = ProofNode{Left: proof[corrupt].Left, Hash: testHashes[15]}
+		index, err := tree.VerifyProofDetailed(testHashes[3], 3, tampered)
+		assert.Equal(t, corrupt, index)
+		assert.Equal(t, &ProofMismatchError{Index: corrupt}, err)
+	}
+
+	index, err = tree.VerifyProofDetailed(testHashes[4], 3, proof)
+	assert.Equal(t, 0, index)
+	assert.NotNil(t, err)
+
+	_, err = tree.VerifyProofDetailed(testHashes[3], 3, proof[:2])
+	assert.Equal(t, "Proof length does not match tree height", err.Error())
+
+	_, err = tree.VerifyProofDetailed(testHashes[3], 16, proof)
+	assert.Equal(t, "Leaf number is out of range", err.Error())
+}
+
+func TestLeafHashSeparateFromNodeHash(t *testing.T) {
+	leafCount, nodeCount := 0, 0
+	leafFactory := func() hash.Hash {
+		return NewHashCountDecorator(sha256.New(), &leafCount)
+	}
+	nodeHash := NewHashCountDecorator(md5.New(), &nodeCount)
+	raw := [][]byte{[]byte("alpha0"), []byte("alpha1"), []byte("alpha2")}
+
+	tree := NewSMT(emptyHash, nodeHash, WithLeafHash(leafFactory))
+	err := tree.Generate(raw, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, leafCount)
+	assert.Equal(t, 2+1, nodeCount)
+
+	leaves := [][]byte{hashValue(raw[0], sha256.New()), hashValue(raw[1], sha256.New()), hashValue(raw[2], sha256.New())}
+	left := hash2Value(leaves[0], leaves[1], md5.New())
+	right := hash2Value(leaves[2], emptyHash, md5.New())
+	assert.Equal(t, hash2Value(left, right, md5.New()), tree.RootHash())
+
+	for i := range raw {
+		proof, err := tree.GetMerkleProof(uint(i))
+		assert.Nil(t, err)
+		assert.Nil(t, VerifyLeafProof(raw[i], uint(i), proof, tree.RootHash(), sha256.New(), md5.New()))
+		assert.NotNil(t, VerifyLeafProof(raw[i], uint(i), proof, tree.RootHash(), md5.New(), md5.New()))
+	}
+
+	_, err = tree.AppendLeaf([]byte("alpha3"))
+	assert.Nil(t, err)
+	proof, err := tree.GetMerkleProof(3)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyLeafProof([]byte("alpha3"), 3, proof, tree.RootHash(), sha256.New(), md5.New()))
+}
+
+func TestVerifyAgainstRoots(t *testing.T) {
+	roots := [][]byte{}
+	for _, count := range []int{3, 4, 5} {
+		tree := NewSMT(emptyHash, hashFunc)
+		err := tree.Generate(testHashes[:count], 8)
+		assert.Nil(t, err)
+		roots = append(roots, tree.RootHash())
+	}
+
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:4], 8)
+	assert.Nil(t, err)
+	proof, err := tree.GetMerkleProof(2)
+	assert.Nil(t, err)
+
+	index, err := VerifyAgainstRoots(testHashes[2], 2, proof, roots, hashFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, index)
+
+	index, err = VerifyAgainstRoots(testHashes[2], 2, proof, [][]byte{roots[0], roots[2]}, hashFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, index)
+
+	index, err = VerifyAgainstRoots(testHashes[2], 2, proof, nil, hashFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, index)
+
+	//the first matching candidate wins
+	index, err = VerifyAgainstRoots(testHashes[2], 2, proof, [][]byte{roots[0], roots[1], roots[1]}, hashFunc)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, index)
+}
+
+func TestProofNodeSides(t *testing.T) {
+	//        root
+	//      /      \
+	//    n01      n23
+	//   /  \     /   \
+	//  l0   l1  l2   l3
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:4], 4)
+	assert.Nil(t, err)
+	n01 := hash2Value(testHashes[0], testHashes[1], hashFunc)
+	n23 := hash2Value(testHashes[2], testHashes[3], hashFunc)
+
+	//l2 is a left child: its sibling l3 is on the right and l2 is hashed first
+	proof, err := tree.GetMerkleProof(2)
+	assert.Nil(t, err)
+	assert.Equal(t, ProofNode{Left: false, Hash: testHashes[3]}, proof[0])
+	assert.True(t, proof[0].SelfLeft())
+	assert.Equal(t, n23, hash2Value(testHashes[2], proof[0].Hash, hashFunc))
+
+	//n23 is a right child: its sibling n01 is on the left and hashed first
+	assert.Equal(t, ProofNode{Left: true, Hash: n01}, proof[1])
+	assert.False(t, proof[1].SelfLeft())
+	assert.Equal(t, tree.RootHash(), hash2Value(proof[1].Hash, n23, hashFunc))
+}
+
+func TestVerifyProofStream(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:9], 16)
+	assert.Nil(t, err)
+
+	for i := uint(0); i < 9; i++ {
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(tree.WriteMerkleProof(writer, i))
+		}()
+		assert.Nil(t, VerifyProofStream(testHashes[i], i, reader, tree.RootHash(), hashFunc))
+	}
+
+	buf := &bytes.Buffer{}
+	err = tree.WriteMerkleProof(buf, 3)
+	assert.Nil(t, err)
+	encoded := buf.Bytes()
+	assert.Equal(t, 4+4*17, len(encoded))
+
+	err = VerifyProofStream(testHashes[4], 3, bytes.NewReader(encoded), tree.RootHash(), hashFunc)
+	assert.Equal(t, &ProofMismatchError{Index: 3}, err)
+
+	for _, length := range []int{0, 2, 4, 20, 4 + 4*17 - 1} {
+		err = VerifyProofStream(testHashes[3], 3, bytes.NewReader(encoded[:length]), tree.RootHash(), hashFunc)
+		assert.Equal(t, "Proof stream is truncated", err.Error())
+	}
+
+	//records sized for another hash function do not line up
+	err = VerifyProofStream(testHashes[3], 3, bytes.NewReader(encoded), tree.RootHash(), sha256.New())
+	assert.NotNil(t, err)
+
+	tampered := append([]byte{}, encoded...)
+	tampered[4] = 7
+	err = VerifyProofStream(testHashes[3], 3, bytes.NewReader(tampered), tree.RootHash(), hashFunc)
+	assert.Equal(t, "Invalid proof direction byte", err.Error())
+
+	//nothing is written for a leaf beyond the capacity, full tree or not
+	full := NewSMT(emptyHash, hashFunc)
+	err = full.Generate(testHashes, 16)
+	assert.Nil(t, err)
+	for _, tree := range []*SMT{tree, full} {
+		buf := &bytes.Buffer{}
+		err = tree.WriteMerkleProof(buf, 16)
+		assert.Equal(t, "Leaf number is out of range", err.Error())
+		assert.Equal(t, 0, buf.Len())
+	}
+}
+
+func TestCapacityInRoot(t *testing.T) {
+	small := NewSMT(emptyHash, hashFunc, WithCapacityInRoot())
+	err := small.Generate(testHashes[:4], 8)
+	assert.Nil(t, err)
+	large := NewSMT(emptyHash, hashFunc, WithCapacityInRoot())
+	err = large.Generate(testHashes[:4], 16)
+	assert.Nil(t, err)
+	plain := NewSMT(emptyHash, hashFunc)
+	err = plain.Generate(testHashes[:4], 8)
+	assert.Nil(t, err)
+
+	capacity := make([]byte, 8)
+	capacity[7] = 8
+	assert.Equal(t, hash2Value(plain.RootHash(), capacity, hashFunc), small.RootHash())
+	assert.NotEqual(t, small.RootHash(), large.RootHash())
+
+	proof, err := small.GetMerkleProof(2)
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyProofWithCapacity(testHashes[2], 2, proof, small.RootHash(), 8, hashFunc))
+	assert.NotNil(t, VerifyProof(testHashes[2], 2, proof, small.RootHash(), hashFunc))
+	err = VerifyProofWithCapacity(testHashes[2], 2, proof, small.RootHash(), 16, hashFunc)
+	assert.Equal(t, "Proof length does not match capacity", err.Error())
+
+	//a proof from the smaller tree is rejected by the larger one
+	assert.NotNil(t, VerifyProofWithCapacity(testHashes[2], 2, proof, large.RootHash(), 8, hashFunc))
+
+	frontier, err := NewFrontierTree(emptyHash, hashFunc, 16, WithCapacityInRoot())
+	assert.Nil(t, err)
+	for _, leaf := range testHashes[:4] {
+		err = frontier.PushLeaf(leaf)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, large.RootHash(), frontier.RootHash())
+}
+
+func TestVerifyFullSet(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:6], 8)
+	assert.Nil(t, err)
+	root := tree.RootHash()
+
+	leaves := map[uint]Hash{}
+	proofs := map[uint][]ProofNode{}
+	for i := uint(0); i < 6; i++ {
+		leaves[i] = testHashes[i]
+		proofs[i], _ = tree.GetMerkleProof(i)
+	}
+	assert.Nil(t, VerifyFullSet(leaves, proofs, root, hashFunc))
+
+	//the proof of leaf 4 taken from a tree with a different leaf 5 implies a
+	//different parent for leaves 4-7 than the earlier proofs committed to
+	other := NewSMT(emptyHash, hashFunc)
+	err = other.Generate(append(append([][]byte{}, testHashes[:5]...), testHashes[9]), 8)
+	assert.Nil(t, err)
+	tampered := map[uint][]ProofNode{}
+	for i, proof := range proofs {
+		tampered[i] = proof
+	}
+	tampered[4], _ = other.GetMerkleProof(4)
+	err = VerifyFullSet(leaves, tampered, root, hashFunc)
+	assert.Equal(t, "Proofs disagree on node 1 at height 2", err.Error())
+
+	delete(tampered, 4)
+	err = VerifyFullSet(leaves, tampered, root, hashFunc)
+	assert.Equal(t, "Leaves and proofs do not match", err.Error())
+	tampered[7] = proofs[4]
+	err = VerifyFullSet(leaves, tampered, root, hashFunc)
+	assert.Equal(t, "Missing proof for leaf 4", err.Error())
+
+	wrongRoot := map[uint][]ProofNode{0: proofs[0]}
+	err = VerifyFullSet(map[uint]Hash{0: testHashes[0]}, wrongRoot, other.RootHash(), hashFunc)
+	assert.Equal(t, "Proof for leaf 0 does not match the root", err.Error())
+}
+
+func TestVerifierMaxProofNodes(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:9], 16)
+	assert.Nil(t, err)
+	proof, err := tree.GetMerkleProof(3)
+	assert.Nil(t, err)
+
+	assert.Nil(t, NewVerifier(hashFunc).VerifyProof(testHashes[3], 3, proof, tree.RootHash()))
+	assert.Nil(t, NewVerifier(hashFunc, WithMaxProofNodes(4)).VerifyProof(testHashes[3], 3, proof, tree.RootHash()))
+	err = NewVerifier(hashFunc, WithMaxProofNodes(3)).VerifyProof(testHashes[3], 3, proof, tree.RootHash())
+	assert.Equal(t, "Proof has too many nodes", err.Error())
+
+	long := make([]ProofNode, DefaultMaxProofNodes+1)
+	for i := range long {
+		long[i] = ProofNode{Hash: emptyHash}
+	}
+	err = VerifyProof(testHashes[3], 3, long, tree.RootHash(), hashFunc)
+	assert.Equal(t, "Proof has too many nodes", err.Error())
+	_, err = VerifyAgainstRoots(testHashes[3], 3, long, [][]byte{tree.RootHash()}, hashFunc)
+	assert.Equal(t, "Proof has too many nodes", err.Error())
+	err = VerifyFullSet(map[uint]Hash{3: testHashes[3]}, map[uint][]ProofNode{3: long}, tree.RootHash(), hashFunc)
+	assert.Equal(t, "Proof has too many nodes", err.Error())
+
+	//the announced count is rejected before any record is read
+	header := []byte{0xff, 0xff, 0xff, 0xff}
+	err = VerifyProofStream(testHashes[3], 3, bytes.NewReader(header), tree.RootHash(), hashFunc)
+	assert.Equal(t, "Proof has too many nodes", err.Error())
+
+	buf := &bytes.Buffer{}
+	err = tree.WriteMerkleProof(buf, 3)
+	assert.Nil(t, err)
+	encoded := buf.Bytes()
+	assert.Nil(t, NewVerifier(hashFunc, WithMaxProofNodes(4)).VerifyProofStream(testHashes[3], 3, bytes.NewReader(encoded), tree.RootHash()))
+	err = NewVerifier(hashFunc, WithMaxProofNodes(3)).VerifyProofStream(testHashes[3], 3, bytes.NewReader(encoded), tree.RootHash())
+	assert.Equal(t, "Proof has too many nodes", err.Error())
+}
+
+func TestVerifierMaxLeafIndex(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:9], 16)
+	assert.Nil(t, err)
+	verifier := NewVerifier(hashFunc, WithMaxLeafIndex(4))
+	for leafNo := uint(0); leafNo < 9; leafNo++ {
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		buf := &bytes.Buffer{}
+		err = tree.WriteMerkleProof(buf, leafNo)
+		assert.Nil(t, err)
+		if leafNo <= 4 {
+			assert.Nil(t, verifier.VerifyProof(testHashes[leafNo], leafNo, proof, tree.RootHash()))
+			assert.Nil(t, verifier.VerifyProofStream(testHashes[leafNo], leafNo, buf, tree.RootHash()))
+			continue
+		}
+		err = verifier.VerifyProof(testHashes[leafNo], leafNo, proof, tree.RootHash())
+		assert.Equal(t, "Leaf number exceeds the maximum leaf index", err.Error())
+		err = verifier.VerifyProofStream(testHashes[leafNo], leafNo, buf, tree.RootHash())
+		assert.Equal(t, "Leaf number exceeds the maximum leaf index", err.Error())
+		//nothing was read from the stream
+		assert.Equal(t, 4+len(proof)*(1+hashFunc.Size()), buf.Len())
+	}
+	proof, err := tree.GetMerkleProof(8)
+	assert.Nil(t, err)
+	assert.Nil(t, NewVerifier(hashFunc).VerifyProof(testHashes[8], 8, proof, tree.RootHash()))
+}
+
+func TestVerifierLeafPrefix(t *testing.T) {
+	leaves := [][]byte{}
+	for _, leaf := range testHashes[:5] {
+		leaves = append(leaves, append([]byte{0x01}, leaf[1:]...))
+	}
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(leaves, 8)
+	assert.Nil(t, err)
+	verifier := NewVerifier(hashFunc, WithLeafPrefix([]byte{0x01}))
+	for leafNo := uint(0); leafNo < 5; leafNo++ {
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		assert.Nil(t, verifier.VerifyProof(leaves[leafNo], leafNo, proof, tree.RootHash()))
+		buf := &bytes.Buffer{}
+		err = tree.WriteMerkleProof(buf, leafNo)
+		assert.Nil(t, err)
+		assert.Nil(t, verifier.VerifyProofStream(leaves[leafNo], leafNo, buf, tree.RootHash()))
+	}
+
+	//the empty leaves are included but do not have the prefix
+	proof, err := tree.GetMerkleProof(5)
+	assert.Nil(t, err)
+	assert.Nil(t, NewVerifier(hashFunc).VerifyProof(emptyHash, 5, proof, tree.RootHash()))
+	err = verifier.VerifyProof(emptyHash, 5, proof, tree.RootHash())
+	assert.Equal(t, "Leaf does not have the required prefix", err.Error())
+	buf := &bytes.Buffer{}
+	err = tree.WriteMerkleProof(buf, 5)
+	assert.Nil(t, err)
+	err = verifier.VerifyProofStream(emptyHash, 5, buf, tree.RootHash())
+	assert.Equal(t, "Leaf does not have the required prefix", err.Error())
+
+	proof, err = tree.GetMerkleProof(0)
+	assert.Nil(t, err)
+	err = NewVerifier(hashFunc, WithLeafPrefix([]byte{0x02})).VerifyProof(leaves[0], 0, proof, tree.RootHash())
+	assert.Equal(t, "Leaf does not have the required prefix", err.Error())
+}
+
+func TestVerifierStrictDirections(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:2], 2)
+	assert.Nil(t, err)
+	root := tree.RootHash()
+	strict := NewVerifier(hashFunc, WithStrictDirections())
+
+	proof, err := tree.GetMerkleProof(1)
+	assert.Nil(t, err)
+	assert.Nil(t, strict.VerifyProof(testHashes[1], 1, proof, root))
+
+	//claiming leaf 0 with the proof of leaf 1 only passes the lax check
+	assert.Nil(t, VerifyProof(testHashes[1], 0, proof, root, hashFunc))
+	err = strict.VerifyProof(testHashes[1], 0, proof, root)
+	assert.Equal(t, "Proof directions do not match the leaf number", err.Error())
+	err = strict.VerifyProof(testHashes[1], 3, proof, root)
+	assert.Equal(t, "Proof directions do not match the leaf number", err.Error())
+
+	large := NewSMT(emptyHash, hashFunc)
+	err = large.Generate(testHashes[:11], 16)
+	assert.Nil(t, err)
+	proof, err = large.GetMerkleProof(6)
+	assert.Nil(t, err)
+	for flipped := range proof {
+		tampered := append([]ProofNode{}, proof...)
+		tampered[flipped].Left = !tampered[flipped].Left
+		err = strict.VerifyProof(testHashes[6], 6, tampered, large.RootHash())
+		assert.Equal(t, "Proof directions do not match the leaf number", err.Error())
+
+		encoded := &bytes.Buffer{}
+		err = WriteProof(encoded, tampered)
+		assert.Nil(t, err)
+		err = strict.VerifyProofStream(testHashes[6], 6, encoded, large.RootHash())
+		assert.Equal(t, "Proof directions do not match the leaf number", err.Error())
+	}
+
+	encoded := &bytes.Buffer{}
+	err = WriteProof(encoded, proof)
+	assert.Nil(t, err)
+	data := encoded.Bytes()
+	assert.Nil(t, strict.VerifyProofStream(testHashes[6], 6, bytes.NewReader(data), large.RootHash()))
+	err = strict.VerifyProofStream(testHashes[6], 22, bytes.NewReader(data), large.RootHash())
+	assert.Equal(t, "Proof directions do not match the leaf number", err.Error())
+}
+
+func TestDivergenceLevel(t *testing.T) {
+	base := NewSMT(emptyHash, hashFunc)
+	err := base.Generate(testHashes[:16], 16)
+	assert.Nil(t, err)
+	proof, err := base.GetMerkleProof(2)
+	assert.Nil(t, err)
+	assert.Equal(t, -1, DivergenceLevel(proof, proof))
+
+	//changing leaf n first shows up in the proof of leaf 2 where their paths meet
+	for leafNo, expected := range map[uint]int{3: 0, 0: 1, 6: 2, 13: 3} {
+		other := NewSMT(emptyHash, hashFunc)
+		err := other.Generate(testHashes[:16], 16)
+		assert.Nil(t, err)
+		err = other.UpdateLeaf(leafNo, hashValue([]byte("changed"), md5.New()))
+		assert.Nil(t, err)
+		otherProof, err := other.GetMerkleProof(2)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, DivergenceLevel(proof, otherProof))
+		assert.Equal(t, expected, DivergenceLevel(otherProof, proof))
+	}
+
+	assert.Equal(t, 2, DivergenceLevel(proof, proof[:2]))
+	assert.Equal(t, -1, DivergenceLevel(nil, nil))
+}
+
+func TestVerifyCompressedProof(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:5], 32)
+	assert.Nil(t, err)
+	chain, err := tree.EmptySubtreeRoots()
+	assert.Nil(t, err)
+
+	//compress by flagging every sibling that is an empty subtree root
+	compress := func(proof []ProofNode) ([]CompressedProofNode, int) {
+		compressed := []CompressedProofNode{}
+		flagged := 0
+		for i, node := range proof {
+			if bytes.Equal(node.Hash, chain[i]) {
+				compressed = append(compressed, CompressedProofNode{Left: node.Left, Empty: true})
+				flagged++
+			} else {
+				compressed = append(compressed, CompressedProofNode{Left: node.Left, Hash: node.Hash})
+			}
+		}
+		return compressed, flagged
+	}
+
+	for leafNo := uint(0); leafNo < 32; leafNo++ {
+		leaf := []byte(emptyHash)
+		if leafNo < 5 {
+			leaf = testHashes[leafNo]
+		}
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		compressed, _ := compress(proof)
+		assert.Nil(t, VerifyCompressedProof(leaf, leafNo, compressed, tree.RootHash(), chain, hashFunc))
+		//the chain is derived from the empty leaf alone
+		assert.Nil(t, VerifyCompressedProof(leaf, leafNo, compressed, tree.RootHash(), chain[:1], hashFunc))
+
+		expanded, err := ExpandProof(compressed, chain[:2], hashFunc)
+		assert.Nil(t, err)
+		assert.Equal(t, proof, expanded)
+	}
+
+	proof, err := tree.GetMerkleProof(4)
+	assert.Nil(t, err)
+	compressed, flagged := compress(proof)
+	assert.Equal(t, 4, flagged)
+	//flagging a non empty sibling breaks the proof
+	compressed[2] = CompressedProofNode{Left: compressed[2].Left, Empty: true}
+	assert.NotNil(t, VerifyCompressedProof(testHashes[4], 4, compressed, tree.RootHash(), chain, hashFunc))
+
+	_, err = ExpandProof(compressed, nil, hashFunc)
+	assert.Equal(t, "Empty subtree chain is empty", err.Error())
+}
+
+func TestVerifierReusableBuffer(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:11], 16)
+	assert.Nil(t, err)
+	verifier := NewVerifier(md5.New(), WithReusableBuffer())
+
+	for round := 0; round < 2; round++ {
+		for i := uint(0); i < 11; i++ {
+			proof, err := tree.GetMerkleProof(i)
+			assert.Nil(t, err)
+			assert.Nil(t, verifier.VerifyProof(testHashes[i], i, proof, tree.RootHash()))
+			assert.NotNil(t, verifier.VerifyProof(testHashes[(i+1)%11], i, proof, tree.RootHash()))
+		}
+	}
+	//the leaf hash given by the caller is never written
+	assert.Equal(t, hashValue([]byte("alpha0"), md5.New()), testHashes[0])
+	assert.Equal(t, md5.Size, cap(verifier.buffer))
+
+	//a leaf hash verified with an empty proof is not kept as the buffer
+	leafA := append(Hash{}, testHashes[0]...)
+	single := NewSMT(emptyHash, hashFunc)
+	err = single.Generate([][]byte{leafA}, 1)
+	assert.Nil(t, err)
+	verifier = NewVerifier(md5.New(), WithReusableBuffer())
+	assert.Nil(t, verifier.VerifyProof(leafA, 0, []ProofNode{}, single.RootHash()))
+	proof, err := tree.GetMerkleProof(1)
+	assert.Nil(t, err)
+	assert.Nil(t, verifier.VerifyProof(testHashes[1], 1, proof, tree.RootHash()))
+	assert.Equal(t, testHashes[0], []byte(leafA))
+
+	//nor is the output of a combiner
+	combined := NewVerifier(md5.New(), WithReusableBuffer(), WithCombiner(func(left, right []byte) ([]byte, error) {
+		return hashPair(md5.New(), left, right)
+	}))
+	assert.Nil(t, combined.VerifyProof(testHashes[1], 1, proof, tree.RootHash()))
+	assert.Nil(t, combined.buffer)
+}
+
+func BenchmarkVerifyProof(b *testing.B) {
+	benchmarkVerifyProof(b, NewVerifier(md5.New()))
+}
+
+func BenchmarkVerifyProof_ReusableBuffer(b *testing.B) {
+	benchmarkVerifyProof(b, NewVerifier(md5.New(), WithReusableBuffer()))
+}
+
+func benchmarkVerifyProof(b *testing.B, verifier *Verifier) {
+	tree := NewSMT(emptyHash, md5.New())
+	if err := tree.Generate(testHashes, 1<<20); err != nil {
+		b.Fatal(err)
+	}
+	proof, err := tree.GetMerkleProof(5)
+	if err != nil {
+		b.Fatal(err)
+	}
+	root := tree.RootHash()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := verifier.VerifyProof(testHashes[5], 5, proof, root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCombiner(t *testing.T) {
+	// Length prefixes both children
+	combine := func(left, right []byte) ([]byte, error) {
+		digest := md5.New()
+		for _, child := range [][]byte{left, right} {
+			digest.Write([]byte{byte(len(child))})
+			digest.Write(child)
+		}
+		return digest.Sum(nil), nil
+	}
+	tree := NewSMT(emptyHash, hashFunc, WithCombiner(combine))
+	err := tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	plain := NewSMT(emptyHash, hashFunc)
+	err = plain.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	assert.NotEqual(t, plain.RootHash(), tree.RootHash())
+
+	left, err := combine(testHashes[0], testHashes[1])
+	assert.Nil(t, err)
+	right, err := combine(testHashes[2], testHashes[3])
+	assert.Nil(t, err)
+	node, err := tree.NodeHash(2, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, Hash(left), node)
+	node, err = tree.NodeHash(1, 0)
+	assert.Nil(t, err)
+	expected, err := combine(left, right)
+	assert.Nil(t, err)
+	assert.Equal(t, Hash(expected), node)
+
+	pooled := NewSMT(emptyHash, hashFunc, WithCombiner(combine), WithBufferPool(&sync.Pool{}))
+	err = pooled.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	assert.Equal(t, tree.RootHash(), pooled.RootHash())
+
+	verifier := NewVerifier(hashFunc, WithCombiner(combine))
+	for leafNo := uint(0); leafNo < 8; leafNo++ {
+		leaf := Hash(emptyHash)
+		if leafNo < 5 {
+			leaf = testHashes[leafNo]
+		}
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		err = verifier.VerifyProof(leaf, leafNo, proof, tree.RootHash())
+		assert.Nil(t, err)
+		err = VerifyProof(leaf, leafNo, proof, tree.RootHash(), hashFunc)
+		assert.NotNil(t, err)
+
+		buf := &bytes.Buffer{}
+		err = tree.WriteMerkleProof(buf, leafNo)
+		assert.Nil(t, err)
+		err = verifier.VerifyProofStream(leaf, leafNo, buf, tree.RootHash())
+		assert.Nil(t, err)
+	}
+}
+
+func TestNormalizeProof(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:9], 16)
+	assert.Nil(t, err)
+
+	for leafNo := uint(0); leafNo < 16; leafNo++ {
+		leaf := Hash(emptyHash)
+		if leafNo < 9 {
+			leaf = testHashes[leafNo]
+		}
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		normalized, err := NormalizeProof(leafNo, proof)
+		assert.Nil(t, err)
+		assert.Equal(t, proof, normalized)
+		assert.False(t, IsReversedProof(leafNo, proof))
+
+		reversed := reverseProof(proof)
+		normalized, err = NormalizeProof(leafNo, reversed)
+		assert.Nil(t, err)
+		//0000, 0110, 1001 and 1111 read the same both ways
+		if leafNo == 0 || leafNo == 6 || leafNo == 9 || leafNo == 15 {
+			assert.Equal(t, reversed, normalized)
+			assert.False(t, IsReversedProof(leafNo, reversed))
+			continue
+		}
+		assert.True(t, IsReversedProof(leafNo, reversed))
+		assert.Nil(t, VerifyProof(leaf, leafNo, normalized, tree.RootHash(), hashFunc))
+	}
+
+	proof, err := tree.GetMerkleProof(1)
+	assert.Nil(t, err)
+	_, err = NormalizeProof(2, proof)
+	assert.Equal(t, "Proof directions do not match the leaf number", err.Error())
+}
+
+func TestLeafIndexFromProof(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:9], 16)
+	assert.Nil(t, err)
+	for leafNo := uint(0); leafNo < 16; leafNo++ {
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		assert.Equal(t, leafNo, LeafIndexFromProof(proof))
+	}
+	assert.Equal(t, uint(0), LeafIndexFromProof(nil))
+	assert.Equal(t, uint(5), LeafIndexFromProof([]ProofNode{{Left: true}, {Left: false}, {Left: true}, {Left: false}}))
+}
+
+func TestVerifyProofLazy(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+	roots, err := tree.EmptySubtreeRoots()
+	assert.Nil(t, err)
+
+	for leafNo := uint(0); leafNo < 16; leafNo++ {
+		leaf := Hash(emptyHash)
+		if leafNo < 5 {
+			leaf = testHashes[leafNo]
+		}
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		//the store only holds the non empty siblings
+		store := map[int]Hash{}
+		for level, node := range proof {
+			if !bytes.Equal(node.Hash, roots[level]) {
+				store[level] = node.Hash
+			}
+		}
+		fetched := 0
+		fetch := func(level int) (Hash, bool, error) {
+			fetched++
+			hash, ok := store[level]
+			return hash, !ok, nil
+		}
+		err = VerifyProofLazy(leaf, leafNo, 4, fetch, tree.RootHash(), emptyHash, hashFunc)
+		assert.Nil(t, err)
+		assert.Equal(t, 4, fetched)
+		err = VerifyProofLazy(testHashes[15], leafNo, 4, fetch, tree.RootHash(), emptyHash, hashFunc)
+		assert.Equal(t, &ProofMismatchError{Index: 3}, err)
+	}
+
+	failing := func(level int) (Hash, bool, error) {
+		if level == 2 {
+			return nil, false, errors.New("Store is unavailable")
+		}
+		return emptyHash, false, nil
+	}
+	err = VerifyProofLazy(testHashes[0], 0, 4, failing, tree.RootHash(), emptyHash, hashFunc)
+	assert.Equal(t, "Store is unavailable", err.Error())
+	err = VerifyProofLazy(testHashes[0], 16, 4, failing, tree.RootHash(), emptyHash, hashFunc)
+	assert.Equal(t, "Leaf number is out of range", err.Error())
+}
+
+func TestSalt(t *testing.T) {
+	trees := map[string]*SMT{}
+	for _, salt := range []string{"", "epoch1", "epoch2"} {
+		opts := []Option{}
+		if salt != "" {
+			opts = append(opts, WithSalt([]byte(salt)))
+		}
+		tree := NewSMT(emptyHash, hashFunc, opts...)
+		err := tree.Generate(testHashes[:5], 8)
+		assert.Nil(t, err)
+		trees[salt] = tree
+	}
+	assert.NotEqual(t, trees[""].RootHash(), trees["epoch1"].RootHash())
+	assert.NotEqual(t, trees["epoch1"].RootHash(), trees["epoch2"].RootHash())
+
+	left := hashValue(append(append([]byte("epoch1"), testHashes[0]...), testHashes[1]...), md5.New())
+	node, err := trees["epoch1"].NodeHash(2, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, Hash(left), node)
+
+	pooled := NewSMT(emptyHash, hashFunc, WithSalt([]byte("epoch1")), WithBufferPool(&sync.Pool{}))
+	err = pooled.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	assert.Equal(t, trees["epoch1"].RootHash(), pooled.RootHash())
+
+	for salt, tree := range trees {
+		for leafNo := uint(0); leafNo < 8; leafNo++ {
+			leaf := Hash(emptyHash)
+			if leafNo < 5 {
+				leaf = testHashes[leafNo]
+			}
+			proof, err := tree.GetMerkleProof(leafNo)
+			assert.Nil(t, err)
+			for verifierSalt := range trees {
+				verifier := NewVerifier(hashFunc)
+				if verifierSalt != "" {
+					verifier = NewVerifier(hashFunc, WithSalt([]byte(verifierSalt)))
+				}
+				err = verifier.VerifyProof(leaf, leafNo, proof, tree.RootHash())
+				if verifierSalt == salt {
+					assert.Nil(t, err)
+				} else {
+					assert.NotNil(t, err)
+				}
+			}
+		}
+	}
+}
+
+func TestRootedProof(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	_, err := tree.GetRootedProof(0)
+	assert.Equal(t, "SMT tree is not filled", err.Error())
+	err = tree.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	other := NewSMT(emptyHash, hashFunc)
+	err = other.Generate(testHashes[:6], 8)
+	assert.Nil(t, err)
+
+	for leafNo := uint(0); leafNo < 5; leafNo++ {
+		proof, err := tree.GetRootedProof(leafNo)
+		assert.Nil(t, err)
+		assert.Equal(t, leafNo, proof.LeafNo)
+		assert.Equal(t, tree.RootHash(), proof.Root)
+		assert.Nil(t, VerifyRootedProof(testHashes[leafNo], proof, tree.RootHash(), hashFunc))
+
+		err = VerifyRootedProof(testHashes[leafNo], proof, other.RootHash(), hashFunc)
+		assert.Equal(t, "Proof targets a different root", err.Error())
+		err = VerifyRootedProof(testHashes[7], proof, tree.RootHash(), hashFunc)
+		assert.NotNil(t, err)
+		//a root swapped into the proof is caught by the recomputation
+		forged := proof
+		forged.Root = other.RootHash()
+		err = VerifyRootedProof(testHashes[leafNo], forged, other.RootHash(), hashFunc)
+		assert.NotNil(t, err)
+	}
+
+	_, err = tree.GetRootedProof(8)
+	assert.Equal(t, "Leaf number is out of range", err.Error())
+	bound := NewSMT(emptyHash, hashFunc, WithCapacityInRoot())
+	err = bound.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	_, err = bound.GetRootedProof(0)
+	assert.Equal(t, "Rooted proofs do not support capacity bound roots", err.Error())
+	salted := NewSMT(emptyHash, hashFunc, WithSalt([]byte("salt")))
+	err = salted.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	_, err = salted.GetRootedProof(0)
+	assert.Equal(t, "Rooted proofs do not support salted nodes", err.Error())
+	combined := NewSMT(emptyHash, hashFunc, WithCombiner(swapCombiner))
+	err = combined.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	_, err = combined.GetRootedProof(0)
+	assert.Equal(t, "Rooted proofs do not support node combiners", err.Error())
+}
+
+// Converts a sha256 proof for VerifyProof32
+func proof32(proof []ProofNode) ([][32]byte, []bool) {
+	hashes := make([][32]byte, len(proof))
+	dirs := make([]bool, len(proof))
+	for i, node := range proof {
+		copy(hashes[i][:], node.Hash)
+		dirs[i] = node.Left
+	}
+	return hashes, dirs
+}
+
+func TestVerifyProof32(t *testing.T) {
+	leaves := [][]byte{}
+	for _, leaf := range testHashes[:5] {
+		leaves = append(leaves, hashValue(leaf, sha256.New()))
+	}
+	emptyHash32 := hashValue(nil, sha256.New())
+	tree := NewSMT(emptyHash32, sha256.New())
+	err := tree.Generate(leaves, 8)
+	assert.Nil(t, err)
+	var root [32]byte
+	copy(root[:], tree.RootHash())
+
+	for leafNo := uint(0); leafNo < 8; leafNo++ {
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		hashes, dirs := proof32(proof)
+		for _, candidate := range [][]byte{leaves[0], leaves[4], emptyHash32} {
+			var leaf [32]byte
+			copy(leaf[:], candidate)
+			generic := VerifyProof(candidate, leafNo, proof, tree.RootHash(), sha256.New()) == nil
+			assert.Equal(t, generic, VerifyProof32(leaf, leafNo, hashes, dirs, root, sha256.New))
+		}
+	}
+
+	proof, err := tree.GetMerkleProof(0)
+	assert.Nil(t, err)
+	hashes, dirs := proof32(proof)
+	var leaf [32]byte
+	copy(leaf[:], leaves[0])
+	assert.True(t, VerifyProof32(leaf, 0, hashes, dirs, root, sha256.New))
+	assert.False(t, VerifyProof32(leaf, 0, hashes, dirs[1:], root, sha256.New))
+	assert.False(t, VerifyProof32(leaf, 0, hashes, dirs, root, md5.New))
+
+	//the leaf number must match the directions and fit the proof
+	assert.False(t, VerifyProof32(leaf, 1, hashes, dirs, root, sha256.New))
+	assert.False(t, VerifyProof32(leaf, 8, hashes, dirs, root, sha256.New))
+	assert.False(t, VerifyProof32(leaf, 999, hashes[:2], dirs[:2], root, sha256.New))
+}
+
+func benchmarkVerify32Proof(b *testing.B) (*SMT, []ProofNode) {
+	leaves := make([][]byte, 1<<10)
+	for i := range leaves {
+		leaves[i] = hashValue([]byte{byte(i), byte(i >> 8)}, sha256.New())
+	}
+	tree := NewSMT(hashValue(nil, sha256.New()), sha256.New())
+	if err := tree.Generate(leaves, len(leaves)); err != nil {
+		b.Fatal(err)
+	}
+	proof, err := tree.GetMerkleProof(3)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return tree, proof
+}
+
+func BenchmarkVerifyProof_SHA256(b *testing.B) {
+	tree, proof := benchmarkVerify32Proof(b)
+	leaf := hashValue([]byte{3, 0}, sha256.New())
+	verifier := NewVerifier(sha256.New())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := verifier.VerifyProof(leaf, 3, proof, tree.RootHash()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVerifyProof32(b *testing.B) {
+	tree, proof := benchmarkVerify32Proof(b)
+	hashes, dirs := proof32(proof)
+	var leaf, root [32]byte
+	copy(leaf[:], hashValue([]byte{3, 0}, sha256.New()))
+	copy(root[:], tree.RootHash())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !VerifyProof32(leaf, 3, hashes, dirs, root, sha256.New) {
+			b.Fatal("proof does not verify")
+		}
+	}
+}
+
+func TestVerifyBatch(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:9], 16)
+	assert.Nil(t, err)
+	items := []BatchItem{}
+	for leafNo := uint(0); leafNo < 9; leafNo++ {
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		items = append(items, BatchItem{LeafHash: testHashes[leafNo], LeafNo: leafNo, Proof: proof})
+	}
+
+	results, failed := VerifyBatch(items, tree.RootHash(), hashFunc)
+	assert.Equal(t, -1, failed)
+	assert.Equal(t, make([]error, 9), results)
+
+	//two failures in the middle of the batch
+	items[4].LeafHash = testHashes[5]
+	items[6].Proof = items[7].Proof
+	results, failed = VerifyBatch(items, tree.RootHash(), hashFunc)
+	assert.Equal(t, 4, failed)
+	assert.Len(t, results, 9)
+	for i, err := range results {
+		if i == 4 || i == 6 {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+
+	results, failed = NewVerifier(hashFunc, WithFailFast()).VerifyBatch(items, tree.RootHash())
+	assert.Equal(t, 4, failed)
+	assert.Len(t, results, 5)
+	assert.Equal(t, make([]error, 4), results[:4])
+	assert.NotNil(t, results[4])
+}
+
+func TestVerifyProofExpectHeight(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+	proof, err := tree.GetMerkleProof(3)
+	assert.Nil(t, err)
+
+	count := 0
+	counting := NewHashCountDecorator(md5.New(), &count)
+	assert.Nil(t, VerifyProofExpectHeight(testHashes[3], 3, proof, tree.RootHash(), 5, counting))
+	assert.Equal(t, 4, count)
+
+	count = 0
+	for _, height := range []int{0, 4, 6} {
+		err = VerifyProofExpectHeight(testHashes[3], 3, proof, tree.RootHash(), height, counting)
+		assert.Equal(t, "Proof length does not match tree height", err.Error())
+	}
+	err = VerifyProofExpectHeight(testHashes[3], 3, proof[:3], tree.RootHash(), 5, counting)
+	assert.Equal(t, "Proof length does not match tree height", err.Error())
+	assert.Equal(t, 0, count)
+}
+
+func TestStreamVerifier(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:5], 16)
+	assert.Nil(t, err)
+	proofs := [][]ProofNode{}
+	for leafNo := uint(0); leafNo < 6; leafNo++ {
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		proofs = append(proofs, proof)
+	}
+
+	stream := NewStreamVerifier(tree.RootHash(), emptyHash, hashFunc)
+	assert.Equal(t, "No leaves were verified", stream.Done().Error())
+	for leafNo := uint(0); leafNo < 5; leafNo++ {
+		assert.Nil(t, stream.Add(leafNo, testHashes[leafNo], proofs[leafNo]))
+	}
+	assert.Nil(t, stream.Done())
+
+	//a stream ending early misses leaves
+	stream = NewStreamVerifier(tree.RootHash(), emptyHash, hashFunc)
+	for leafNo := uint(0); leafNo < 3; leafNo++ {
+		assert.Nil(t, stream.Add(leafNo, testHashes[leafNo], proofs[leafNo]))
+	}
+	assert.Equal(t, "Leaves are missing after leaf 2", stream.Done().Error())
+
+	//a gap
+	err = stream.Add(4, testHashes[4], proofs[4])
+	assert.Equal(t, "Leaf number does not follow the previous leaves", err.Error())
+
+	//an inconsistent proof is not recorded
+	err = stream.Add(3, testHashes[3], proofs[4])
+	assert.NotNil(t, err)
+	assert.Nil(t, stream.Add(3, testHashes[3], proofs[3]))
+	assert.Nil(t, stream.Add(4, testHashes[4], proofs[4]))
+	assert.Nil(t, stream.Done())
+
+	//the proof of leaf 0 does not stand for the following leaves
+	stream = NewStreamVerifier(tree.RootHash(), emptyHash, hashFunc)
+	assert.Nil(t, stream.Add(0, testHashes[0], proofs[0]))
+	for i := 0; i < 2; i++ {
+		err = stream.Add(1, testHashes[0], proofs[0])
+		assert.Equal(t, errDirectionMismatch, err)
+	}
+	err = stream.Add(2, testHashes[0], proofs[0])
+	assert.Equal(t, "Leaf number does not follow the previous leaves", err.Error())
+
+	//raw leaves are hashed with the leaf hash
+	hashed := NewSMT(emptyHash, hashFunc, WithLeafHash(md5.New))
+	err = hashed.Generate(testHashes[:2], 4)
+	assert.Nil(t, err)
+	stream = NewStreamVerifier(hashed.RootHash(), emptyHash, hashFunc, WithLeafHash(md5.New))
+	for leafNo := uint(0); leafNo < 2; leafNo++ {
+		proof, err := hashed.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		assert.Nil(t, stream.Add(leafNo, testHashes[leafNo], proof))
+	}
+	assert.Nil(t, stream.Done())
+}
+
+func TestLeafIndexBinding(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithLeafIndexBinding()},
+		{WithLeafIndexBinding(), WithLeafHash(md5.New)},
+	} {
+		tree := NewSMT(emptyHash, hashFunc, opts...)
+		//the same value at two positions is stored differently
+		leaves := [][]byte{testHashes[0], testHashes[1], testHashes[0], testHashes[3]}
+		err := tree.Generate(leaves, 8)
+		assert.Nil(t, err)
+		assert.NotEqual(t, tree.fullNodes[0][0], tree.fullNodes[0][2])
+
+		verifier := NewVerifier(hashFunc, opts...)
+		for leafNo, leaf := range leaves {
+			proof, err := tree.GetMerkleProof(uint(leafNo))
+			assert.Nil(t, err)
+			assert.Nil(t, verifier.VerifyLeaf(leaf, uint(leafNo), proof, tree.RootHash()))
+		}
+
+		//a valid proof replayed at another position fails, even though the
+		//proof directions are not checked
+		proof, err := tree.GetMerkleProof(1)
+		assert.Nil(t, err)
+		assert.NotNil(t, verifier.VerifyLeaf(leaves[1], 0, proof, tree.RootHash()))
+		assert.NotNil(t, verifier.VerifyLeaf(leaves[1], 3, proof, tree.RootHash()))
+
+		//updates and appends bind the leaf position too
+		err = tree.UpdateLeaf(1, testHashes[5])
+		assert.Nil(t, err)
+		_, err = tree.AppendLeaves([][]byte{testHashes[6]})
+		assert.Nil(t, err)
+		for leafNo, leaf := range [][]byte{testHashes[5], testHashes[6]} {
+			leafNo := uint(leafNo)*3 + 1
+			proof, err := tree.GetMerkleProof(leafNo)
+			assert.Nil(t, err)
+			assert.Nil(t, verifier.VerifyLeaf(leaf, leafNo, proof, tree.RootHash()))
+		}
+	}
+
+	//an unbound tree does not verify with a binding verifier
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:2], 2)
+	assert.Nil(t, err)
+	proof, err := tree.GetMerkleProof(0)
+	assert.Nil(t, err)
+	assert.Nil(t, NewVerifier(hashFunc).VerifyLeaf(testHashes[0], 0, proof, tree.RootHash()))
+	assert.NotNil(t, NewVerifier(hashFunc, WithLeafIndexBinding()).VerifyLeaf(testHashes[0], 0, proof, tree.RootHash()))
+}
+
+func TestVerifyProofSplit(t *testing.T) {
+	tree := NewSMT(emptyHash, hashFunc)
+	err := tree.Generate(testHashes[:11], 16)
+	assert.Nil(t, err)
+	root := tree.RootHash()
+	for leafNo := uint(0); leafNo < 16; leafNo++ {
+		leafHash := Hash(emptyHash)
+		if leafNo < 11 {
+			leafHash = testHashes[leafNo]
+		}
+		proof, err := tree.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		siblings := []Hash{}
+		directions := []bool{}
+		for _, node := range proof {
+			siblings = append(siblings, node.Hash)
+			directions = append(directions, node.Left)
+		}
+		assert.Nil(t, VerifyProof(leafHash, leafNo, proof, root, hashFunc))
+		assert.Nil(t, VerifyProofSplit(leafHash, siblings, directions, root, hashFunc))
+
+		//both reject the same tampering
+		tampered := append(Hash{}, siblings[1]...)
+		tampered[0] ^= 1
+		siblings[1] = tampered
+		proof[1].Hash = tampered
+		assert.NotNil(t, VerifyProof(leafHash, leafNo, proof, root, hashFunc))
+		assert.Equal(t, &ProofMismatchError{Index: 3}, VerifyProofSplit(leafHash, siblings, directions, root, hashFunc))
+	}
+
+	err = VerifyProofSplit(testHashes[0], []Hash{testHashes[1]}, []bool{}, root, hashFunc)
+	assert.Equal(t, "Siblings and directions have different lengths", err.Error())
+}
+
+func TestRootTag(t *testing.T) {
+	plain := NewSMT(emptyHash, hashFunc)
+	err := plain.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	tagged := NewSMT(emptyHash, hashFunc, WithRootTag([]byte("protocol")))
+	err = tagged.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	expected, _ := hashPair(hashFunc, []byte("protocol"), plain.RootHash())
+	assert.Equal(t, expected, tagged.RootHash())
+	assert.NotEqual(t, plain.RootHash(), tagged.RootHash())
+
+	verifier := NewVerifier(hashFunc, WithRootTag([]byte("protocol")))
+	for leafNo := uint(0); leafNo < 5; leafNo++ {
+		proof, err := tagged.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		assert.Nil(t, verifier.VerifyProof(testHashes[leafNo], leafNo, proof, tagged.RootHash()))
+		buf := new(bytes.Buffer)
+		assert.Nil(t, WriteProof(buf, proof))
+		assert.Nil(t, verifier.VerifyProofStream(testHashes[leafNo], leafNo, buf, tagged.RootHash()))
+
+		//verification enforces the tag
+		assert.NotNil(t, VerifyProof(testHashes[leafNo], leafNo, proof, tagged.RootHash(), hashFunc))
+		other := NewVerifier(hashFunc, WithRootTag([]byte("other")))
+		assert.NotNil(t, other.VerifyProof(testHashes[leafNo], leafNo, proof, tagged.RootHash()))
+		assert.NotNil(t, verifier.VerifyProof(testHashes[leafNo], leafNo, proof, plain.RootHash()))
+	}
+
+	//the tag applies after the capacity binding
+	bound := NewSMT(emptyHash, hashFunc, WithCapacityInRoot(), WithRootTag([]byte("protocol")))
+	err = bound.Generate(testHashes[:5], 8)
+	assert.Nil(t, err)
+	capacityRoot, _ := bindCapacity(hashFunc, plain.RootHash(), 8)
+	expected, _ = hashPair(hashFunc, []byte("protocol"), capacityRoot)
+	assert.Equal(t, expected, bound.RootHash())
+	boundVerifier := NewVerifier(hashFunc, WithCapacityInRoot(), WithRootTag([]byte("protocol")))
+	for leafNo := uint(0); leafNo < 8; leafNo++ {
+		leafHash := Hash(emptyHash)
+		if leafNo < 5 {
+			leafHash = testHashes[leafNo]
+		}
+		proof, err := bound.GetMerkleProof(leafNo)
+		assert.Nil(t, err)
+		assert.Nil(t, boundVerifier.VerifyProof(leafHash, leafNo, proof, bound.RootHash()))
+		assert.Nil(t, VerifyTaggedProofWithCapacity(leafHash, leafNo, proof, bound.RootHash(), 8, []byte("protocol"), hashFunc))
+		assert.NotNil(t, VerifyTaggedProofWithCapacity(leafHash, leafNo, proof, bound.RootHash(), 8, []byte("other"), hashFunc))
+		assert.NotNil(t, VerifyProofWithCapacity(leafHash, leafNo, proof, bound.RootHash(), 8, hashFunc))
+		assert.NotNil(t, verifier.VerifyProof(leafHash, leafNo, proof, bound.RootHash()))
+	}
+	//a proof of a smaller tree does not verify against the larger root
+	small := NewSMT(emptyHash, hashFunc, WithCapacityInRoot(), WithRootTag([]byte("protocol")))
+	err = small.Generate(testHashes[:4], 4)
+	assert.Nil(t, err)
+	proof, err := small.GetMerkleProof(0)
+	assert.Nil(t, err)
+	assert.NotNil(t, boundVerifier.VerifyProof(testHashes[0], 0, proof, bound.RootHash()))
+	assert.Nil(t, boundVerifier.VerifyProof(testHashes[0], 0, proof, small.RootHash()))
+
+	_, err = tagged.GetRootedProof(0)
+	assert.Equal(t, "Rooted proofs do not support tagged roots", err.Error())
+}
+
+func TestVerifierWithHash(t *testing.T) {
+	// One verifier, defaulting to md5, checks proofs of trees of other hashes
+	verifier := NewVerifier(md5.New(), WithStrictDirections())
+	for _, factory := range []func() hash.Hash{sha256.New, sha512.New} {
+		tree := NewSMT(make(Hash, factory().Size()), factory())
+		leaves := [][]byte{}
+		for i := 0; i < 5; i++ {
+			leaf, _ := hashLeaf(factory(), []byte{byte(i)})
+			leaves = append(leaves, leaf)
+		}
+		err := tree.Generate(leaves, 8)
+		assert.Nil(t, err)
+
+		adapted := verifier.WithHash(factory())
+		assert.True(t, adapted.strict)
+		for leafNo, leaf := range leaves {
+			proof, err := tree.GetMerkleProof(uint(leafNo))
+			assert.Nil(t, err)
+			assert.Nil(t, adapted.VerifyProof(leaf, uint(leafNo), proof, tree.RootHash()))
+			assert.Nil(t, VerifyProof(leaf, uint(leafNo), proof, tree.RootHash(), factory()))
+			assert.NotNil(t, verifier.VerifyProof(leaf, uint(leafNo), proof, tree.RootHash()))
+		}
+		//the options still apply
+		proof, err := tree.GetMerkleProof(1)
+		assert.Nil(t, err)
+		assert.Equal(t, errDirectionMismatch, adapted.VerifyProof(leaves[1], 0, proof, tree.RootHash()))
+	}
+	//the other hash sizes do not verify against each other
+	sha512Tree := NewSMT(make(Hash, 64), sha512.New())
+	err := sha512Tree.Generate([][]byte{make([]byte, 64)}, 2)
+	assert.Nil(t, err)
+	proof, err := sha512Tree.GetMerkleProof(0)
+	assert.Nil(t, err)
+	assert.NotNil(t, verifier.WithHash(sha256.New()).VerifyProof(make([]byte, 64), 0, proof, sha512Tree.RootHash()))
+}
+
+func TestVerifierRejectsTreeOptions(t *testing.T) {
+	treeOnly := []Option{
+		WithSecureErase(),
+		WithOperationLog(),
+		WithSortedLeaves(),
+		WithIndexedLeaves(),
+		WithPaddingLeaf(testHashes[0]),
+		WithEmptyNodeSeed([]byte("seed")),
+		WithHexPrefix(),
+		WithUniqueLeaves(),
+	}
+	for _, opt := range treeOnly {
+		assert.Panics(t, func() { NewVerifier(hashFunc, opt) })
+		verifier, err := NewVerifierE(hashFunc, opt)
+		assert.Nil(t, verifier)
+		assert.NotNil(t, err)
+	}
+	_, err := NewVerifierE(hashFunc, WithStrictDirections(), WithPaddingLeaf(testHashes[0]))
+	assert.Equal(t, "WithPaddingLeaf is not supported by Verifier", err.Error())
+
+	//options a verifier honours are still accepted
+	verifier, err := NewVerifierE(hashFunc, WithCapacityInRoot(), WithStrictDirections(), WithRootTag([]byte("tag")),
+		WithMaxProofNodes(8), WithReusableBuffer(), WithSalt([]byte("salt")), WithFailFast())
+	assert.Nil(t, err)
+	assert.NotNil(t, verifier)
+}